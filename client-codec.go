@@ -0,0 +1,80 @@
+package zephyr
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes request bodies and decodes response bodies for the typed
+// client helpers, such as GetJSON, PostJSON and DoJSON. ServiceClients use
+// JSONCodec unless they are given another codec with WithCodec.
+type Codec interface {
+	// ContentType is sent as the Content-Type of request bodies, and as the
+	// Accept header of requests.
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// JSONCodec encodes and decodes bodies as JSON.
+	JSONCodec Codec = jsonCodec{}
+
+	// MsgpackCodec encodes and decodes bodies as msgpack. It falls back to
+	// json struct tags for fields without a msgpack tag, so the same types
+	// can be shared with services speaking JSON.
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := msgpack.NewEncoder(buf)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+// hasContentType reports whether the given Content-Type header names the
+// same media type as the codec, ignoring any parameters such as charset.
+func hasContentType(codec Codec, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	codecMediaType, _, err := mime.ParseMediaType(codec.ContentType())
+	if err != nil {
+		return false
+	}
+	return mediaType == codecMediaType
+}
@@ -0,0 +1,159 @@
+package zephyr
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// StatusError is returned by the typed client helpers when a service responds
+// with a status outside of the 2xx range. Body holds the whole response body.
+// If the body was encoded with the client's codec and has an "error" or
+// "message" field, Message holds its value. Other structured error bodies can
+// be decoded with Decode.
+type StatusError struct {
+	Service    string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Message    string
+
+	codec Codec
+}
+
+var _ error = &StatusError{}
+
+func (e *StatusError) Error() string {
+	status := fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message == "" {
+		return fmt.Sprintf("service %s responded with %s", e.Service, status)
+	}
+	return fmt.Sprintf("service %s responded with %s: %s", e.Service, status, e.Message)
+}
+
+// Decode decodes the body of the error response into v, using the codec of
+// the client which made the request.
+func (e *StatusError) Decode(v any) error {
+	codec := e.codec
+	if codec == nil {
+		codec = JSONCodec
+	}
+	return codec.Unmarshal(e.Body, v)
+}
+
+// errorBody is the shape of the structured error bodies which StatusError
+// picks its Message from.
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func newStatusError(c *ServiceClient, res *http.Response, body []byte) *StatusError {
+	codec := c.codec()
+	statusErr := &StatusError{
+		Service:    c.Name,
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Body:       body,
+		codec:      codec,
+	}
+	if len(body) > 0 && hasContentType(codec, res.Header.Get("Content-Type")) {
+		decodedBody := errorBody{}
+		if err := codec.Unmarshal(body, &decodedBody); err == nil {
+			statusErr.Message = decodedBody.Error
+			if statusErr.Message == "" {
+				statusErr.Message = decodedBody.Message
+			}
+		}
+	}
+	return statusErr
+}
+
+// GetJSON sends a GET request to the service, and decodes the response body
+// into a Resp with the client's codec.
+//
+//	item, err := zephyr.GetJSON[Item](client.Service("items"), "/items/1")
+func GetJSON[Resp any](c *ServiceClient, servicePath string) (Resp, error) {
+	req, err := http.NewRequest(http.MethodGet, servicePath, nil)
+	if err != nil {
+		var resp Resp
+		return resp, err
+	}
+	return DoJSON[Resp](c, req)
+}
+
+// PostJSON encodes body with the client's codec, sends it to the service in a
+// POST request, and decodes the response body into a Resp.
+//
+//	created, err := zephyr.PostJSON[NewItem, Item](client.Service("items"), "/items", newItem)
+func PostJSON[Req, Resp any](c *ServiceClient, servicePath string, body Req) (Resp, error) {
+	req, err := newEncodedRequest(c.codec(), http.MethodPost, servicePath, body)
+	if err != nil {
+		var resp Resp
+		return resp, err
+	}
+	return DoJSON[Resp](c, req)
+}
+
+// DoJSON sends an HTTP request to the service with Do, and decodes the
+// response body into a Resp with the client's codec. If the request has no
+// Accept header, it is set to the codec's content type.
+//
+// If the service responds with a status outside of the 2xx range, a
+// *StatusError is returned. An empty response body, such as that of a 204
+// response, leaves the returned Resp as its zero value.
+func DoJSON[Resp any](c *ServiceClient, req *http.Request) (Resp, error) {
+	var resp Resp
+	err := c.doDecoded(req, &resp)
+	return resp, err
+}
+
+// doDecoded sends the request with Do, and decodes the response body into v
+// with the client's codec. It backs DoJSON and RequestBuilder.Decode.
+func (c *ServiceClient) doDecoded(req *http.Request, v any) error {
+	codec := c.codec()
+
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", codec.ContentType())
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response from service %s: %w", c.Name, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		clientRequestDebug.Tracef("Request to %s responded with status %d", c.Name, res.StatusCode)
+		return newStatusError(c, res, body)
+	}
+	if len(body) == 0 || v == nil {
+		return nil
+	}
+	if err := codec.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to decode response from service %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// newEncodedRequest creates a request with the given body encoded by codec.
+func newEncodedRequest(codec Codec, method string, servicePath string, body any) (*http.Request, error) {
+	bodyBuf, err := codec.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request body: %w", err)
+	}
+	req, err := http.NewRequest(method, servicePath, bytes.NewReader(bodyBuf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", codec.ContentType())
+	return req, nil
+}
@@ -0,0 +1,175 @@
+package zephyr_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+	localtransport "github.com/telemetrytv/zephyr/local-transport"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type jsonItem struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func startJSONService(t *testing.T, handler func(res http.ResponseWriter, req *http.Request)) *zephyr.ServiceClient {
+	t.Helper()
+	transport := localtransport.New()
+	service := zephyr.NewService("items", transport, func(ctx *navaros.Context) {
+		handler(ctx.ResponseWriter(), ctx.Request())
+	})
+	require.NoError(t, service.Start())
+	t.Cleanup(service.Stop)
+	return zephyr.NewClient(transport).Service("items")
+}
+
+func TestGetJSON(t *testing.T) {
+	t.Run("Will decode the response body", func(t *testing.T) {
+		var recvAccept string
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			recvAccept = req.Header.Get("Accept")
+			assert.Equal(t, http.MethodGet, req.Method)
+			assert.Equal(t, "/items/1", req.URL.Path)
+			res.Header().Set("Content-Type", "application/json")
+			_, _ = res.Write([]byte(`{"id":1,"name":"widget"}`))
+		})
+
+		item, err := zephyr.GetJSON[jsonItem](client, "/items/1")
+		require.NoError(t, err)
+		assert.Equal(t, jsonItem{ID: 1, Name: "widget"}, item)
+		assert.Equal(t, "application/json", recvAccept)
+	})
+
+	t.Run("Will return a StatusError carrying the status and body", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Content-Type", "application/json; charset=utf-8")
+			res.WriteHeader(http.StatusNotFound)
+			_, _ = res.Write([]byte(`{"error":"item 1 not found","code":"not_found"}`))
+		})
+
+		_, err := zephyr.GetJSON[jsonItem](client, "/items/1")
+		var statusErr *zephyr.StatusError
+		require.ErrorAs(t, err, &statusErr)
+		assert.Equal(t, "items", statusErr.Service)
+		assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+		assert.Equal(t, "item 1 not found", statusErr.Message)
+		assert.JSONEq(t, `{"error":"item 1 not found","code":"not_found"}`, string(statusErr.Body))
+		assert.Equal(t, "service items responded with 404 Not Found: item 1 not found", err.Error())
+
+		var errBody struct {
+			Code string `json:"code"`
+		}
+		require.NoError(t, statusErr.Decode(&errBody))
+		assert.Equal(t, "not_found", errBody.Code)
+	})
+
+	t.Run("Will keep plain text error bodies without a message", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			http.Error(res, "nope", http.StatusForbidden)
+		})
+
+		_, err := zephyr.GetJSON[jsonItem](client, "/items/1")
+		var statusErr *zephyr.StatusError
+		require.ErrorAs(t, err, &statusErr)
+		assert.Equal(t, http.StatusForbidden, statusErr.StatusCode)
+		assert.Empty(t, statusErr.Message)
+		assert.Equal(t, "nope\n", string(statusErr.Body))
+		assert.Equal(t, "service items responded with 403 Forbidden", err.Error())
+	})
+
+	t.Run("Will return an error if the response cannot be decoded", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			_, _ = res.Write([]byte("not json"))
+		})
+
+		_, err := zephyr.GetJSON[jsonItem](client, "/items/1")
+		var syntaxErr *json.SyntaxError
+		assert.ErrorAs(t, err, &syntaxErr)
+	})
+
+	t.Run("Will return the remote error if the handler fails", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			panic("boom")
+		})
+
+		_, err := zephyr.GetJSON[jsonItem](client, "/items/1")
+		var remoteErr *zephyr.RemoteError
+		assert.ErrorAs(t, err, &remoteErr)
+	})
+}
+
+func TestPostJSON(t *testing.T) {
+	t.Run("Will encode the request body and decode the response body", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, http.MethodPost, req.Method)
+			assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+			var item jsonItem
+			assert.NoError(t, json.NewDecoder(req.Body).Decode(&item))
+			item.ID = 7
+			res.WriteHeader(http.StatusCreated)
+			assert.NoError(t, json.NewEncoder(res).Encode(item))
+		})
+
+		item, err := zephyr.PostJSON[jsonItem, jsonItem](client, "/items", jsonItem{Name: "widget"})
+		require.NoError(t, err)
+		assert.Equal(t, jsonItem{ID: 7, Name: "widget"}, item)
+	})
+
+	t.Run("Will leave the response as its zero value if the body is empty", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			res.WriteHeader(http.StatusNoContent)
+		})
+
+		item, err := zephyr.PostJSON[jsonItem, *jsonItem](client, "/items", jsonItem{Name: "widget"})
+		require.NoError(t, err)
+		assert.Nil(t, item)
+	})
+
+	t.Run("Will use the client's codec", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, "application/msgpack", req.Header.Get("Content-Type"))
+			assert.Equal(t, "application/msgpack", req.Header.Get("Accept"))
+			body, err := io.ReadAll(req.Body)
+			assert.NoError(t, err)
+			var item map[string]any
+			assert.NoError(t, msgpack.Unmarshal(body, &item))
+			assert.Equal(t, "widget", item["name"])
+
+			res.Header().Set("Content-Type", "application/msgpack")
+			res.WriteHeader(http.StatusConflict)
+			buf, err := msgpack.Marshal(map[string]string{"message": "widget already exists"})
+			assert.NoError(t, err)
+			_, _ = res.Write(buf)
+		})
+
+		_, err := zephyr.PostJSON[jsonItem, jsonItem](client.WithCodec(zephyr.MsgpackCodec), "/items", jsonItem{Name: "widget"})
+		var statusErr *zephyr.StatusError
+		require.ErrorAs(t, err, &statusErr)
+		assert.Equal(t, http.StatusConflict, statusErr.StatusCode)
+		assert.Equal(t, "widget already exists", statusErr.Message)
+	})
+}
+
+func TestDoJSON(t *testing.T) {
+	t.Run("Will keep the Accept header of the request", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, http.MethodPut, req.Method)
+			assert.Equal(t, "application/vnd.items+json", req.Header.Get("Accept"))
+			_, _ = res.Write([]byte(`{"id":1,"name":"renamed"}`))
+		})
+
+		req, err := http.NewRequest(http.MethodPut, "/items/1", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", "application/vnd.items+json")
+		item, err := zephyr.DoJSON[jsonItem](client, req)
+		require.NoError(t, err)
+		assert.Equal(t, jsonItem{ID: 1, Name: "renamed"}, item)
+	})
+}
@@ -0,0 +1,140 @@
+package zephyr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RequestBuilder builds a request to a service one piece at a time, and sends
+// it with Do or Decode. Use Request on a ServiceClient to get one:
+//
+//	res, err := client.Service("items").Request(http.MethodPut, "/items/1").
+//		Header("If-Match", etag).
+//		Query("notify", "true").
+//		JSON(item).
+//		Do()
+//
+// Errors met while building the request, such as a body which cannot be
+// encoded, are held until the request is built or sent.
+type RequestBuilder struct {
+	client      *ServiceClient
+	method      string
+	servicePath string
+	header      http.Header
+	query       url.Values
+	body        io.Reader
+	ctx         context.Context
+	err         error
+}
+
+// Request returns a RequestBuilder for a request to the service with the
+// given method and path.
+func (c *ServiceClient) Request(method string, servicePath string) *RequestBuilder {
+	return &RequestBuilder{
+		client:      c,
+		method:      method,
+		servicePath: servicePath,
+		header:      http.Header{},
+		query:       url.Values{},
+		ctx:         context.Background(),
+	}
+}
+
+// Header adds a header to the request.
+func (b *RequestBuilder) Header(key string, value string) *RequestBuilder {
+	b.header.Add(key, value)
+	return b
+}
+
+// Query adds a query parameter to the request, in addition to any in the
+// path given to Request.
+func (b *RequestBuilder) Query(key string, value string) *RequestBuilder {
+	b.query.Add(key, value)
+	return b
+}
+
+// Context sets the context of the request.
+func (b *RequestBuilder) Context(ctx context.Context) *RequestBuilder {
+	b.ctx = ctx
+	return b
+}
+
+// Body sets the body of the request, and its content type.
+func (b *RequestBuilder) Body(contentType string, body io.Reader) *RequestBuilder {
+	b.header.Set("Content-Type", contentType)
+	b.body = body
+	return b
+}
+
+// Encode encodes v with the client's codec and sets it as the body of the
+// request.
+func (b *RequestBuilder) Encode(v any) *RequestBuilder {
+	return b.encode(b.client.codec(), v)
+}
+
+// JSON encodes v as JSON and sets it as the body of the request, whatever the
+// client's codec.
+func (b *RequestBuilder) JSON(v any) *RequestBuilder {
+	return b.encode(JSONCodec, v)
+}
+
+// Form sets the body of the request to the given form data.
+func (b *RequestBuilder) Form(data url.Values) *RequestBuilder {
+	return b.Body("application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
+}
+
+func (b *RequestBuilder) encode(codec Codec, v any) *RequestBuilder {
+	bodyBuf, err := codec.Marshal(v)
+	if err != nil {
+		b.err = fmt.Errorf("failed to encode request body: %w", err)
+		return b
+	}
+	return b.Body(codec.ContentType(), bytes.NewReader(bodyBuf))
+}
+
+// Build returns the built request, without sending it.
+func (b *RequestBuilder) Build() (*http.Request, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	req, err := http.NewRequestWithContext(b.ctx, b.method, b.servicePath, b.body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range b.header {
+		req.Header[key] = append(req.Header[key], values...)
+	}
+	if len(b.query) > 0 {
+		query := req.URL.Query()
+		for key, values := range b.query {
+			query[key] = append(query[key], values...)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	return req, nil
+}
+
+// Do builds the request and sends it to the service with the client's Do.
+func (b *RequestBuilder) Do() (*http.Response, error) {
+	req, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return b.client.Do(req)
+}
+
+// Decode builds the request, sends it to the service, and decodes the
+// response body into v with the client's codec, in the same way as DoJSON.
+// If v is nil, the response body is discarded.
+func (b *RequestBuilder) Decode(v any) error {
+	req, err := b.Build()
+	if err != nil {
+		return err
+	}
+	return b.client.doDecoded(req, v)
+}
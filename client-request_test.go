@@ -0,0 +1,140 @@
+package zephyr_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type contextKey struct{}
+
+func TestRequestBuilder(t *testing.T) {
+	t.Run("Will send the method, path, headers and query", func(t *testing.T) {
+		var recvRequest *http.Request
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			recvRequest = req
+			res.WriteHeader(http.StatusNoContent)
+		})
+
+		res, err := client.Request(http.MethodDelete, "/items/1?force=true").
+			Header("If-Match", "abc123").
+			Header("X-Tag", "a").
+			Header("X-Tag", "b").
+			Query("notify", "true").
+			Query("force", "really").
+			Do()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+		assert.Equal(t, http.MethodDelete, recvRequest.Method)
+		assert.Equal(t, "/items/1", recvRequest.URL.Path)
+		assert.Equal(t, "abc123", recvRequest.Header.Get("If-Match"))
+		assert.Equal(t, []string{"a", "b"}, recvRequest.Header.Values("X-Tag"))
+		assert.Equal(t, url.Values{"force": {"true", "really"}, "notify": {"true"}}, recvRequest.URL.Query())
+	})
+
+	t.Run("Will encode the body as JSON", func(t *testing.T) {
+		var recvItem jsonItem
+		var recvContentType string
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			recvContentType = req.Header.Get("Content-Type")
+			assert.NoError(t, json.NewDecoder(req.Body).Decode(&recvItem))
+		})
+
+		_, err := client.WithCodec(zephyr.MsgpackCodec).Request(http.MethodPut, "/items/1").
+			JSON(jsonItem{ID: 1, Name: "widget"}).
+			Do()
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", recvContentType)
+		assert.Equal(t, jsonItem{ID: 1, Name: "widget"}, recvItem)
+	})
+
+	t.Run("Will encode the body with the client's codec", func(t *testing.T) {
+		var recvItem jsonItem
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, "application/msgpack", req.Header.Get("Content-Type"))
+			body, err := io.ReadAll(req.Body)
+			assert.NoError(t, err)
+			assert.NoError(t, zephyr.MsgpackCodec.Unmarshal(body, &recvItem))
+		})
+
+		_, err := client.WithCodec(zephyr.MsgpackCodec).Request(http.MethodPatch, "/items/1").
+			Encode(jsonItem{Name: "gadget"}).
+			Do()
+		require.NoError(t, err)
+		assert.Equal(t, jsonItem{Name: "gadget"}, recvItem)
+	})
+
+	t.Run("Will encode form bodies", func(t *testing.T) {
+		var recvForm url.Values
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			assert.NoError(t, req.ParseForm())
+			recvForm = req.PostForm
+		})
+
+		_, err := client.Request(http.MethodPost, "/items").
+			Form(url.Values{"name": {"widget"}}).
+			Do()
+		require.NoError(t, err)
+		assert.Equal(t, url.Values{"name": {"widget"}}, recvForm)
+	})
+
+	t.Run("Will return an error if the body cannot be encoded", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			t.Error("request should not have been sent")
+		})
+
+		_, err := client.Request(http.MethodPost, "/items").JSON(math.Inf(1)).Do()
+		var unsupportedErr *json.UnsupportedValueError
+		assert.ErrorAs(t, err, &unsupportedErr)
+	})
+
+	t.Run("Will send the context with the request", func(t *testing.T) {
+		var recvValue any
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			recvValue = req.Context().Value(contextKey{})
+		})
+
+		ctx := context.WithValue(context.Background(), contextKey{}, "value")
+		_, err := client.Request(http.MethodGet, "/items").Context(ctx).Do()
+		require.NoError(t, err)
+		assert.Equal(t, "value", recvValue)
+	})
+
+	t.Run("Will decode the response body", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, "application/msgpack", req.Header.Get("Accept"))
+			buf, err := msgpack.Marshal(map[string]any{"id": 1, "name": "widget"})
+			assert.NoError(t, err)
+			_, _ = res.Write(buf)
+		})
+
+		var item jsonItem
+		err := client.WithCodec(zephyr.MsgpackCodec).Request(http.MethodGet, "/items/1").Decode(&item)
+		require.NoError(t, err)
+		assert.Equal(t, jsonItem{ID: 1, Name: "widget"}, item)
+	})
+
+	t.Run("Will return a StatusError when decoding a failed response", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Content-Type", "application/json")
+			res.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = res.Write([]byte(`{"error":"item has changed"}`))
+		})
+
+		err := client.Request(http.MethodPut, "/items/1").Header("If-Match", "abc123").JSON(jsonItem{}).Decode(nil)
+		var statusErr *zephyr.StatusError
+		require.ErrorAs(t, err, &statusErr)
+		assert.Equal(t, http.StatusPreconditionFailed, statusErr.StatusCode)
+		assert.Equal(t, "item has changed", statusErr.Message)
+	})
+}
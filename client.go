@@ -1,6 +1,7 @@
 package zephyr
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -41,6 +42,47 @@ func (c *Client) Service(name string) *ServiceClient {
 type ServiceClient struct {
 	*Client
 	Name string
+
+	// InstanceID, if set, pins requests to the instance of the service with
+	// this ID, if the transport implements InstanceDispatcher. If the instance
+	// has gone away, requests are dispatched to any other instance. Use
+	// Instance to get a pinned ServiceClient.
+	InstanceID string
+
+	// Codec encodes and decodes the bodies of requests sent with the typed
+	// helpers, such as GetJSON and PostJSON. If nil, JSONCodec is used. Use
+	// WithCodec to get a ServiceClient with another codec.
+	Codec Codec
+}
+
+// Instance returns a copy of the ServiceClient pinned to the instance with the
+// given ID. Services set the InstanceIDHeader on their responses, so a client
+// can keep talking to the instance which handled an earlier request:
+//
+//	res, err := client.Service("sessions").Get("/session")
+//	...
+//	sessions := client.Service("sessions").Instance(res.Header.Get(zephyr.InstanceIDHeader))
+func (c *ServiceClient) Instance(instanceID string) *ServiceClient {
+	pinned := *c
+	pinned.InstanceID = instanceID
+	return &pinned
+}
+
+// WithCodec returns a copy of the ServiceClient which encodes and decodes the
+// bodies of requests sent with the typed helpers using the given codec.
+//
+//	item, err := zephyr.GetJSON[Item](client.Service("items").WithCodec(zephyr.MsgpackCodec), "/items/1")
+func (c *ServiceClient) WithCodec(codec Codec) *ServiceClient {
+	withCodec := *c
+	withCodec.Codec = codec
+	return &withCodec
+}
+
+func (c *ServiceClient) codec() Codec {
+	if c.Codec == nil {
+		return JSONCodec
+	}
+	return c.Codec
 }
 
 // Do sends an HTTP request to the service.
@@ -48,7 +90,7 @@ func (c *ServiceClient) Do(req *http.Request) (*http.Response, error) {
 	clientRequestDebug.Tracef("Request to %s: %s %s", c.Name, req.Method, req.URL.Path)
 
 	responseRecorder := httptest.NewRecorder()
-	if err := c.Transport.Dispatch(c.Name, responseRecorder, req); err != nil {
+	if err := c.dispatch(responseRecorder, req); err != nil {
 		clientRequestDebug.Tracef("Request to %s failed: %v", c.Name, err)
 		return nil, err
 	}
@@ -60,6 +102,21 @@ func (c *ServiceClient) Do(req *http.Request) (*http.Response, error) {
 	return response, nil
 }
 
+// dispatch dispatches the request to the pinned instance if there is one, or
+// to any instance otherwise.
+func (c *ServiceClient) dispatch(res http.ResponseWriter, req *http.Request) error {
+	instanceDispatcher, ok := c.Transport.(InstanceDispatcher)
+	if c.InstanceID == "" || !ok {
+		return c.Transport.Dispatch(c.Name, res, req)
+	}
+	err := instanceDispatcher.DispatchInstance(c.Name, c.InstanceID, res, req)
+	if errors.Is(err, ErrInstanceUnavailable) {
+		clientRequestDebug.Tracef("Instance %s of %s is unavailable, dispatching to any instance", c.InstanceID, c.Name)
+		return c.Transport.Dispatch(c.Name, res, req)
+	}
+	return err
+}
+
 // Get sends a GET request to the service.
 func (c *ServiceClient) Get(servicePath string) (*http.Response, error) {
 	req, err := http.NewRequest(http.MethodGet, servicePath, nil)
@@ -93,13 +150,61 @@ func (c *ServiceClient) PostForm(servicePath string, data url.Values) (*http.Res
 	return c.Post(servicePath, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
 }
 
+// Put sends a PUT request to the service.
+func (c *ServiceClient) Put(servicePath string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPut, servicePath, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.Do(req)
+}
+
+// Patch sends a PATCH request to the service.
+func (c *ServiceClient) Patch(servicePath string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPatch, servicePath, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.Do(req)
+}
+
+// Delete sends a DELETE request to the service.
+func (c *ServiceClient) Delete(servicePath string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodDelete, servicePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Options sends an OPTIONS request to the service.
+func (c *ServiceClient) Options(servicePath string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodOptions, servicePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
 // ServeHTTP implements http.Handler. It allows a ServiceClient to proxy
 // requests to a service.
 func (c *ServiceClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	clientServeDebug.Tracef("ServiceClient %s handling HTTP request: %s %s", c.Name, r.Method, r.URL.Path)
 
-	if err := c.Transport.Dispatch(c.Name, w, r); err != nil {
+	trackedW := &trackingResponseWriter{ResponseWriter: w}
+	if err := c.dispatch(trackedW, r); err != nil {
 		clientServeDebug.Tracef("Error dispatching request to %s: %v", c.Name, err)
+		if trackedW.hasWritten {
+			clientServeDebug.Trace("Response already started, cannot respond with an error")
+			return
+		}
+		var remoteErr *RemoteError
+		if errors.As(err, &remoteErr) {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 
@@ -0,0 +1,85 @@
+package zephyr_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+)
+
+func startEchoService(t *testing.T) *zephyr.ServiceClient {
+	t.Helper()
+	return startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+		var body []byte
+		if req.Body != nil {
+			var err error
+			body, err = io.ReadAll(req.Body)
+			assert.NoError(t, err)
+		}
+		res.Header().Set("Echo-Method", req.Method)
+		res.Header().Set("Echo-Path", req.URL.Path)
+		res.Header().Set("Echo-Content-Type", req.Header.Get("Content-Type"))
+		res.Header().Set("Echo-Body", string(body))
+		res.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func TestServiceClient(t *testing.T) {
+	t.Run("Will send PUT requests", func(t *testing.T) {
+		client := startEchoService(t)
+
+		res, err := client.Put("/items/1", "text/plain", strings.NewReader("widget"))
+		require.NoError(t, err)
+		assert.Equal(t, http.MethodPut, res.Header.Get("Echo-Method"))
+		assert.Equal(t, "/items/1", res.Header.Get("Echo-Path"))
+		assert.Equal(t, "text/plain", res.Header.Get("Echo-Content-Type"))
+		assert.Equal(t, "widget", res.Header.Get("Echo-Body"))
+	})
+
+	t.Run("Will send PATCH requests", func(t *testing.T) {
+		client := startEchoService(t)
+
+		res, err := client.Patch("/items/1", "text/plain", strings.NewReader("gadget"))
+		require.NoError(t, err)
+		assert.Equal(t, http.MethodPatch, res.Header.Get("Echo-Method"))
+		assert.Equal(t, "/items/1", res.Header.Get("Echo-Path"))
+		assert.Equal(t, "text/plain", res.Header.Get("Echo-Content-Type"))
+		assert.Equal(t, "gadget", res.Header.Get("Echo-Body"))
+	})
+
+	t.Run("Will send DELETE requests", func(t *testing.T) {
+		client := startEchoService(t)
+
+		res, err := client.Delete("/items/1")
+		require.NoError(t, err)
+		assert.Equal(t, http.MethodDelete, res.Header.Get("Echo-Method"))
+		assert.Equal(t, "/items/1", res.Header.Get("Echo-Path"))
+	})
+
+	t.Run("Will send OPTIONS requests", func(t *testing.T) {
+		client := startEchoService(t)
+
+		res, err := client.Options("/items")
+		require.NoError(t, err)
+		assert.Equal(t, http.MethodOptions, res.Header.Get("Echo-Method"))
+		assert.Equal(t, "/items", res.Header.Get("Echo-Path"))
+	})
+
+	t.Run("Will not write an error once the response has started", func(t *testing.T) {
+		client := startJSONService(t, func(res http.ResponseWriter, req *http.Request) {
+			res.WriteHeader(http.StatusOK)
+			_, _ = res.Write([]byte("partial"))
+			panic("boom")
+		})
+
+		res := httptest.NewRecorder()
+		client.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/items", nil))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "partial", res.Body.String())
+	})
+}
@@ -0,0 +1,571 @@
+package zephyr
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/telemetrytv/trace"
+)
+
+var (
+	gatewayCacheDebug = trace.Bind("zephyr:gateway:cache")
+)
+
+// DefaultResponseCacheSize is the size, in bytes, of a response cache created
+// with NewResponseCache when no size is given.
+const DefaultResponseCacheSize = 64 << 20
+
+// ResponseCache is an in-memory, size bounded cache of service responses which
+// can be assigned to a gateway's Cache field. It behaves as a shared HTTP cache:
+// only GET requests are cached, and responses are stored and reused according
+// to their Cache-Control, Expires, and Vary headers. Stale responses carrying
+// an ETag or Last-Modified header are revalidated with the service using a
+// conditional request. When the cache is full, the least recently used
+// responses are evicted.
+type ResponseCache struct {
+
+	// MaxSize is the maximum combined size, in bytes, of all cached responses.
+	MaxSize int64
+
+	// MaxEntrySize is the maximum size, in bytes, of a single cached response.
+	// Larger responses are passed through to the client without being cached.
+	// If zero, a quarter of MaxSize is used.
+	MaxEntrySize int64
+
+	mu        sync.Mutex
+	size      int64
+	lru       *list.List
+	entries   map[string]*list.Element
+	varyByKey map[string][]string
+}
+
+type cacheEntry struct {
+	key          string
+	serviceName  string
+	path         string
+	statusCode   int
+	header       http.Header
+	body         []byte
+	storedAt     time.Time
+	expiresAt    time.Time
+	initialAge   time.Duration
+	mustValidate bool
+}
+
+// NewResponseCache creates a new response cache which holds at most maxSize
+// bytes of responses. If maxSize is zero, DefaultResponseCacheSize is used.
+func NewResponseCache(maxSize int64) *ResponseCache {
+	if maxSize == 0 {
+		maxSize = DefaultResponseCacheSize
+	}
+	return &ResponseCache{
+		MaxSize: maxSize,
+	}
+}
+
+// Len returns the number of responses currently in the cache.
+func (c *ResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Size returns the combined size, in bytes, of the responses currently in the
+// cache.
+func (c *ResponseCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Purge removes all responses from the cache.
+func (c *ResponseCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	gatewayCacheDebug.Trace("Purging all cached responses")
+	c.entries = nil
+	c.varyByKey = nil
+	c.lru = nil
+	c.size = 0
+}
+
+// PurgeService removes all responses from the cache that were produced by the
+// service with the given name. It returns the number of responses removed.
+func (c *ResponseCache) PurgeService(serviceName string) int {
+	gatewayCacheDebug.Tracef("Purging cached responses from service %s", serviceName)
+	return c.purgeWhere(func(entry *cacheEntry) bool {
+		return entry.serviceName == serviceName
+	})
+}
+
+// PurgePrefix removes all responses from the cache whose request path begins
+// with the given prefix. It returns the number of responses removed.
+func (c *ResponseCache) PurgePrefix(pathPrefix string) int {
+	gatewayCacheDebug.Tracef("Purging cached responses with path prefix %s", pathPrefix)
+	return c.purgeWhere(func(entry *cacheEntry) bool {
+		return strings.HasPrefix(entry.path, pathPrefix)
+	})
+}
+
+func (c *ResponseCache) purgeWhere(shouldPurge func(entry *cacheEntry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := 0
+	for _, element := range c.entries {
+		if shouldPurge(element.Value.(*cacheEntry)) {
+			c.removeElement(element)
+			purged += 1
+		}
+	}
+	gatewayCacheDebug.Tracef("Purged %d cached responses", purged)
+	return purged
+}
+
+// serve responds to the request from the cache where possible, falling back
+// to dispatch when the response is missing, stale, or must be revalidated.
+// Responses received from the service are stored if they are cacheable.
+func (c *ResponseCache) serve(serviceName string, res http.ResponseWriter, req *http.Request, dispatch func(res http.ResponseWriter, req *http.Request) error) error {
+	now := time.Now()
+	requestDirectives := parseCacheControl(req.Header.Values("Cache-Control"))
+	if _, ok := requestDirectives["no-store"]; ok {
+		gatewayCacheDebug.Trace("Request has no-store directive, bypassing cache")
+		return dispatch(res, req)
+	}
+
+	entry := c.lookup(req)
+	if entry != nil {
+		_, requestNoCache := requestDirectives["no-cache"]
+		requestMaxAge, hasRequestMaxAge := durationDirective(requestDirectives, "max-age")
+		isFresh := !entry.mustValidate && now.Before(entry.expiresAt)
+		if hasRequestMaxAge && entry.age(now) > requestMaxAge {
+			isFresh = false
+		}
+
+		if isFresh && !requestNoCache {
+			gatewayCacheDebug.Tracef("Serving %s from cache", req.URL.Path)
+			writeCacheEntry(res, req, entry, now)
+			return nil
+		}
+
+		if entry.header.Get("ETag") == "" && entry.header.Get("Last-Modified") == "" {
+			gatewayCacheDebug.Tracef("Cached response for %s is stale and has no validators", req.URL.Path)
+			entry = nil
+		}
+	}
+
+	outReq := req
+	if entry != nil {
+		gatewayCacheDebug.Tracef("Revalidating cached response for %s", req.URL.Path)
+		outReq = req.Clone(req.Context())
+		outReq.Header.Del("If-Match")
+		outReq.Header.Del("If-None-Match")
+		outReq.Header.Del("If-Modified-Since")
+		outReq.Header.Del("If-Unmodified-Since")
+		outReq.Header.Del("If-Range")
+		if etag := entry.header.Get("ETag"); etag != "" {
+			outReq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.header.Get("Last-Modified"); lastModified != "" {
+			outReq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	writer := &cacheResponseWriter{
+		res:          res,
+		header:       http.Header{},
+		revalidating: entry != nil,
+		maxEntrySize: c.maxEntrySize(),
+	}
+	if err := dispatch(writer, outReq); err != nil {
+		return err
+	}
+
+	if writer.notModified {
+		gatewayCacheDebug.Tracef("Cached response for %s is still valid", req.URL.Path)
+		refreshed := c.refresh(entry, writer.header, now)
+		writeCacheEntry(res, req, refreshed, now)
+		return nil
+	}
+
+	if !writer.hasWrittenHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+	if writer.isCapturing {
+		c.store(serviceName, req, writer.statusCode, writer.capturedHeader, writer.capturedBody, now)
+	}
+
+	return nil
+}
+
+// invalidate removes cached responses for the given path. It is called when
+// an unsafe request for the path succeeds, as the resource has likely changed.
+func (c *ResponseCache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, element := range c.entries {
+		if element.Value.(*cacheEntry).path == path {
+			c.removeElement(element)
+		}
+	}
+}
+
+func (c *ResponseCache) lookup(req *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	primaryKey := cachePrimaryKey(req)
+	varyHeaders, ok := c.varyByKey[primaryKey]
+	if !ok {
+		return nil
+	}
+	element, ok := c.entries[cacheVariantKey(primaryKey, varyHeaders, req.Header)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry)
+}
+
+func (c *ResponseCache) store(serviceName string, req *http.Request, statusCode int, header http.Header, body []byte, now time.Time) {
+	if !isCacheableStatus(statusCode) || header.Get("Set-Cookie") != "" {
+		return
+	}
+	directives := parseCacheControl(header.Values("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return
+	}
+	if _, ok := directives["private"]; ok {
+		return
+	}
+	if req.Header.Get("Authorization") != "" {
+		if _, ok := directives["public"]; !ok {
+			return
+		}
+	}
+
+	varyHeaders := []string{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				varyHeaders = append(varyHeaders, name)
+			}
+		}
+	}
+	sort.Strings(varyHeaders)
+
+	lifetime, hasLifetime := freshnessLifetime(directives, header)
+	_, noCache := directives["no-cache"]
+	hasValidators := header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+	if !hasLifetime && !(noCache && hasValidators) {
+		return
+	}
+
+	entry := &cacheEntry{
+		serviceName:  serviceName,
+		path:         req.URL.Path,
+		statusCode:   statusCode,
+		header:       header,
+		body:         body,
+		storedAt:     now,
+		expiresAt:    now.Add(lifetime),
+		mustValidate: noCache,
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		entry.initialAge = time.Duration(age) * time.Second
+		entry.expiresAt = entry.expiresAt.Add(-entry.initialAge)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	primaryKey := cachePrimaryKey(req)
+	entry.key = cacheVariantKey(primaryKey, varyHeaders, req.Header)
+	if c.entries == nil {
+		c.entries = map[string]*list.Element{}
+		c.varyByKey = map[string][]string{}
+		c.lru = list.New()
+	}
+	if existing, ok := c.entries[entry.key]; ok {
+		c.removeElement(existing)
+	}
+	c.varyByKey[primaryKey] = varyHeaders
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size()
+	gatewayCacheDebug.Tracef("Stored response for %s from service %s, %d bytes", entry.path, serviceName, entry.size())
+
+	c.evict()
+}
+
+// refresh updates a cached response with the headers of a 304 Not Modified
+// response, extending its freshness.
+func (c *ResponseCache) refresh(entry *cacheEntry, notModifiedHeader http.Header, now time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	refreshed := *entry
+	refreshed.header = entry.header.Clone()
+	for key, values := range notModifiedHeader {
+		if key == "Content-Length" {
+			continue
+		}
+		refreshed.header[key] = values
+	}
+
+	directives := parseCacheControl(refreshed.header.Values("Cache-Control"))
+	lifetime, _ := freshnessLifetime(directives, refreshed.header)
+	_, noCache := directives["no-cache"]
+	refreshed.storedAt = now
+	refreshed.initialAge = 0
+	refreshed.expiresAt = now.Add(lifetime)
+	refreshed.mustValidate = noCache
+
+	if element, ok := c.entries[entry.key]; ok {
+		c.size += refreshed.size() - element.Value.(*cacheEntry).size()
+		element.Value = &refreshed
+		c.lru.MoveToFront(element)
+		c.evict()
+	}
+	return &refreshed
+}
+
+// evict removes the least recently used responses until the cache is within
+// MaxSize. It must be called with c.mu held.
+func (c *ResponseCache) evict() {
+	for c.size > c.MaxSize && c.lru.Len() > 0 {
+		oldest := c.lru.Back()
+		gatewayCacheDebug.Tracef("Evicting cached response for %s", oldest.Value.(*cacheEntry).path)
+		c.removeElement(oldest)
+	}
+}
+
+func (c *ResponseCache) removeElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+func (c *ResponseCache) maxEntrySize() int64 {
+	if c.MaxEntrySize != 0 {
+		return c.MaxEntrySize
+	}
+	return c.MaxSize / 4
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for key, values := range e.header {
+		for _, value := range values {
+			size += int64(len(key) + len(value))
+		}
+	}
+	return size
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.storedAt)
+}
+
+func writeCacheEntry(res http.ResponseWriter, req *http.Request, entry *cacheEntry, now time.Time) {
+	for key, values := range entry.header {
+		res.Header()[key] = append([]string(nil), values...)
+	}
+	res.Header().Set("Age", strconv.Itoa(int(entry.age(now).Seconds())))
+
+	etag := entry.header.Get("ETag")
+	if etag != "" && entry.statusCode == http.StatusOK && etagMatches(req.Header.Get("If-None-Match"), etag) {
+		res.Header().Del("Content-Length")
+		res.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	res.WriteHeader(entry.statusCode)
+	if _, err := res.Write(entry.body); err != nil {
+		gatewayCacheDebug.Tracef("Failed to write cached response body: %v", err)
+	}
+}
+
+// cacheResponseWriter passes a service response through to the client while
+// capturing a copy of it for the cache. When revalidating, a 304 Not Modified
+// response is captured instead of being passed through, so the cached response
+// can be sent in its place.
+type cacheResponseWriter struct {
+	res              http.ResponseWriter
+	header           http.Header
+	revalidating     bool
+	maxEntrySize     int64
+	hasWrittenHeader bool
+	notModified      bool
+	isCapturing      bool
+	statusCode       int
+	capturedHeader   http.Header
+	capturedBody     []byte
+}
+
+func (w *cacheResponseWriter) Header() http.Header {
+	if w.hasWrittenHeader && !w.notModified {
+		return w.res.Header()
+	}
+	return w.header
+}
+
+func (w *cacheResponseWriter) WriteHeader(statusCode int) {
+	if w.hasWrittenHeader {
+		return
+	}
+	w.hasWrittenHeader = true
+	w.statusCode = statusCode
+
+	if w.revalidating && statusCode == http.StatusNotModified {
+		w.notModified = true
+		return
+	}
+
+	for key, values := range w.header {
+		w.res.Header()[key] = values
+	}
+	w.capturedHeader = w.header.Clone()
+	w.isCapturing = isCacheableStatus(statusCode)
+	w.res.WriteHeader(statusCode)
+}
+
+func (w *cacheResponseWriter) Write(p []byte) (int, error) {
+	if !w.hasWrittenHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.notModified {
+		return len(p), nil
+	}
+	if w.isCapturing {
+		if int64(len(w.capturedBody)+len(p)) > w.maxEntrySize {
+			gatewayCacheDebug.Trace("Response exceeds maximum cache entry size, not caching")
+			w.isCapturing = false
+			w.capturedBody = nil
+		} else {
+			w.capturedBody = append(w.capturedBody, p...)
+		}
+	}
+	return w.res.Write(p)
+}
+
+func (w *cacheResponseWriter) Flush() {
+	if !w.hasWrittenHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.notModified {
+		return
+	}
+	if err := http.NewResponseController(w.res).Flush(); err != nil {
+		gatewayCacheDebug.Tracef("Failed to flush response: %v", err)
+	}
+}
+
+func (w *cacheResponseWriter) Unwrap() http.ResponseWriter {
+	return w.res
+}
+
+func cachePrimaryKey(req *http.Request) string {
+	return req.Host + " " + req.URL.RequestURI()
+}
+
+func cacheVariantKey(primaryKey string, varyHeaders []string, header http.Header) string {
+	if len(varyHeaders) == 0 {
+		return primaryKey
+	}
+	var key strings.Builder
+	key.WriteString(primaryKey)
+	for _, name := range varyHeaders {
+		key.WriteString("\n")
+		key.WriteString(name)
+		key.WriteString(": ")
+		key.WriteString(strings.Join(header.Values(name), ", "))
+	}
+	return key.String()
+}
+
+func isCacheableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+func parseCacheControl(values []string) map[string]string {
+	directives := map[string]string{}
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(directive, "=")
+			directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return directives
+}
+
+func durationDirective(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// freshnessLifetime returns how long a response may be served from the cache
+// without revalidation, as declared by s-maxage, max-age, or Expires.
+func freshnessLifetime(directives map[string]string, header http.Header) (time.Duration, bool) {
+	if lifetime, ok := durationDirective(directives, "s-maxage"); ok {
+		return lifetime, true
+	}
+	if lifetime, ok := durationDirective(directives, "max-age"); ok {
+		return lifetime, true
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, true
+		}
+		date := time.Now()
+		if dateAt, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = dateAt
+		}
+		if lifetime := expiresAt.Sub(date); lifetime > 0 {
+			return lifetime, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	trimWeak := func(tag string) string {
+		return strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || trimWeak(candidate) == trimWeak(etag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,363 @@
+package zephyr
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/telemetrytv/trace"
+)
+
+var (
+	gatewayCompressionDebug = trace.Bind("zephyr:gateway:compression")
+)
+
+// DefaultCompressionMinSize is the response size, in bytes, below which a
+// ResponseCompression created with NewResponseCompression leaves responses
+// uncompressed.
+const DefaultCompressionMinSize = 1024
+
+// DefaultCompressibleContentTypes are the media types compressed by a
+// ResponseCompression created with NewResponseCompression. Entries ending in a
+// slash match any subtype, and entries beginning with a plus match any media
+// type with that structured syntax suffix.
+var DefaultCompressibleContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/x-www-form-urlencoded",
+	"image/svg+xml",
+	"+json",
+	"+xml",
+}
+
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+)
+
+// ResponseCompression can be assigned to a gateway's Compression field to have
+// the gateway compress service responses with gzip or zstd, depending on the
+// client's Accept-Encoding header. Only responses with a compressible content
+// type and a size of at least MinSize are compressed, and responses already
+// encoded by a service are passed through untouched. Compression is applied as
+// the response streams through the gateway, so bodies are never buffered in
+// full.
+type ResponseCompression struct {
+
+	// MinSize is the minimum size, in bytes, of a response body before it will
+	// be compressed. Responses without a Content-Length are buffered up to
+	// MinSize bytes to determine if they are large enough.
+	MinSize int
+
+	// ContentTypes is a list of media types which may be compressed. See
+	// DefaultCompressibleContentTypes for the matching rules.
+	ContentTypes []string
+
+	// DisableZstd prevents zstd from being negotiated, leaving gzip as the
+	// only encoding offered to clients.
+	DisableZstd bool
+
+	gzipWriters sync.Pool
+	zstdWriters sync.Pool
+}
+
+// NewResponseCompression creates a ResponseCompression with the default
+// minimum size and compressible content types.
+func NewResponseCompression() *ResponseCompression {
+	return &ResponseCompression{
+		MinSize:      DefaultCompressionMinSize,
+		ContentTypes: DefaultCompressibleContentTypes,
+	}
+}
+
+// wrap returns a response writer which compresses the response if the
+// request accepts a supported encoding. Responses which could be compressed
+// are marked as varying by Accept-Encoding either way, so shared caches keep
+// the variants apart. The returned close function must be called once the
+// response has been written in full.
+func (c *ResponseCompression) wrap(res http.ResponseWriter, req *http.Request) (http.ResponseWriter, func() error) {
+	if req.Method == http.MethodHead {
+		return res, func() error { return nil }
+	}
+	encoding := c.negotiate(req.Header.Values("Accept-Encoding"))
+	if encoding != "" {
+		gatewayCompressionDebug.Tracef("Negotiated %s encoding for %s %s", encoding, req.Method, req.URL.Path)
+	}
+
+	writer := &compressResponseWriter{
+		res:         res,
+		compression: c,
+		encoding:    encoding,
+	}
+	return writer, writer.close
+}
+
+// negotiate picks the preferred encoding supported by both the client and the
+// gateway, based on the quality values in the Accept-Encoding header.
+func (c *ResponseCompression) negotiate(acceptEncodings []string) string {
+	qualities := map[string]float64{}
+	for _, acceptEncoding := range acceptEncodings {
+		for _, part := range strings.Split(acceptEncoding, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			quality := 1.0
+			if qualityStr, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if parsedQuality, err := strconv.ParseFloat(qualityStr, 64); err == nil {
+					quality = parsedQuality
+				}
+			}
+			qualities[name] = quality
+		}
+	}
+
+	qualityOf := func(encoding string) float64 {
+		if quality, ok := qualities[encoding]; ok {
+			return quality
+		}
+		if quality, ok := qualities["*"]; ok {
+			return quality
+		}
+		return 0
+	}
+
+	zstdQuality := qualityOf(encodingZstd)
+	if c.DisableZstd {
+		zstdQuality = 0
+	}
+	gzipQuality := qualityOf(encodingGzip)
+	switch {
+	case zstdQuality > 0 && zstdQuality >= gzipQuality:
+		return encodingZstd
+	case gzipQuality > 0:
+		return encodingGzip
+	}
+	return ""
+}
+
+func (c *ResponseCompression) isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, compressibleType := range c.ContentTypes {
+		switch {
+		case strings.HasSuffix(compressibleType, "/"):
+			if strings.HasPrefix(mediaType, compressibleType) {
+				return true
+			}
+		case strings.HasPrefix(compressibleType, "+"):
+			if strings.HasSuffix(mediaType, compressibleType) {
+				return true
+			}
+		case mediaType == compressibleType:
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ResponseCompression) getEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingZstd:
+		if encoder, ok := c.zstdWriters.Get().(*zstd.Encoder); ok {
+			encoder.Reset(w)
+			return encoder, nil
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	default:
+		if encoder, ok := c.gzipWriters.Get().(*gzip.Writer); ok {
+			encoder.Reset(w)
+			return encoder, nil
+		}
+		return gzip.NewWriter(w), nil
+	}
+}
+
+func (c *ResponseCompression) putEncoder(encoder io.WriteCloser) {
+	switch encoder := encoder.(type) {
+	case *zstd.Encoder:
+		encoder.Reset(nil)
+		c.zstdWriters.Put(encoder)
+	case *gzip.Writer:
+		encoder.Reset(nil)
+		c.gzipWriters.Put(encoder)
+	}
+}
+
+// compressResponseWriter defers writing the response headers until it knows
+// whether the response will be compressed. This is decided as soon as the
+// Content-Length is known to be large enough, or once MinSize bytes of a
+// response without a Content-Length have been written. If the client accepts
+// no supported encoding, encoding is empty and the response is never
+// compressed.
+type compressResponseWriter struct {
+	res         http.ResponseWriter
+	compression *ResponseCompression
+	encoding    string
+	statusCode  int
+	hasDecided  bool
+	encoder     io.WriteCloser
+	pending     []byte
+}
+
+func (w *compressResponseWriter) Header() http.Header {
+	return w.res.Header()
+}
+
+func (w *compressResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode != 0 {
+		return
+	}
+	if statusCode < 200 {
+		w.res.WriteHeader(statusCode)
+		return
+	}
+	w.statusCode = statusCode
+
+	if !w.shouldConsider() {
+		w.decide(false)
+		return
+	}
+	w.res.Header().Add("Vary", "Accept-Encoding")
+	if w.encoding == "" {
+		w.decide(false)
+		return
+	}
+	if contentLength, err := strconv.Atoi(w.res.Header().Get("Content-Length")); err == nil {
+		w.decide(contentLength >= w.compression.MinSize)
+	}
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.hasDecided {
+		return w.write(p)
+	}
+
+	w.pending = append(w.pending, p...)
+	if len(w.pending) >= w.compression.MinSize {
+		w.decide(true)
+		if err := w.flushPending(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends any pending bytes to the client. If the response is not yet
+// known to be large enough to compress, it is sent uncompressed.
+func (w *compressResponseWriter) Flush() {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.hasDecided {
+		w.decide(len(w.pending) >= w.compression.MinSize)
+	}
+	if err := w.flushPending(); err != nil {
+		gatewayCompressionDebug.Tracef("Failed to write pending bytes on flush: %v", err)
+		return
+	}
+	if flusher, ok := w.encoder.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			gatewayCompressionDebug.Tracef("Failed to flush %s encoder: %v", w.encoding, err)
+			return
+		}
+	}
+	if err := http.NewResponseController(w.res).Flush(); err != nil {
+		gatewayCompressionDebug.Tracef("Failed to flush response: %v", err)
+	}
+}
+
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.res
+}
+
+// close finishes the response. If nothing has been written, it is left alone
+// so the caller can still respond with an error.
+func (w *compressResponseWriter) close() error {
+	if w.statusCode == 0 {
+		return nil
+	}
+	if !w.hasDecided {
+		w.decide(len(w.pending) >= w.compression.MinSize)
+	}
+	if err := w.flushPending(); err != nil {
+		return err
+	}
+	if w.encoder == nil {
+		return nil
+	}
+	err := w.encoder.Close()
+	w.compression.putEncoder(w.encoder)
+	w.encoder = nil
+	return err
+}
+
+// shouldConsider reports whether the response is a candidate for
+// compression based on its status and headers alone.
+func (w *compressResponseWriter) shouldConsider() bool {
+	header := w.res.Header()
+	if w.statusCode < 200 || w.statusCode == http.StatusNoContent || w.statusCode == http.StatusNotModified {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" {
+		gatewayCompressionDebug.Trace("Response is already encoded by the service")
+		return false
+	}
+	if strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	return w.compression.isCompressible(header.Get("Content-Type"))
+}
+
+func (w *compressResponseWriter) decide(compress bool) {
+	w.hasDecided = true
+	header := w.res.Header()
+
+	if compress {
+		encoder, err := w.compression.getEncoder(w.encoding, w.res)
+		if err != nil {
+			gatewayCompressionDebug.Tracef("Failed to create %s encoder: %v", w.encoding, err)
+			compress = false
+		} else {
+			gatewayCompressionDebug.Tracef("Compressing response with %s", w.encoding)
+			w.encoder = encoder
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", w.encoding)
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+
+	w.res.WriteHeader(w.statusCode)
+}
+
+func (w *compressResponseWriter) flushPending() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	pending := w.pending
+	w.pending = nil
+	_, err := w.write(pending)
+	return err
+}
+
+func (w *compressResponseWriter) write(p []byte) (int, error) {
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	return w.res.Write(p)
+}
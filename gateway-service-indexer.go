@@ -1,10 +1,14 @@
 package zephyr
 
-import "sync"
+import (
+	"slices"
+	"sync"
+)
 
 type GatewayServiceIndexer struct {
 	mu                 sync.Mutex
 	ServiceDescriptors []*ServiceDescriptor
+	hashRings          map[string]*hashRing
 }
 
 func (r *GatewayServiceIndexer) SetServiceDescriptor(descriptor *ServiceDescriptor) error {
@@ -13,16 +17,65 @@ func (r *GatewayServiceIndexer) SetServiceDescriptor(descriptor *ServiceDescript
 	for _, existingDescriptor := range r.ServiceDescriptors {
 		if existingDescriptor.Name == descriptor.Name {
 			existingDescriptor.RouteDescriptors = descriptor.RouteDescriptors
+			if descriptor.InstanceID != "" && !slices.Contains(existingDescriptor.InstanceIDs, descriptor.InstanceID) {
+				existingDescriptor.InstanceIDs = append(existingDescriptor.InstanceIDs, descriptor.InstanceID)
+				delete(r.hashRings, descriptor.Name)
+			}
 			return nil
 		}
 	}
+	if descriptor.InstanceID != "" {
+		descriptor.InstanceIDs = []string{descriptor.InstanceID}
+	}
 	r.ServiceDescriptors = append(r.ServiceDescriptors, descriptor)
 	return nil
 }
 
+// UnsetServiceInstance removes an instance of a service, so no more requests
+// are routed to it until it announces itself again.
+func (r *GatewayServiceIndexer) UnsetServiceInstance(name string, instanceID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, service := range r.ServiceDescriptors {
+		if service.Name == name {
+			service.InstanceIDs = slices.DeleteFunc(service.InstanceIDs, func(id string) bool {
+				return id == instanceID
+			})
+			delete(r.hashRings, name)
+			return
+		}
+	}
+}
+
+// ResolveInstance returns the ID of the instance of a service that requests
+// with the given sticky key are routed to, or false if no instances of the
+// service have announced an ID.
+func (r *GatewayServiceIndexer) ResolveInstance(name string, key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ring, ok := r.hashRings[name]
+	if !ok {
+		for _, service := range r.ServiceDescriptors {
+			if service.Name == name {
+				ring = newHashRing(service.InstanceIDs)
+				break
+			}
+		}
+		if ring == nil {
+			return "", false
+		}
+		if r.hashRings == nil {
+			r.hashRings = map[string]*hashRing{}
+		}
+		r.hashRings[name] = ring
+	}
+	return ring.get(key)
+}
+
 func (r *GatewayServiceIndexer) UnsetService(name string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	delete(r.hashRings, name)
 	for i, service := range r.ServiceDescriptors {
 		if service.Name == name {
 			r.ServiceDescriptors = append(r.ServiceDescriptors[:i], r.ServiceDescriptors[i+1:]...)
@@ -32,7 +85,33 @@ func (r *GatewayServiceIndexer) UnsetService(name string) error {
 	return nil
 }
 
+// Snapshot returns copies of the service descriptors, so they can be read
+// while services continue to announce themselves.
+func (r *GatewayServiceIndexer) Snapshot() []*ServiceDescriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	serviceDescriptors := make([]*ServiceDescriptor, 0, len(r.ServiceDescriptors))
+	for _, descriptor := range r.ServiceDescriptors {
+		descriptorCopy := *descriptor
+		descriptorCopy.GatewayNames = slices.Clone(descriptor.GatewayNames)
+		descriptorCopy.RouteDescriptors = slices.Clone(descriptor.RouteDescriptors)
+		descriptorCopy.InstanceIDs = slices.Clone(descriptor.InstanceIDs)
+		serviceDescriptors = append(serviceDescriptors, &descriptorCopy)
+	}
+	return serviceDescriptors
+}
+
 func (r *GatewayServiceIndexer) ResolveService(method string, path string) (string, bool) {
+	serviceDescriptor, _, ok := r.ResolveRoute(method, path)
+	if !ok {
+		return "", false
+	}
+	return serviceDescriptor.Name, true
+}
+
+// ResolveRoute returns the service descriptor and the route descriptor that
+// match the given method and path.
+func (r *GatewayServiceIndexer) ResolveRoute(method string, path string) (*ServiceDescriptor, *RouteDescriptor, bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	for _, remoteService := range r.ServiceDescriptors {
@@ -44,9 +123,9 @@ func (r *GatewayServiceIndexer) ResolveService(method string, path string) (stri
 				continue
 			}
 			if _, isMatch := httpRoute.Pattern.Match(path); isMatch {
-				return remoteService.Name, true
+				return remoteService, httpRoute, true
 			}
 		}
 	}
-	return "", false
+	return nil, nil, false
 }
@@ -0,0 +1,67 @@
+package zephyr_test
+
+import (
+	"testing"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+)
+
+func TestGatewayServiceIndexer_Snapshot(t *testing.T) {
+	newRouteDescriptor := func(t *testing.T, method string, patternStr string) *zephyr.RouteDescriptor {
+		pattern, err := navaros.NewPattern(patternStr)
+		require.NoError(t, err)
+		return &zephyr.RouteDescriptor{Method: method, Pattern: pattern}
+	}
+
+	t.Run("Returns copies unaffected by later announcements", func(t *testing.T) {
+		indexer := &zephyr.GatewayServiceIndexer{}
+		require.NoError(t, indexer.SetServiceDescriptor(&zephyr.ServiceDescriptor{
+			Name:             "testService",
+			InstanceID:       "first",
+			RouteDescriptors: []*zephyr.RouteDescriptor{newRouteDescriptor(t, "GET", "/items")},
+		}))
+
+		snapshot := indexer.Snapshot()
+		require.NoError(t, indexer.SetServiceDescriptor(&zephyr.ServiceDescriptor{
+			Name:             "testService",
+			InstanceID:       "second",
+			RouteDescriptors: []*zephyr.RouteDescriptor{newRouteDescriptor(t, "POST", "/items")},
+		}))
+
+		require.Len(t, snapshot, 1)
+		assert.Equal(t, []string{"first"}, snapshot[0].InstanceIDs)
+		require.Len(t, snapshot[0].RouteDescriptors, 1)
+		assert.Equal(t, "GET", snapshot[0].RouteDescriptors[0].Method)
+	})
+
+	t.Run("Can be read while services announce themselves", func(t *testing.T) {
+		indexer := &zephyr.GatewayServiceIndexer{}
+		routeDescriptors := []*zephyr.RouteDescriptor{newRouteDescriptor(t, "GET", "/items")}
+		require.NoError(t, indexer.SetServiceDescriptor(&zephyr.ServiceDescriptor{
+			Name:             "testService",
+			RouteDescriptors: routeDescriptors,
+		}))
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				indexer.SetServiceDescriptor(&zephyr.ServiceDescriptor{
+					Name:             "testService",
+					InstanceID:       string(rune('a' + i%26)),
+					RouteDescriptors: routeDescriptors,
+				})
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			for _, descriptor := range indexer.Snapshot() {
+				assert.Len(t, descriptor.RouteDescriptors, 1)
+				assert.LessOrEqual(t, len(descriptor.InstanceIDs), 26)
+			}
+		}
+		<-done
+	})
+}
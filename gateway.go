@@ -1,6 +1,7 @@
 package zephyr
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -18,10 +19,43 @@ var (
 
 var GatewayAnnounceInterval = time.Duration((8 + rand.Intn(2))) * time.Second
 
+// DefaultMaxBodySize is the maximum request body size, in bytes, that a
+// gateway created with NewGateway will forward to a service.
+var DefaultMaxBodySize int64 = 10 << 20
+
 type Gateway struct {
 	Name      string
 	Transport Transport
-	gsi       *GatewayServiceIndexer
+
+	// Cache, if set, is used to cache responses to GET requests according to
+	// the caching headers sent by services. See ResponseCache.
+	Cache *ResponseCache
+
+	// Compression, if set, is used to compress responses for clients that
+	// accept gzip or zstd encoded bodies. See ResponseCompression.
+	Compression *ResponseCompression
+
+	// MaxBodySize is the maximum request body size, in bytes, the gateway will
+	// forward to a service. Routes may override it with their own
+	// MaxBodySize. If zero, DefaultMaxBodySize is used. If negative, request
+	// bodies are not limited.
+	MaxBodySize int64
+
+	// Debug, if set, includes the message and stack trace of a failed service
+	// handler in the body of the 502 response sent to the client. It should
+	// not be enabled in production, as stack traces reveal implementation
+	// details of services.
+	Debug bool
+
+	// StickyKey, if set, is used to route requests with the same key to the
+	// same instance of a service, for services which keep state in memory.
+	// It takes effect for services whose instances announce an instance ID,
+	// which requires a transport implementing InstanceDispatcher. Requests to
+	// an instance which has gone away are dispatched to any other instance.
+	StickyKey StickyKey
+
+	gsi                    *GatewayServiceIndexer
+	unbindConnectionChange func()
 }
 
 var _ http.Handler = &Gateway{}
@@ -29,8 +63,9 @@ var _ navaros.Handler = &Gateway{}
 
 func NewGateway(name string, transport Transport) *Gateway {
 	return &Gateway{
-		Name:      name,
-		Transport: transport,
+		Name:        name,
+		Transport:   transport,
+		MaxBodySize: DefaultMaxBodySize,
 	}
 }
 
@@ -91,13 +126,56 @@ func (g *Gateway) Start() error {
 		return err
 	}
 
+	gatewayDebug.Trace("Binding connection change handler")
+	g.unbindConnectionChange, err = bindConnectionChange(g.Transport, g.handleConnectionChange)
+	if err != nil {
+		gatewayDebug.Tracef("Failed to bind connection change handler: %v", err)
+		return err
+	}
+
+	return g.announce()
+}
+
+// Ready returns nil if the gateway has been started and its transport is
+// ready to carry requests, or an error describing why not. It is intended
+// for use in readiness probes.
+func (g *Gateway) Ready() error {
+	gsi := g.gsi
+	if gsi == nil {
+		return fmt.Errorf("gateway %s is not started", g.Name)
+	}
+	if err := transportReady(g.Transport); err != nil {
+		return fmt.Errorf("gateway %s transport is not ready: %w", g.Name, err)
+	}
+	return nil
+}
+
+func (g *Gateway) announce() error {
+	gsi := g.gsi
+	if gsi == nil {
+		return nil
+	}
 	gatewayDebug.Tracef("Announcing gateway %s", g.Name)
 	return g.Transport.AnnounceGateway(&GatewayDescriptor{
 		Name:               g.Name,
-		ServiceDescriptors: g.gsi.ServiceDescriptors,
+		ServiceDescriptors: gsi.Snapshot(),
 	})
 }
 
+// handleConnectionChange announces the gateway as soon as its transport
+// reconnects, so services that missed announcements while the connection was
+// down are introduced to it without waiting for the next one.
+func (g *Gateway) handleConnectionChange(isConnected bool) {
+	if !isConnected {
+		gatewayDebug.Tracef("Gateway %s transport disconnected", g.Name)
+		return
+	}
+	gatewayDebug.Tracef("Gateway %s transport reconnected", g.Name)
+	if err := g.announce(); err != nil {
+		gatewayDebug.Tracef("Failed to announce gateway after reconnecting: %v", err)
+	}
+}
+
 func (g *Gateway) Stop() {
 	gatewayDebug.Tracef("Stopping gateway %s", g.Name)
 
@@ -106,6 +184,12 @@ func (g *Gateway) Stop() {
 		return
 	}
 
+	gatewayDebug.Trace("Unbinding connection change handler")
+	if g.unbindConnectionChange != nil {
+		g.unbindConnectionChange()
+		g.unbindConnectionChange = nil
+	}
+
 	gatewayDebug.Trace("Clearing service indexer")
 	g.gsi = nil
 
@@ -127,16 +211,17 @@ func (g *Gateway) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	serviceName, ok := g.gsi.ResolveService(req.Method, req.URL.Path)
+	serviceDescriptor, routeDescriptor, ok := g.gsi.ResolveRoute(req.Method, req.URL.Path)
 	if !ok {
 		gatewayRouteDebug.Tracef("No service found for %s %s, returning 404", req.Method, req.URL.Path)
 		res.WriteHeader(404)
 		return
 	}
+	serviceName := serviceDescriptor.Name
 
 	gatewayRouteDebug.Tracef("Resolved %s %s to service %s", req.Method, req.URL.Path, serviceName)
 
-	if err := g.Transport.Dispatch(serviceName, res, req); err != nil {
+	if err := g.dispatch(serviceName, routeDescriptor, res, req); err != nil {
 		gatewayRouteDebug.Tracef("Error dispatching to %s: %v", serviceName, err)
 		panic(fmt.Errorf("failed to dispatch request to %s: %w", serviceName, err))
 	}
@@ -161,6 +246,27 @@ func (g *Gateway) CanServeHTTP(req *http.Request) bool {
 	return ok
 }
 
+// ResolveRoute returns the descriptors of the service and route a request with
+// the given method and path would be dispatched to, if the gateway knows of
+// one.
+func (g *Gateway) ResolveRoute(method string, path string) (*ServiceDescriptor, *RouteDescriptor, bool) {
+	gsi := g.gsi
+	if gsi == nil {
+		return nil, nil, false
+	}
+	return gsi.ResolveRoute(method, path)
+}
+
+// ServiceDescriptors returns copies of the descriptors of the services the
+// gateway has indexed from their announcements.
+func (g *Gateway) ServiceDescriptors() []*ServiceDescriptor {
+	gsi := g.gsi
+	if gsi == nil {
+		return nil
+	}
+	return gsi.Snapshot()
+}
+
 func (g *Gateway) Handle(ctx *navaros.Context) {
 	method := ctx.Method()
 	path := ctx.Path()
@@ -172,17 +278,18 @@ func (g *Gateway) Handle(ctx *navaros.Context) {
 		return
 	}
 
-	serviceName, ok := g.gsi.ResolveService(string(method), path)
+	serviceDescriptor, routeDescriptor, ok := g.gsi.ResolveRoute(string(method), path)
 	if !ok {
 		gatewayRouteDebug.Tracef("No service found for %s %s, skipping to next handler", method, path)
 		ctx.Next()
 		return
 	}
+	serviceName := serviceDescriptor.Name
 
 	gatewayRouteDebug.Tracef("Resolved %s %s to service %s", method, path, serviceName)
 
 	// This Panic is ok because it will be caught and handled by Navaros
-	if err := g.Transport.Dispatch(serviceName, ctx.ResponseWriter(), ctx.Request()); err != nil {
+	if err := g.dispatch(serviceName, routeDescriptor, ctx.ResponseWriter(), ctx.Request()); err != nil {
 		gatewayRouteDebug.Tracef("Error dispatching to %s: %v", serviceName, err)
 		panic(err)
 	}
@@ -208,3 +315,118 @@ func (g *Gateway) CanHandle(ctx *navaros.Context) bool {
 	}
 	return ok
 }
+
+// dispatch enforces the body size limit of the resolved route, then forwards
+// the request to the service, through the cache and compression if they are
+// configured. Upgrade requests bypass both so the connection can be hijacked
+// and tunnelled to the service. Requests declaring a Content-Length above the
+// limit are rejected before any of the body is streamed. Bodies without a
+// declared length are cut off once they exceed the limit, and if the transport
+// fails because of it before the response has started, the client receives a
+// 413. If the service's handler fails before it starts responding, the client
+// receives a 502.
+func (g *Gateway) dispatch(serviceName string, routeDescriptor *RouteDescriptor, res http.ResponseWriter, req *http.Request) error {
+	isUpgrade := IsUpgradeRequest(req)
+
+	if g.Compression != nil && !isUpgrade {
+		compressedRes, closeCompression := g.Compression.wrap(res, req)
+		res = compressedRes
+		defer func() {
+			if err := closeCompression(); err != nil {
+				gatewayRouteDebug.Tracef("Failed to finish compressed response: %v", err)
+			}
+		}()
+	}
+
+	trackedRes := &trackingResponseWriter{ResponseWriter: res}
+	res = trackedRes
+
+	maxBodySize := g.maxBodySize(routeDescriptor)
+	if maxBodySize > 0 {
+		if req.ContentLength > maxBodySize {
+			gatewayRouteDebug.Tracef("Request body of %d bytes exceeds limit of %d bytes, returning 413",
+				req.ContentLength, maxBodySize)
+			res.WriteHeader(http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		if req.Body != nil {
+			req.Body = http.MaxBytesReader(res, req.Body, maxBodySize)
+		}
+	}
+
+	var err error
+	switch {
+	case g.Cache == nil || isUpgrade:
+		err = g.dispatchToService(serviceName, routeDescriptor, res, req)
+	case req.Method == http.MethodGet:
+		err = g.Cache.serve(serviceName, res, req, func(res http.ResponseWriter, req *http.Request) error {
+			return g.dispatchToService(serviceName, routeDescriptor, res, req)
+		})
+	default:
+		err = g.dispatchToService(serviceName, routeDescriptor, res, req)
+		if err == nil && req.Method != http.MethodHead && req.Method != http.MethodOptions {
+			gatewayRouteDebug.Tracef("Invalidating cached responses for %s after %s", req.URL.Path, req.Method)
+			g.Cache.invalidate(req.URL.Path)
+		}
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) && !trackedRes.hasWritten {
+		gatewayRouteDebug.Tracef("Request body exceeded limit of %d bytes while streaming, returning 413",
+			maxBytesErr.Limit)
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) && !trackedRes.hasWritten {
+		gatewayRouteDebug.Tracef("Service %s handler failed, returning 502: %s", serviceName, remoteErr.Message)
+		body := http.StatusText(http.StatusBadGateway)
+		if g.Debug {
+			body = remoteErr.Error() + "\n\n" + remoteErr.Stack
+		}
+		http.Error(res, body, http.StatusBadGateway)
+		return nil
+	}
+
+	return err
+}
+
+// dispatchToService dispatches the request to the instance of the service its
+// sticky key maps to, if the gateway has a StickyKey and the service's
+// instances have announced their IDs. Otherwise, or if that instance has gone
+// away, the request is dispatched to any instance.
+func (g *Gateway) dispatchToService(serviceName string, routeDescriptor *RouteDescriptor, res http.ResponseWriter, req *http.Request) error {
+	gsi := g.gsi
+	instanceDispatcher, ok := g.Transport.(InstanceDispatcher)
+	if g.StickyKey == nil || gsi == nil || !ok {
+		return g.Transport.Dispatch(serviceName, res, req)
+	}
+	key := g.StickyKey(req, routeDescriptor)
+	if key == "" {
+		return g.Transport.Dispatch(serviceName, res, req)
+	}
+	instanceID, ok := gsi.ResolveInstance(serviceName, key)
+	if !ok {
+		return g.Transport.Dispatch(serviceName, res, req)
+	}
+
+	gatewayRouteDebug.Tracef("Dispatching to instance %s of service %s", instanceID, serviceName)
+	err := instanceDispatcher.DispatchInstance(serviceName, instanceID, res, req)
+	if errors.Is(err, ErrInstanceUnavailable) {
+		gatewayRouteDebug.Tracef("Instance %s of service %s is unavailable, removing it", instanceID, serviceName)
+		gsi.UnsetServiceInstance(serviceName, instanceID)
+		return g.Transport.Dispatch(serviceName, res, req)
+	}
+	return err
+}
+
+func (g *Gateway) maxBodySize(routeDescriptor *RouteDescriptor) int64 {
+	if routeDescriptor != nil && routeDescriptor.MaxBodySize != 0 {
+		return routeDescriptor.MaxBodySize
+	}
+	if g.MaxBodySize != 0 {
+		return g.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
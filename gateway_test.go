@@ -0,0 +1,695 @@
+package zephyr_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/telemetrytv/zephyr"
+	localtransport "github.com/telemetrytv/zephyr/local-transport"
+)
+
+func TestGateway_MaxBodySize(t *testing.T) {
+	startGateway := func(t *testing.T, maxBodySize int64, handler func(ctx *navaros.Context)) *zephyr.Gateway {
+		transport := localtransport.New()
+
+		g := zephyr.NewGateway("testGateway", transport)
+		g.MaxBodySize = 8
+		assert.NoError(t, g.Start())
+
+		routeDescriptor, err := zephyr.NewRouteDescriptor("POST", "/upload", zephyr.WithMaxBodySize(maxBodySize))
+		assert.NoError(t, err)
+
+		s := zephyr.NewService("testService", transport, handler)
+		s.RouteDescriptors = []*zephyr.RouteDescriptor{routeDescriptor}
+		assert.NoError(t, s.Start())
+
+		return g
+	}
+
+	t.Run("Rejects requests with a Content-Length above the limit", func(t *testing.T) {
+		handlerCalled := false
+		g := startGateway(t, 0, func(ctx *navaros.Context) {
+			handlerCalled = true
+		})
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("too large body"))
+		g.ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+		assert.False(t, handlerCalled)
+	})
+
+	t.Run("Cuts off bodies without a Content-Length once they exceed the limit", func(t *testing.T) {
+		var readErr error
+		g := startGateway(t, 0, func(ctx *navaros.Context) {
+			_, readErr = io.ReadAll(ctx.RequestBodyReader())
+			ctx.Status = http.StatusNoContent
+		})
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("too large body"))
+		req.ContentLength = -1
+		g.ServeHTTP(res, req)
+
+		var maxBytesErr *http.MaxBytesError
+		assert.ErrorAs(t, readErr, &maxBytesErr)
+		assert.Equal(t, http.StatusNoContent, res.Code)
+	})
+
+	startStreamingGateway := func(t *testing.T, dispatch zephyr.DispatchFunc) *zephyr.Gateway {
+		transport := localtransport.New()
+		streamingTransport := zephyr.WrapTransport(transport, zephyr.TransportMiddleware{
+			Dispatch: func(next zephyr.DispatchFunc) zephyr.DispatchFunc {
+				return dispatch
+			},
+		})
+
+		g := zephyr.NewGateway("testGateway", streamingTransport)
+		g.MaxBodySize = 8
+		assert.NoError(t, g.Start())
+
+		routeDescriptor, err := zephyr.NewRouteDescriptor("POST", "/upload")
+		assert.NoError(t, err)
+		s := zephyr.NewService("testService", transport, func(ctx *navaros.Context) {})
+		s.RouteDescriptors = []*zephyr.RouteDescriptor{routeDescriptor}
+		assert.NoError(t, s.Start())
+
+		return g
+	}
+
+	t.Run("Responds with a 413 if the transport fails streaming an oversized body", func(t *testing.T) {
+		g := startStreamingGateway(t, func(serviceName string, res http.ResponseWriter, req *http.Request) error {
+			_, err := io.ReadAll(req.Body)
+			return err
+		})
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("too large body"))
+		req.ContentLength = -1
+		g.ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+	})
+
+	t.Run("Aborts the response instead of responding with a 413 once it has started", func(t *testing.T) {
+		g := startStreamingGateway(t, func(serviceName string, res http.ResponseWriter, req *http.Request) error {
+			res.WriteHeader(http.StatusAccepted)
+			_, err := io.ReadAll(req.Body)
+			return err
+		})
+
+		res := &headerCountingRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("too large body"))
+		req.ContentLength = -1
+		assert.Panics(t, func() {
+			g.ServeHTTP(res, req)
+		})
+
+		assert.Equal(t, http.StatusAccepted, res.Code)
+		assert.Equal(t, 1, res.headerWrites)
+	})
+
+	t.Run("Allows routes to override the gateway limit", func(t *testing.T) {
+		var recvBody []byte
+		g := startGateway(t, 64, func(ctx *navaros.Context) {
+			recvBody, _ = io.ReadAll(ctx.RequestBodyReader())
+			ctx.Status = http.StatusNoContent
+		})
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("larger than gateway limit"))
+		g.ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusNoContent, res.Code)
+		assert.Equal(t, "larger than gateway limit", string(recvBody))
+	})
+
+	t.Run("Rejects requests above a limit declared by the service", func(t *testing.T) {
+		transport := localtransport.New()
+
+		g := zephyr.NewGateway("testGateway", transport)
+		assert.NoError(t, g.Start())
+
+		handlerCalled := false
+		router := navaros.NewRouter()
+		router.PublicPost("/upload", func(ctx *navaros.Context) {
+			handlerCalled = true
+		})
+		s := zephyr.NewService("testService", transport, router)
+		s.MaxBodySize = 8
+		assert.NoError(t, s.Start())
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("too large body"))
+		g.ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+		assert.False(t, handlerCalled)
+	})
+}
+
+// headerCountingRecorder counts calls to WriteHeader, which the recorder
+// itself ignores after the first.
+type headerCountingRecorder struct {
+	*httptest.ResponseRecorder
+	headerWrites int
+}
+
+func (r *headerCountingRecorder) WriteHeader(statusCode int) {
+	r.headerWrites += 1
+	r.ResponseRecorder.WriteHeader(statusCode)
+}
+
+func TestGateway_Cache(t *testing.T) {
+	startGateway := func(t *testing.T, handler func(ctx *navaros.Context)) *zephyr.Gateway {
+		transport := localtransport.New()
+
+		g := zephyr.NewGateway("testGateway", transport)
+		g.Cache = zephyr.NewResponseCache(1024)
+		assert.NoError(t, g.Start())
+
+		router := navaros.NewRouter()
+		router.PublicGet("/items/:id", handler)
+		router.PublicPost("/items/:id", func(ctx *navaros.Context) {
+			ctx.Status = http.StatusNoContent
+		})
+		s := zephyr.NewService("testService", transport, router)
+		assert.NoError(t, s.Start())
+
+		return g
+	}
+
+	get := func(g *zephyr.Gateway, path string, header http.Header) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		g.ServeHTTP(res, req)
+		return res
+	}
+
+	t.Run("Serves fresh responses from the cache", func(t *testing.T) {
+		calls := 0
+		g := startGateway(t, func(ctx *navaros.Context) {
+			calls += 1
+			ctx.Headers.Set("Cache-Control", "public, max-age=60")
+			ctx.Body = "item " + ctx.Params().Get("id")
+		})
+
+		res1 := get(g, "/items/1", nil)
+		res2 := get(g, "/items/1", nil)
+
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, "item 1", res1.Body.String())
+		assert.Equal(t, http.StatusOK, res2.Code)
+		assert.Equal(t, "item 1", res2.Body.String())
+		assert.Equal(t, "0", res2.Header().Get("Age"))
+	})
+
+	t.Run("Does not cache responses marked no-store or private", func(t *testing.T) {
+		calls := 0
+		g := startGateway(t, func(ctx *navaros.Context) {
+			calls += 1
+			if ctx.Params().Get("id") == "1" {
+				ctx.Headers.Set("Cache-Control", "no-store")
+			} else {
+				ctx.Headers.Set("Cache-Control", "private, max-age=60")
+			}
+			ctx.Body = "item"
+		})
+
+		get(g, "/items/1", nil)
+		get(g, "/items/1", nil)
+		get(g, "/items/2", nil)
+		get(g, "/items/2", nil)
+
+		assert.Equal(t, 4, calls)
+		assert.Equal(t, 0, g.Cache.Len())
+	})
+
+	t.Run("Stores separate responses for headers listed in Vary", func(t *testing.T) {
+		calls := 0
+		g := startGateway(t, func(ctx *navaros.Context) {
+			calls += 1
+			ctx.Headers.Set("Cache-Control", "max-age=60")
+			ctx.Headers.Set("Vary", "Accept-Language")
+			ctx.Body = "hello " + ctx.RequestHeaders().Get("Accept-Language")
+		})
+
+		en := http.Header{"Accept-Language": {"en"}}
+		fr := http.Header{"Accept-Language": {"fr"}}
+		get(g, "/items/1", en)
+		get(g, "/items/1", fr)
+		resEn := get(g, "/items/1", en)
+		resFr := get(g, "/items/1", fr)
+
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, "hello en", resEn.Body.String())
+		assert.Equal(t, "hello fr", resFr.Body.String())
+	})
+
+	t.Run("Revalidates stale responses using their ETag", func(t *testing.T) {
+		calls := 0
+		var ifNoneMatch string
+		g := startGateway(t, func(ctx *navaros.Context) {
+			calls += 1
+			ctx.Headers.Set("Cache-Control", "no-cache")
+			ctx.Headers.Set("ETag", `"v1"`)
+			ifNoneMatch = ctx.RequestHeaders().Get("If-None-Match")
+			if ifNoneMatch == `"v1"` {
+				ctx.Status = http.StatusNotModified
+				return
+			}
+			ctx.Body = "item"
+		})
+
+		get(g, "/items/1", nil)
+		res := get(g, "/items/1", nil)
+
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, `"v1"`, ifNoneMatch)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "item", res.Body.String())
+
+		res = get(g, "/items/1", http.Header{"If-None-Match": {`"v1"`}})
+		assert.Equal(t, http.StatusNotModified, res.Code)
+	})
+
+	t.Run("Accounts for headers added when a response is revalidated", func(t *testing.T) {
+		padding := ""
+		g := startGateway(t, func(ctx *navaros.Context) {
+			ctx.Headers.Set("Cache-Control", "no-cache")
+			ctx.Headers.Set("ETag", `"v1"`)
+			if ctx.RequestHeaders().Get("If-None-Match") == `"v1"` {
+				ctx.Headers.Set("X-Padding", padding)
+				ctx.Status = http.StatusNotModified
+				return
+			}
+			ctx.Body = "item"
+		})
+
+		get(g, "/items/1", nil)
+		storedSize := g.Cache.Size()
+		padding = strings.Repeat("p", 300)
+		get(g, "/items/1", nil)
+		assert.Greater(t, g.Cache.Size(), storedSize+300)
+
+		assert.Equal(t, 1, g.Cache.PurgePrefix("/items"))
+		assert.Equal(t, int64(0), g.Cache.Size())
+
+		padding = ""
+		get(g, "/items/1", nil)
+		padding = strings.Repeat("p", 2000)
+		get(g, "/items/1", nil)
+		assert.Equal(t, 0, g.Cache.Len())
+		assert.Equal(t, int64(0), g.Cache.Size())
+	})
+
+	t.Run("Evicts the least recently used responses when full", func(t *testing.T) {
+		g := startGateway(t, func(ctx *navaros.Context) {
+			ctx.Headers.Set("Cache-Control", "max-age=60")
+			ctx.Body = strings.Repeat("x", 200)
+		})
+
+		for i := 0; i < 10; i += 1 {
+			get(g, "/items/"+string(rune('a'+i)), nil)
+		}
+
+		assert.LessOrEqual(t, g.Cache.Size(), int64(1024))
+		assert.Less(t, g.Cache.Len(), 10)
+	})
+
+	t.Run("Purges responses by service name and path prefix", func(t *testing.T) {
+		calls := 0
+		g := startGateway(t, func(ctx *navaros.Context) {
+			calls += 1
+			ctx.Headers.Set("Cache-Control", "max-age=60")
+			ctx.Body = "item"
+		})
+
+		get(g, "/items/1", nil)
+		get(g, "/items/2", nil)
+		assert.Equal(t, 2, g.Cache.Len())
+
+		assert.Equal(t, 1, g.Cache.PurgePrefix("/items/1"))
+		assert.Equal(t, 1, g.Cache.PurgeService("testService"))
+		assert.Equal(t, 0, g.Cache.Len())
+
+		get(g, "/items/1", nil)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("Invalidates cached responses after an unsafe request", func(t *testing.T) {
+		calls := 0
+		g := startGateway(t, func(ctx *navaros.Context) {
+			calls += 1
+			ctx.Headers.Set("Cache-Control", "max-age=60")
+			ctx.Body = "item"
+		})
+
+		get(g, "/items/1", nil)
+		g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/items/1", nil))
+		get(g, "/items/1", nil)
+
+		assert.Equal(t, 2, calls)
+	})
+}
+
+func TestGateway_Compression(t *testing.T) {
+	startGateway := func(t *testing.T, handler func(ctx *navaros.Context)) *zephyr.Gateway {
+		transport := localtransport.New()
+
+		g := zephyr.NewGateway("testGateway", transport)
+		g.Compression = zephyr.NewResponseCompression()
+		assert.NoError(t, g.Start())
+
+		router := navaros.NewRouter()
+		router.PublicGet("/data", handler)
+		s := zephyr.NewService("testService", transport, router)
+		assert.NoError(t, s.Start())
+
+		return g
+	}
+
+	get := func(g *zephyr.Gateway, acceptEncoding string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/data", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		g.ServeHTTP(res, req)
+		return res
+	}
+
+	largeBody := strings.Repeat("compress me ", 1000)
+
+	t.Run("Compresses large compressible responses with gzip", func(t *testing.T) {
+		g := startGateway(t, func(ctx *navaros.Context) {
+			ctx.Headers.Set("Content-Type", "text/plain")
+			ctx.Body = largeBody
+		})
+
+		res := get(g, "gzip")
+
+		assert.Equal(t, "gzip", res.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", res.Header().Get("Vary"))
+		reader, err := gzip.NewReader(res.Body)
+		assert.NoError(t, err)
+		body, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, largeBody, string(body))
+	})
+
+	t.Run("Prefers zstd when the client accepts it", func(t *testing.T) {
+		g := startGateway(t, func(ctx *navaros.Context) {
+			ctx.Headers.Set("Content-Type", "application/json")
+			ctx.Body = largeBody
+		})
+
+		res := get(g, "gzip, zstd")
+
+		assert.Equal(t, "zstd", res.Header().Get("Content-Encoding"))
+		decoder, err := zstd.NewReader(res.Body)
+		assert.NoError(t, err)
+		body, err := io.ReadAll(decoder)
+		assert.NoError(t, err)
+		assert.Equal(t, largeBody, string(body))
+	})
+
+	t.Run("Leaves small, incompressible, and already encoded responses alone", func(t *testing.T) {
+		g := startGateway(t, func(ctx *navaros.Context) {
+			ctx.Headers.Set("Content-Type", "text/plain")
+			ctx.Body = "small"
+		})
+		res := get(g, "gzip")
+		assert.Equal(t, "", res.Header().Get("Content-Encoding"))
+		assert.Equal(t, "small", res.Body.String())
+
+		g = startGateway(t, func(ctx *navaros.Context) {
+			ctx.Headers.Set("Content-Type", "image/png")
+			ctx.Body = largeBody
+		})
+		res = get(g, "gzip")
+		assert.Equal(t, "", res.Header().Get("Content-Encoding"))
+		assert.Equal(t, largeBody, res.Body.String())
+
+		g = startGateway(t, func(ctx *navaros.Context) {
+			ctx.Headers.Set("Content-Type", "text/plain")
+			ctx.Headers.Set("Content-Encoding", "br")
+			ctx.Body = largeBody
+		})
+		res = get(g, "gzip, br")
+		assert.Equal(t, "br", res.Header().Get("Content-Encoding"))
+		assert.Equal(t, largeBody, res.Body.String())
+	})
+
+	t.Run("Marks every compressible response as varying by Accept-Encoding", func(t *testing.T) {
+		g := startGateway(t, func(ctx *navaros.Context) {
+			ctx.Headers.Set("Content-Type", "text/plain")
+			ctx.Body = "small"
+		})
+
+		res := get(g, "gzip")
+		assert.Equal(t, "", res.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", res.Header().Get("Vary"))
+
+		res = get(g, "")
+		assert.Equal(t, "", res.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", res.Header().Get("Vary"))
+	})
+
+	t.Run("Forwards informational responses before the final status", func(t *testing.T) {
+		g := startGateway(t, func(ctx *navaros.Context) {
+			res := ctx.ResponseWriter()
+			res.Header().Set("Link", "</style.css>; rel=preload")
+			res.WriteHeader(http.StatusEarlyHints)
+			res.Header().Set("Content-Type", "text/plain")
+			res.WriteHeader(http.StatusCreated)
+			_, _ = res.Write([]byte(largeBody))
+		})
+		server := httptest.NewServer(g)
+		defer server.Close()
+
+		var informationalCodes []int
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				informationalCodes = append(informationalCodes, code)
+				return nil
+			},
+		}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", server.URL+"/data", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultTransport.RoundTrip(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		assert.Equal(t, []int{http.StatusEarlyHints}, informationalCodes)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	})
+
+	t.Run("Lets a failed dispatch respond with an error", func(t *testing.T) {
+		transport := localtransport.New()
+		failingTransport := zephyr.WrapTransport(transport, zephyr.TransportMiddleware{
+			Dispatch: func(next zephyr.DispatchFunc) zephyr.DispatchFunc {
+				return func(serviceName string, res http.ResponseWriter, req *http.Request) error {
+					return errors.New("transport failed")
+				}
+			},
+		})
+
+		g := zephyr.NewGateway("testGateway", failingTransport)
+		g.Compression = zephyr.NewResponseCompression()
+		assert.NoError(t, g.Start())
+
+		routeDescriptor, err := zephyr.NewRouteDescriptor("GET", "/data")
+		assert.NoError(t, err)
+		s := zephyr.NewService("testService", transport, func(ctx *navaros.Context) {})
+		s.RouteDescriptors = []*zephyr.RouteDescriptor{routeDescriptor}
+		assert.NoError(t, s.Start())
+
+		router := navaros.NewRouter()
+		router.Use(g)
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/data", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		router.ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusInternalServerError, res.Code)
+	})
+}
+
+func TestGateway_Upgrade(t *testing.T) {
+	t.Run("Tunnels upgraded connections to the service", func(t *testing.T) {
+		transport := localtransport.New()
+
+		g := zephyr.NewGateway("testGateway", transport)
+		assert.NoError(t, g.Start())
+
+		router := navaros.NewRouter()
+		router.PublicGet("/echo", func(ctx *navaros.Context) {
+			conn, brw, err := zephyr.Hijack(ctx)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			_, err = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+			assert.NoError(t, err)
+			assert.NoError(t, brw.Flush())
+
+			line, err := brw.ReadString('\n')
+			assert.NoError(t, err)
+			_, err = brw.WriteString("echo: " + line)
+			assert.NoError(t, err)
+			assert.NoError(t, brw.Flush())
+		})
+		s := zephyr.NewService("testService", transport, router)
+		assert.NoError(t, s.Start())
+
+		served := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			defer close(served)
+			g.ServeHTTP(res, req)
+		}))
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		_, err = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: test\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+		assert.NoError(t, err)
+
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+		_, err = conn.Write([]byte("hello\n"))
+		assert.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "echo: hello\n", line)
+
+		assert.NoError(t, conn.Close())
+		<-served
+	})
+}
+
+func TestGateway_Flush(t *testing.T) {
+	t.Run("Flushes streamed responses to the client as they are written", func(t *testing.T) {
+		transport := localtransport.New()
+
+		g := zephyr.NewGateway("testGateway", transport)
+		g.Compression = zephyr.NewResponseCompression()
+		g.Cache = zephyr.NewResponseCache(0)
+		assert.NoError(t, g.Start())
+
+		release := make(chan struct{})
+		router := navaros.NewRouter()
+		router.PublicGet("/events", func(ctx *navaros.Context) {
+			ctx.Headers.Set("Content-Type", "text/event-stream")
+			_, err := ctx.Write([]byte("data: first\n\n"))
+			assert.NoError(t, err)
+			ctx.Flush()
+			<-release
+			_, err = ctx.Write([]byte("data: second\n\n"))
+			assert.NoError(t, err)
+		})
+		s := zephyr.NewService("testService", transport, router)
+		assert.NoError(t, s.Start())
+
+		server := httptest.NewServer(g)
+		defer server.Close()
+
+		req, err := http.NewRequest("GET", server.URL+"/events", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultTransport.RoundTrip(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		reader := bufio.NewReader(res.Body)
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "data: first\n", line)
+
+		close(release)
+		rest, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, "\ndata: second\n\n", string(rest))
+	})
+}
+
+func TestGateway_RemoteError(t *testing.T) {
+	startGateway := func(t *testing.T, handler func(ctx *navaros.Context)) *zephyr.Gateway {
+		transport := localtransport.New()
+
+		g := zephyr.NewGateway("testGateway", transport)
+		assert.NoError(t, g.Start())
+
+		routeDescriptor, err := zephyr.NewRouteDescriptor("GET", "/fail")
+		assert.NoError(t, err)
+
+		s := zephyr.NewService("testService", transport, handler)
+		s.RouteDescriptors = []*zephyr.RouteDescriptor{routeDescriptor}
+		assert.NoError(t, s.Start())
+
+		return g
+	}
+
+	t.Run("Responds with a 502 when the service handler fails", func(t *testing.T) {
+		g := startGateway(t, func(ctx *navaros.Context) {
+			panic("something went wrong")
+		})
+
+		res := httptest.NewRecorder()
+		g.ServeHTTP(res, httptest.NewRequest("GET", "/fail", nil))
+
+		assert.Equal(t, http.StatusBadGateway, res.Code)
+		assert.NotContains(t, res.Body.String(), "something went wrong")
+	})
+
+	t.Run("Includes the handler error and stack in debug mode", func(t *testing.T) {
+		g := startGateway(t, func(ctx *navaros.Context) {
+			panic("something went wrong")
+		})
+		g.Debug = true
+
+		res := httptest.NewRecorder()
+		g.ServeHTTP(res, httptest.NewRequest("GET", "/fail", nil))
+
+		assert.Equal(t, http.StatusBadGateway, res.Code)
+		assert.Contains(t, res.Body.String(), "service testService handler failed: something went wrong")
+		assert.Contains(t, res.Body.String(), "gateway_test.go")
+	})
+
+	t.Run("Aborts the response when the handler fails after starting it", func(t *testing.T) {
+		g := startGateway(t, func(ctx *navaros.Context) {
+			_, err := ctx.Write([]byte("partial"))
+			assert.NoError(t, err)
+			panic("something went wrong")
+		})
+
+		res := httptest.NewRecorder()
+		assert.Panics(t, func() {
+			g.ServeHTTP(res, httptest.NewRequest("GET", "/fail", nil))
+		})
+		assert.Equal(t, http.StatusOK, res.Code)
+	})
+}
@@ -0,0 +1,218 @@
+package httptransport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/telemetrytv/zephyr"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func (c *HTTPTransport) AnnounceGateway(gatewayDescriptor *zephyr.GatewayDescriptor) error {
+	transportHTTPAnnounceDebug.Tracef("Announcing gateway %s with %d services",
+		gatewayDescriptor.Name, len(gatewayDescriptor.ServiceDescriptors))
+	gatewayDescriptorBuf, err := msgpack.Marshal(gatewayDescriptor)
+	if err != nil {
+		transportHTTPAnnounceDebug.Tracef("Failed to marshal gateway descriptor: %v", err)
+		return err
+	}
+	c.mu.Lock()
+	c.lastGatewayAnnouncement = gatewayDescriptorBuf
+	c.mu.Unlock()
+	return c.broadcast(pathAnnounceGateway, gatewayDescriptorBuf)
+}
+
+func (c *HTTPTransport) BindGatewayAnnounce(handler func(gatewayDescriptor *zephyr.GatewayDescriptor)) error {
+	transportHTTPAnnounceDebug.Trace("Binding gateway announcement handler")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gatewayAnnounceHandlers = append(c.gatewayAnnounceHandlers, handler)
+	return nil
+}
+
+func (c *HTTPTransport) UnbindGatewayAnnounce() error {
+	transportHTTPAnnounceDebug.Trace("Unbinding gateway announcement handlers")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gatewayAnnounceHandlers = nil
+	return nil
+}
+
+func (c *HTTPTransport) AnnounceService(serviceDescriptor *zephyr.ServiceDescriptor) error {
+	transportHTTPAnnounceDebug.Tracef("Announcing service %s with %d routes",
+		serviceDescriptor.Name, len(serviceDescriptor.RouteDescriptors))
+	serviceDescriptorBuf, err := msgpack.Marshal(serviceDescriptor)
+	if err != nil {
+		transportHTTPAnnounceDebug.Tracef("Failed to marshal service descriptor: %v", err)
+		return err
+	}
+	c.mu.Lock()
+	c.lastServiceAnnouncements[serviceDescriptor.Name] = serviceDescriptorBuf
+	c.mu.Unlock()
+	return c.broadcast(pathAnnounceService, serviceDescriptorBuf)
+}
+
+func (c *HTTPTransport) BindServiceAnnounce(handler func(serviceDescriptor *zephyr.ServiceDescriptor)) error {
+	transportHTTPAnnounceDebug.Trace("Binding service announcement handler")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serviceAnnounceHandlers = append(c.serviceAnnounceHandlers, handler)
+	return nil
+}
+
+func (c *HTTPTransport) UnbindServiceAnnounce() error {
+	transportHTTPAnnounceDebug.Trace("Unbinding service announcement handlers")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serviceAnnounceHandlers = nil
+	return nil
+}
+
+// broadcast posts an announcement to every peer in the registry, including
+// this transport. Peers call their announcement handlers before replying, so
+// once broadcast returns they have all seen the announcement, and any
+// announcements their handlers made in response have been delivered. Peers
+// which cannot be reached are skipped, as they may have gone away without
+// deregistering.
+func (c *HTTPTransport) broadcast(path string, body []byte) error {
+	if err := c.Ready(); err != nil {
+		return err
+	}
+	peers, err := c.Registry.Peers()
+	if err != nil {
+		transportHTTPAnnounceDebug.Tracef("Failed to list peers: %v", err)
+		return err
+	}
+
+	transportHTTPAnnounceDebug.Tracef("Posting announcement to %s on %d peers", path, len(peers))
+	wg := sync.WaitGroup{}
+	for _, addr := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.post(addr, path, body)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// post posts an announcement to the peer at addr.
+func (c *HTTPTransport) post(addr string, path string, body []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.AnnounceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(addr, path), bytes.NewReader(body))
+	if err != nil {
+		transportHTTPAnnounceDebug.Tracef("Failed to create announcement for %s: %v", addr, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/msgpack")
+	req.Header.Set(headerAddr, c.AdvertiseAddr)
+	res, err := c.client.Do(req)
+	if err != nil {
+		transportHTTPAnnounceDebug.Tracef("Failed to post announcement to %s: %v", addr, err)
+		return
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+}
+
+// handlePeerAdded is called by registries implementing Watcher when a peer
+// appears. The peer is sent the last announcements made through this
+// transport, so it learns about the gateway or services here without waiting
+// for them to announce again. Announcements are only replayed while they
+// still apply: a gateway's while it is listening for service announcements,
+// and a service's while it is bound.
+func (c *HTTPTransport) handlePeerAdded(addr string) {
+	if addr == c.AdvertiseAddr || c.Ready() != nil {
+		return
+	}
+
+	c.mu.RLock()
+	var gatewayAnnouncement []byte
+	if len(c.serviceAnnounceHandlers) > 0 {
+		gatewayAnnouncement = c.lastGatewayAnnouncement
+	}
+	serviceAnnouncements := [][]byte{}
+	for serviceName, serviceAnnouncement := range c.lastServiceAnnouncements {
+		if _, ok := c.dispatchHandlers[serviceName]; ok {
+			serviceAnnouncements = append(serviceAnnouncements, serviceAnnouncement)
+		}
+	}
+	c.mu.RUnlock()
+
+	if gatewayAnnouncement == nil && len(serviceAnnouncements) == 0 {
+		return
+	}
+	transportHTTPAnnounceDebug.Tracef("Replaying announcements to new peer %s", addr)
+	if gatewayAnnouncement != nil {
+		c.post(addr, pathAnnounceGateway, gatewayAnnouncement)
+	}
+	for _, serviceAnnouncement := range serviceAnnouncements {
+		c.post(addr, pathAnnounceService, serviceAnnouncement)
+	}
+}
+
+func (c *HTTPTransport) serveGatewayAnnounce(res http.ResponseWriter, req *http.Request) {
+	gatewayDescriptor := &zephyr.GatewayDescriptor{}
+	if err := msgpack.NewDecoder(req.Body).Decode(gatewayDescriptor); err != nil {
+		transportHTTPAnnounceDebug.Tracef("Failed to unmarshal gateway descriptor: %v", err)
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	transportHTTPAnnounceDebug.Tracef("Received announcement from gateway %s", gatewayDescriptor.Name)
+	res.WriteHeader(http.StatusNoContent)
+
+	c.mu.RLock()
+	handlers := slices.Clone(c.gatewayAnnounceHandlers)
+	c.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(gatewayDescriptor)
+	}
+}
+
+func (c *HTTPTransport) serveServiceAnnounce(res http.ResponseWriter, req *http.Request) {
+	serviceDescriptor := &zephyr.ServiceDescriptor{}
+	if err := msgpack.NewDecoder(req.Body).Decode(serviceDescriptor); err != nil {
+		transportHTTPAnnounceDebug.Tracef("Failed to unmarshal service descriptor: %v", err)
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	transportHTTPAnnounceDebug.Tracef("Received announcement from service %s with %d routes",
+		serviceDescriptor.Name, len(serviceDescriptor.RouteDescriptors))
+	res.WriteHeader(http.StatusNoContent)
+
+	if addr := req.Header.Get(headerAddr); addr != "" {
+		c.addServiceAddr(serviceDescriptor.Name, addr)
+	}
+
+	c.mu.RLock()
+	handlers := slices.Clone(c.serviceAnnounceHandlers)
+	c.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(serviceDescriptor)
+	}
+}
+
+// serveServices lists the services bound on the transport, so peers can find
+// out where to dispatch requests.
+func (c *HTTPTransport) serveServices(res http.ResponseWriter, req *http.Request) {
+	c.mu.RLock()
+	serviceNames := make([]string, 0, len(c.dispatchHandlers))
+	for serviceName := range c.dispatchHandlers {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	c.mu.RUnlock()
+
+	serviceNamesBuf, err := msgpack.Marshal(serviceNames)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/msgpack")
+	res.Write(serviceNamesBuf)
+}
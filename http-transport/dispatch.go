@@ -0,0 +1,440 @@
+package httptransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/telemetrytv/zephyr"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func (c *HTTPTransport) Dispatch(serviceName string, res http.ResponseWriter, req *http.Request) error {
+	transportHTTPDispatchDebug.Tracef("Dispatching request to service %s: %s %s", serviceName, req.Method, req.URL.Path)
+	if err := c.Ready(); err != nil {
+		return err
+	}
+
+	addrs := c.resolve(serviceName, false)
+	hasRefreshed := false
+	for {
+		if len(addrs) == 0 {
+			if hasRefreshed {
+				break
+			}
+			addrs = c.resolve(serviceName, true)
+			hasRefreshed = true
+			continue
+		}
+		addr := c.pickAddr(addrs)
+		err := c.dispatch(serviceName, addr, res, req)
+		if !errors.Is(err, zephyr.ErrInstanceUnavailable) {
+			return err
+		}
+		transportHTTPDispatchDebug.Tracef("Service %s is unavailable at %s, trying another address", serviceName, addr)
+		c.removeServiceAddr(serviceName, addr)
+		addrs = slices.DeleteFunc(addrs, func(existingAddr string) bool {
+			return existingAddr == addr
+		})
+	}
+
+	transportHTTPDispatchDebug.Tracef("No peers have service %s bound", serviceName)
+	return fmt.Errorf("httptransport: no peers have service %s bound", serviceName)
+}
+
+// InstanceID returns the address the transport is advertised at, which
+// DispatchInstance dispatches to.
+func (c *HTTPTransport) InstanceID() string {
+	return c.AdvertiseAddr
+}
+
+// DispatchInstance dispatches a request to the service bound on the transport
+// advertised at the address given as the instance ID. If the service is not
+// bound there, zephyr.ErrInstanceUnavailable is returned with the request body
+// intact.
+func (c *HTTPTransport) DispatchInstance(serviceName string, instanceID string, res http.ResponseWriter, req *http.Request) error {
+	transportHTTPDispatchDebug.Tracef("Dispatching request to instance %s of service %s: %s %s",
+		instanceID, serviceName, req.Method, req.URL.Path)
+	if err := c.Ready(); err != nil {
+		return err
+	}
+	err := c.dispatch(serviceName, instanceID, res, req)
+	if errors.Is(err, zephyr.ErrInstanceUnavailable) {
+		c.removeServiceAddr(serviceName, instanceID)
+	}
+	return err
+}
+
+func (c *HTTPTransport) BindDispatch(serviceName string, handler func(res http.ResponseWriter, req *http.Request)) error {
+	transportHTTPDispatchDebug.Tracef("Binding dispatch handler for service %s", serviceName)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dispatchHandlers[serviceName] = handler
+	return nil
+}
+
+func (c *HTTPTransport) UnbindDispatch(serviceName string) error {
+	transportHTTPDispatchDebug.Tracef("Unbinding dispatch handler for service %s", serviceName)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.dispatchHandlers, serviceName)
+	return nil
+}
+
+// dispatch proxies the request to the transport at addr. If the transport
+// cannot be reached, or does not have the service bound, and nothing of the
+// request body has been sent, zephyr.ErrInstanceUnavailable is returned.
+func (c *HTTPTransport) dispatch(serviceName string, addr string, res http.ResponseWriter, req *http.Request) error {
+	if zephyr.IsUpgradeRequest(req) {
+		return c.dispatchUpgrade(serviceName, addr, res, req)
+	}
+
+	body := &dispatchBody{}
+	var outBody io.Reader = http.NoBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body.reader = req.Body
+		outBody = body
+	}
+	outReq, err := http.NewRequestWithContext(req.Context(), req.Method, c.url(addr, req.URL.RequestURI()), outBody)
+	if err != nil {
+		return err
+	}
+	outReq.ContentLength = req.ContentLength
+	copyHeader(outReq.Header, req.Header)
+	setDispatchHeaders(outReq.Header, serviceName, req)
+	if len(req.Trailer) > 0 {
+		// Trailers are only sent with a chunked body, and the values of the
+		// shared map are filled in once the body has been read to the end.
+		outReq.Trailer = req.Trailer
+		outReq.ContentLength = -1
+	}
+
+	transportHTTPDispatchDebug.Tracef("Proxying request to %s", addr)
+	outRes, err := c.client.Do(outReq)
+	if err != nil {
+		if !body.hasRead() && isDialError(err) {
+			transportHTTPDispatchDebug.Tracef("Failed to reach %s: %v", addr, err)
+			return fmt.Errorf("%w: %s", zephyr.ErrInstanceUnavailable, addr)
+		}
+		transportHTTPDispatchDebug.Tracef("Request to %s failed: %v", addr, err)
+		return err
+	}
+	defer outRes.Body.Close()
+
+	return c.copyResponse(serviceName, addr, res, outRes, body)
+}
+
+// copyResponse streams the response from a peer to res, returning a
+// *zephyr.RemoteError if the handler failed.
+func (c *HTTPTransport) copyResponse(serviceName string, addr string, res http.ResponseWriter, outRes *http.Response, body *dispatchBody) error {
+	if outRes.Header.Get(headerUnbound) != "" {
+		if body != nil && body.hasRead() {
+			return fmt.Errorf("httptransport: service %s is not bound at %s", serviceName, addr)
+		}
+		return fmt.Errorf("%w: %s", zephyr.ErrInstanceUnavailable, addr)
+	}
+	if remoteErr := handlerError(serviceName, outRes.Header); remoteErr != nil {
+		transportHTTPDispatchDebug.Tracef("Service handler failed before responding: %s", remoteErr.Message)
+		return remoteErr
+	}
+
+	copyHeader(res.Header(), outRes.Header)
+	res.WriteHeader(outRes.StatusCode)
+
+	transportHTTPDispatchDebug.Trace("Streaming response body")
+	if err := copyBody(res, outRes.Body); err != nil {
+		transportHTTPDispatchDebug.Tracef("Failed to stream response body: %v", err)
+		return err
+	}
+
+	if remoteErr := handlerError(serviceName, outRes.Trailer); remoteErr != nil {
+		transportHTTPDispatchDebug.Tracef("Service handler failed while responding: %s", remoteErr.Message)
+		return remoteErr
+	}
+	for key, values := range outRes.Trailer {
+		for _, value := range values {
+			res.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+	return nil
+}
+
+// copyBody copies a streamed body to res, flushing after every read so the
+// body reaches the client as it arrives.
+func copyBody(res http.ResponseWriter, body io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, writeErr := res.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			if flushErr := http.NewResponseController(res).Flush(); flushErr != nil && !errors.Is(flushErr, http.ErrNotSupported) {
+				return flushErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// setDispatchHeaders marks a proxied request with the service it is for, and
+// with the fields of the original request which proxying loses.
+func setDispatchHeaders(header http.Header, serviceName string, req *http.Request) {
+	header.Set(headerService, serviceName)
+	header.Set(headerHost, req.Host)
+	header.Set(headerProto, req.Proto)
+	if req.RemoteAddr != "" {
+		header.Set(headerRemoteAddr, req.RemoteAddr)
+	}
+}
+
+// handlerError returns the error reported by a peer's handler in the given
+// headers or trailers, if any.
+func handlerError(serviceName string, header http.Header) *zephyr.RemoteError {
+	message := header.Get(headerHandlerError)
+	if message == "" {
+		return nil
+	}
+	return &zephyr.RemoteError{
+		Service: serviceName,
+		Message: message,
+		Stack:   strings.Join(header.Values(headerHandlerStack), "\n"),
+	}
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// dispatchBody records whether any of a request body has been read, and so
+// may have been sent, and keeps the client from closing it, so the request
+// can be dispatched again if it was not.
+type dispatchBody struct {
+	mu     sync.Mutex
+	reader io.Reader
+	isRead bool
+}
+
+func (b *dispatchBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	b.isRead = true
+	b.mu.Unlock()
+	return b.reader.Read(p)
+}
+
+func (b *dispatchBody) hasRead() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.isRead
+}
+
+// serveDispatch hands a request proxied from a peer to the handler bound for
+// its service, reporting a failed handler in the response.
+func (c *HTTPTransport) serveDispatch(res http.ResponseWriter, req *http.Request) {
+	serviceName := req.Header.Get(headerService)
+	c.mu.RLock()
+	handler, ok := c.dispatchHandlers[serviceName]
+	c.mu.RUnlock()
+	if !ok {
+		transportHTTPDispatchDebug.Tracef("No handler bound for service %s", serviceName)
+		res.Header().Set(headerUnbound, "1")
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	transportHTTPDispatchDebug.Tracef("Handling request for service %s: %s %s", serviceName, req.Method, req.URL.Path)
+
+	// The server sets trailers on the original request once its body has
+	// been read, so the clone shares its trailer map.
+	trailer := req.Trailer
+	req = req.Clone(req.Context())
+	req.Trailer = trailer
+	if host := req.Header.Get(headerHost); host != "" {
+		req.Host = host
+	}
+	if remoteAddr := req.Header.Get(headerRemoteAddr); remoteAddr != "" {
+		req.RemoteAddr = remoteAddr
+	}
+	if proto := req.Header.Get(headerProto); proto != "" {
+		if major, minor, ok := http.ParseHTTPVersion(proto); ok {
+			req.Proto, req.ProtoMajor, req.ProtoMinor = proto, major, minor
+		}
+	}
+	for _, key := range []string{headerService, headerHost, headerRemoteAddr, headerProto} {
+		req.Header.Del(key)
+	}
+	req.RequestURI = req.URL.RequestURI()
+
+	serviceRes := &dispatchResponseWriter{ResponseWriter: res}
+	if remoteErr := callHandler(handler, serviceRes, req); remoteErr != nil {
+		transportHTTPDispatchDebug.Tracef("Handler for service %s failed: %v", serviceName, remoteErr)
+		serviceRes.writeError(remoteErr)
+	}
+}
+
+// callHandler calls the handler, recovering any panic as the error reported
+// to the peer.
+func callHandler(handler func(http.ResponseWriter, *http.Request), res http.ResponseWriter, req *http.Request) (remoteErr *zephyr.RemoteError) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			remoteErr = zephyr.NewRemoteError(recovered)
+		}
+	}()
+	handler(res, req)
+	return nil
+}
+
+// dispatchResponseWriter tracks the state of a response, so a failed handler
+// can be reported in headers or trailers, depending on whether the response
+// had been started.
+type dispatchResponseWriter struct {
+	http.ResponseWriter
+	hasWritten  bool
+	hasHijacked bool
+}
+
+var _ http.Flusher = &dispatchResponseWriter{}
+
+func (w *dispatchResponseWriter) WriteHeader(statusCode int) {
+	w.hasWritten = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *dispatchResponseWriter) Write(p []byte) (int, error) {
+	w.hasWritten = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *dispatchResponseWriter) Flush() {
+	w.hasWritten = true
+	if err := http.NewResponseController(w.ResponseWriter).Flush(); err != nil {
+		transportHTTPDispatchDebug.Tracef("Failed to flush response: %v", err)
+	}
+}
+
+func (w *dispatchResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *dispatchResponseWriter) writeError(remoteErr *zephyr.RemoteError) {
+	if w.hasHijacked {
+		return
+	}
+	header := w.Header()
+	prefix := ""
+	if w.hasWritten {
+		prefix = http.TrailerPrefix
+	}
+	header.Set(prefix+headerHandlerError, remoteErr.Message)
+	for _, line := range strings.Split(remoteErr.Stack, "\n") {
+		header.Add(prefix+headerHandlerStack, line)
+	}
+	if !w.hasWritten {
+		w.ResponseWriter.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// resolve returns the addresses of the peers which have the service bound. If
+// refresh is set, or no addresses are known, every peer in the registry is
+// asked which services it has bound.
+func (c *HTTPTransport) resolve(serviceName string, refresh bool) []string {
+	if !refresh {
+		c.mu.RLock()
+		addrs := slices.Clone(c.serviceAddrs[serviceName])
+		c.mu.RUnlock()
+		return addrs
+	}
+
+	peers, err := c.Registry.Peers()
+	if err != nil {
+		transportHTTPDispatchDebug.Tracef("Failed to list peers: %v", err)
+		return nil
+	}
+	transportHTTPDispatchDebug.Tracef("Asking %d peers which services they have bound", len(peers))
+
+	serviceAddrs := map[string][]string{}
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, addr := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serviceNames, err := c.queryServices(addr)
+			if err != nil {
+				transportHTTPDispatchDebug.Tracef("Failed to ask %s for its services: %v", addr, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, serviceName := range serviceNames {
+				serviceAddrs[serviceName] = append(serviceAddrs[serviceName], addr)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serviceAddrs = serviceAddrs
+	return slices.Clone(serviceAddrs[serviceName])
+}
+
+func (c *HTTPTransport) queryServices(addr string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.AnnounceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(addr, pathServices), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("httptransport: unexpected status %s", res.Status)
+	}
+	var serviceNames []string
+	if err := msgpack.NewDecoder(res.Body).Decode(&serviceNames); err != nil {
+		return nil, err
+	}
+	return serviceNames, nil
+}
+
+// pickAddr spreads requests across the given addresses in turn.
+func (c *HTTPTransport) pickAddr(addrs []string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextAddr++
+	return addrs[c.nextAddr%len(addrs)]
+}
+
+func (c *HTTPTransport) addServiceAddr(serviceName string, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !slices.Contains(c.serviceAddrs[serviceName], addr) {
+		c.serviceAddrs[serviceName] = append(c.serviceAddrs[serviceName], addr)
+	}
+}
+
+func (c *HTTPTransport) removeServiceAddr(serviceName string, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serviceAddrs[serviceName] = slices.DeleteFunc(c.serviceAddrs[serviceName], func(existingAddr string) bool {
+		return existingAddr == addr
+	})
+}
@@ -0,0 +1,269 @@
+package httptransport
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/telemetrytv/trace"
+	"github.com/telemetrytv/zephyr"
+)
+
+var (
+	transportHTTPDebug         = trace.Bind("zephyr:transport:http")
+	transportHTTPAnnounceDebug = trace.Bind("zephyr:transport:http:announce")
+	transportHTTPDispatchDebug = trace.Bind("zephyr:transport:http:dispatch")
+)
+
+// DefaultListenAddr is the address transports listen on if no ListenAddr is
+// given in their Options. It picks a free port on the loopback interface.
+const DefaultListenAddr = "127.0.0.1:0"
+
+// DispatchTimeout is the default time to wait for a service to respond with
+// its status and headers.
+const DispatchTimeout = 30 * time.Second
+
+// AnnounceTimeout is the default time to wait for a peer to accept an
+// announcement, or to list the services bound to it.
+const AnnounceTimeout = 5 * time.Second
+
+// ErrClosed is returned by a transport once it has been closed.
+var ErrClosed = errors.New("httptransport: transport is closed")
+
+// Options configures an HTTPTransport. Any field left as its zero value falls
+// back to its default.
+type Options struct {
+
+	// Network is the network the transport listens on and dials peers with,
+	// either "tcp" or "unix". Addresses on the unix network are socket paths.
+	// If empty, "tcp" is used.
+	Network string
+
+	// ListenAddr is the address the transport listens on for announcements
+	// and dispatched requests. If empty, DefaultListenAddr is used.
+	ListenAddr string
+
+	// AdvertiseAddr is the address the transport registers with its registry,
+	// which peers use to reach it. It must be set if the listen address is not
+	// reachable by peers as is, for example when listening on all interfaces.
+	// If empty, the address the transport is listening on is used.
+	AdvertiseAddr string
+
+	// DispatchTimeout is how long to wait for a service to respond with its
+	// status and headers. If zero, the DispatchTimeout constant is used.
+	DispatchTimeout time.Duration
+
+	// AnnounceTimeout is how long to wait for a peer to accept an
+	// announcement, or to list the services bound to it. If zero, the
+	// AnnounceTimeout constant is used.
+	AnnounceTimeout time.Duration
+}
+
+// HTTPTransport is a transport which needs no message broker. Every transport
+// serves HTTP/2 without TLS (h2c) on its own port. Announcements are posted to
+// every peer listed by the transport's Registry, and requests are proxied
+// straight to a peer which has the service bound, with their bodies streamed
+// in both directions.
+type HTTPTransport struct {
+	Options
+	Registry Registry
+
+	listener net.Listener
+	server   *http.Server
+	client   *http.Client
+
+	mu                       sync.RWMutex
+	isClosed                 bool
+	gatewayAnnounceHandlers  []func(gatewayDescriptor *zephyr.GatewayDescriptor)
+	serviceAnnounceHandlers  []func(serviceDescriptor *zephyr.ServiceDescriptor)
+	dispatchHandlers         map[string]func(res http.ResponseWriter, req *http.Request)
+	serviceAddrs             map[string][]string
+	nextAddr                 int
+	unwatch                  func()
+	lastGatewayAnnouncement  []byte
+	lastServiceAnnouncements map[string][]byte
+}
+
+var _ zephyr.Transport = &HTTPTransport{}
+var _ zephyr.InstanceDispatcher = &HTTPTransport{}
+var _ zephyr.ReadinessReporter = &HTTPTransport{}
+
+// New creates an HTTPTransport which finds its peers through the given
+// registry. It starts listening straight away, and registers its address with
+// the registry. Options may be given to configure the transport, otherwise
+// the defaults are used. The transport must be closed with Close once it is no
+// longer needed.
+func New(registry Registry, options ...Options) (*HTTPTransport, error) {
+	transport := &HTTPTransport{
+		Registry:                 registry,
+		dispatchHandlers:         map[string]func(res http.ResponseWriter, req *http.Request){},
+		serviceAddrs:             map[string][]string{},
+		lastServiceAnnouncements: map[string][]byte{},
+	}
+	if len(options) > 0 {
+		transport.Options = options[0]
+	}
+	if transport.Network == "" {
+		transport.Network = "tcp"
+	}
+	if transport.ListenAddr == "" {
+		transport.ListenAddr = DefaultListenAddr
+	}
+	if transport.DispatchTimeout == 0 {
+		transport.DispatchTimeout = DispatchTimeout
+	}
+	if transport.AnnounceTimeout == 0 {
+		transport.AnnounceTimeout = AnnounceTimeout
+	}
+
+	transportHTTPDebug.Tracef("Listening on %s %s", transport.Network, transport.ListenAddr)
+	listener, err := net.Listen(transport.Network, transport.ListenAddr)
+	if err != nil {
+		transportHTTPDebug.Tracef("Failed to listen on %s: %v", transport.ListenAddr, err)
+		return nil, err
+	}
+	transport.listener = listener
+	if transport.AdvertiseAddr == "" {
+		transport.AdvertiseAddr = listener.Addr().String()
+	}
+
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	transport.server = &http.Server{
+		Handler:   http.HandlerFunc(transport.serveHTTP),
+		Protocols: protocols,
+	}
+	go func() {
+		if err := transport.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			transportHTTPDebug.Tracef("Server stopped: %v", err)
+		}
+	}()
+
+	clientProtocols := &http.Protocols{}
+	clientProtocols.SetUnencryptedHTTP2(true)
+	transport.client = &http.Client{
+		Transport: &http.Transport{
+			Protocols:             clientProtocols,
+			ResponseHeaderTimeout: transport.DispatchTimeout,
+			DialContext:           transport.dialContext,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	transportHTTPDebug.Tracef("Registering address %s", transport.AdvertiseAddr)
+	if err := registry.Register(transport.AdvertiseAddr); err != nil {
+		transportHTTPDebug.Tracef("Failed to register address %s: %v", transport.AdvertiseAddr, err)
+		transport.server.Close()
+		return nil, err
+	}
+	if watcher, ok := registry.(Watcher); ok {
+		transport.unwatch = watcher.Watch(transport.handlePeerAdded)
+	}
+
+	return transport, nil
+}
+
+// Addr returns the address the transport is advertised at.
+func (c *HTTPTransport) Addr() string {
+	return c.AdvertiseAddr
+}
+
+// Ready returns ErrClosed once the transport has been closed.
+func (c *HTTPTransport) Ready() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.isClosed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close deregisters the transport's address from its registry and stops
+// listening. Requests already being handled are given until ctx is done to
+// complete.
+func (c *HTTPTransport) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.isClosed = true
+	c.mu.Unlock()
+
+	transportHTTPDebug.Tracef("Closing transport at %s", c.AdvertiseAddr)
+	if c.unwatch != nil {
+		c.unwatch()
+	}
+	err := c.Registry.Deregister(c.AdvertiseAddr)
+	if err != nil {
+		transportHTTPDebug.Tracef("Failed to deregister address %s: %v", c.AdvertiseAddr, err)
+	}
+	if shutdownErr := c.server.Shutdown(ctx); shutdownErr != nil {
+		transportHTTPDebug.Tracef("Failed to shut down server: %v", shutdownErr)
+		c.server.Close()
+		if err == nil {
+			err = shutdownErr
+		}
+	}
+	c.client.CloseIdleConnections()
+	return err
+}
+
+// serveHTTP routes requests from peers. Dispatched requests are marked with
+// the service header, everything else is an announcement or a query.
+func (c *HTTPTransport) serveHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Header.Get(headerService) != "" {
+		c.serveDispatch(res, req)
+		return
+	}
+	switch req.URL.Path {
+	case pathAnnounceGateway:
+		c.serveGatewayAnnounce(res, req)
+	case pathAnnounceService:
+		c.serveServiceAnnounce(res, req)
+	case pathServices:
+		c.serveServices(res, req)
+	default:
+		http.NotFound(res, req)
+	}
+}
+
+// url returns the URL of a path on the peer at addr.
+func (c *HTTPTransport) url(addr string, path string) string {
+	return "http://" + c.host(addr) + path
+}
+
+// host returns the host used in URLs for the peer at addr. Socket paths are
+// not valid hosts, so on the unix network they are hex encoded, and decoded
+// again by dialContext.
+func (c *HTTPTransport) host(addr string) string {
+	if c.Network != "unix" {
+		return addr
+	}
+	return hex.EncodeToString([]byte(addr)) + ".unix"
+}
+
+func (c *HTTPTransport) dialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if c.Network == "unix" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		path, err := hex.DecodeString(strings.TrimSuffix(host, ".unix"))
+		if err != nil {
+			return nil, err
+		}
+		network, addr = "unix", string(path)
+	}
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, network, addr)
+}
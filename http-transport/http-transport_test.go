@@ -0,0 +1,353 @@
+package httptransport_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+	httptransport "github.com/telemetrytv/zephyr/http-transport"
+	"github.com/telemetrytv/zephyr/transporttest"
+)
+
+func newTransport(t *testing.T, registry httptransport.Registry) *httptransport.HTTPTransport {
+	t.Helper()
+	transport, err := httptransport.New(registry, httptransport.Options{
+		DispatchTimeout: 2 * time.Second,
+		AnnounceTimeout: time.Second,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		transport.Close(context.Background())
+	})
+	return transport
+}
+
+func startService(t *testing.T, transport zephyr.Transport, router *navaros.Router) *zephyr.Service {
+	t.Helper()
+	s := zephyr.NewService("testService", transport, router)
+	require.NoError(t, s.Start())
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func startGateway(t *testing.T, transport zephyr.Transport) *zephyr.Gateway {
+	t.Helper()
+	g := zephyr.NewGateway("testGateway", transport)
+	require.NoError(t, g.Start())
+	t.Cleanup(g.Stop)
+	return g
+}
+
+func TestHTTPTransport(t *testing.T) {
+	t.Run("Routes requests from a gateway to a service on another transport", func(t *testing.T) {
+		registry := httptransport.NewStaticRegistry()
+		router := navaros.NewRouter()
+		router.PublicPost("/echo/:name", func(ctx *navaros.Context) {
+			body, err := io.ReadAll(ctx.RequestBodyReader())
+			assert.NoError(t, err)
+			ctx.Headers.Set("Test-Header", "test-value")
+			ctx.Status = http.StatusCreated
+			ctx.Body = ctx.Params().Get("name") + ": " + string(body)
+		})
+		startService(t, newTransport(t, registry), router)
+		g := startGateway(t, newTransport(t, registry))
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://example.com/echo/test?query=1", strings.NewReader("test body"))
+		g.ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusCreated, res.Code)
+		assert.Equal(t, "test-value", res.Header().Get("Test-Header"))
+		assert.Equal(t, "test: test body", res.Body.String())
+	})
+
+	t.Run("Passes the original host and remote address to the service", func(t *testing.T) {
+		registry := httptransport.NewStaticRegistry()
+		var recvRequest *http.Request
+		router := navaros.NewRouter()
+		router.PublicGet("/", func(ctx *navaros.Context) {
+			recvRequest = ctx.Request()
+			ctx.Status = http.StatusNoContent
+		})
+		startService(t, newTransport(t, registry), router)
+		client := zephyr.NewClient(newTransport(t, registry))
+
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		res := httptest.NewRecorder()
+		client.Service("testService").ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusNoContent, res.Code)
+		require.NotNil(t, recvRequest)
+		assert.Equal(t, "example.com", recvRequest.Host)
+		assert.Equal(t, req.RemoteAddr, recvRequest.RemoteAddr)
+		assert.Equal(t, "HTTP/1.1", recvRequest.Proto)
+		assert.Empty(t, recvRequest.Header.Get("Zephyr-Service"))
+	})
+
+	t.Run("Streams request and response bodies", func(t *testing.T) {
+		registry := httptransport.NewStaticRegistry()
+		router := navaros.NewRouter()
+		router.PublicPost("/stream", func(ctx *navaros.Context) {
+			reader := bufio.NewReader(ctx.RequestBodyReader())
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				ctx.Write([]byte("echo: " + line))
+				ctx.Flush()
+			}
+		})
+		startService(t, newTransport(t, registry), router)
+		client := zephyr.NewClient(newTransport(t, registry))
+
+		bodyReader, bodyWriter := io.Pipe()
+		// HTTP/1 servers only let handlers respond while the request body is
+		// still being sent once full duplex is enabled.
+		server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			http.NewResponseController(res).EnableFullDuplex()
+			client.Service("testService").ServeHTTP(res, req)
+		}))
+		defer server.Close()
+		req, err := http.NewRequest("POST", server.URL+"/stream", bodyReader)
+		require.NoError(t, err)
+
+		resChan := make(chan *http.Response, 1)
+		go func() {
+			res, err := server.Client().Do(req)
+			assert.NoError(t, err)
+			resChan <- res
+		}()
+
+		_, err = bodyWriter.Write([]byte("one\n"))
+		require.NoError(t, err)
+		res := <-resChan
+		require.NotNil(t, res)
+		defer res.Body.Close()
+		reader := bufio.NewReader(res.Body)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "echo: one\n", line)
+
+		_, err = bodyWriter.Write([]byte("two\n"))
+		require.NoError(t, err)
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "echo: two\n", line)
+		bodyWriter.Close()
+	})
+
+	t.Run("Returns a remote error when the handler fails", func(t *testing.T) {
+		registry := httptransport.NewStaticRegistry()
+		router := navaros.NewRouter()
+		router.PublicGet("/fail", func(ctx *navaros.Context) {
+			panic("something went wrong")
+		})
+		startService(t, newTransport(t, registry), router)
+		client := zephyr.NewClient(newTransport(t, registry))
+
+		_, err := client.Service("testService").Get("/fail")
+		var remoteErr *zephyr.RemoteError
+		require.ErrorAs(t, err, &remoteErr)
+		assert.Equal(t, "testService", remoteErr.Service)
+		assert.Contains(t, remoteErr.Message, "something went wrong")
+		assert.NotEmpty(t, remoteErr.Stack)
+	})
+
+	t.Run("Returns a remote error when the handler fails after responding", func(t *testing.T) {
+		registry := httptransport.NewStaticRegistry()
+		router := navaros.NewRouter()
+		router.PublicGet("/fail", func(ctx *navaros.Context) {
+			ctx.Write([]byte("partial"))
+			ctx.Flush()
+			panic("something went wrong")
+		})
+		startService(t, newTransport(t, registry), router)
+		transport := newTransport(t, registry)
+
+		res := httptest.NewRecorder()
+		err := transport.Dispatch("testService", res, httptest.NewRequest("GET", "/fail", nil))
+		var remoteErr *zephyr.RemoteError
+		require.ErrorAs(t, err, &remoteErr)
+		assert.Contains(t, remoteErr.Message, "something went wrong")
+		assert.Equal(t, "partial", res.Body.String())
+	})
+
+	t.Run("Tunnels upgraded connections to the service", func(t *testing.T) {
+		registry := httptransport.NewStaticRegistry()
+		router := navaros.NewRouter()
+		router.PublicGet("/echo", func(ctx *navaros.Context) {
+			conn, brw, err := zephyr.Hijack(ctx)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			_, err = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+			assert.NoError(t, err)
+			assert.NoError(t, brw.Flush())
+
+			line, err := brw.ReadString('\n')
+			assert.NoError(t, err)
+			_, err = brw.WriteString("echo: " + line)
+			assert.NoError(t, err)
+			assert.NoError(t, brw.Flush())
+		})
+		startService(t, newTransport(t, registry), router)
+		g := startGateway(t, newTransport(t, registry))
+
+		server := httptest.NewServer(g)
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: test\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+		require.NoError(t, err)
+
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+		_, err = conn.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "echo: hello\n", line)
+	})
+
+	t.Run("Dispatches to the remaining instances once one closes", func(t *testing.T) {
+		registry := httptransport.NewStaticRegistry()
+		router := navaros.NewRouter()
+		router.PublicGet("/", func(ctx *navaros.Context) {
+			ctx.Status = http.StatusNoContent
+		})
+		serviceTransportA := newTransport(t, registry)
+		serviceTransportB := newTransport(t, registry)
+		startService(t, serviceTransportA, router)
+		startService(t, serviceTransportB, router)
+		client := zephyr.NewClient(newTransport(t, registry))
+
+		for i := 0; i < 4; i++ {
+			res, err := client.Service("testService").Get("/")
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusNoContent, res.StatusCode)
+		}
+
+		require.NoError(t, serviceTransportA.Close(context.Background()))
+		for i := 0; i < 4; i++ {
+			res, err := client.Service("testService").Get("/")
+			require.NoError(t, err)
+			assert.Equal(t, serviceTransportB.Addr(), res.Header.Get(zephyr.InstanceIDHeader))
+		}
+	})
+
+	t.Run("Returns ErrInstanceUnavailable with the body intact for unbound instances", func(t *testing.T) {
+		registry := httptransport.NewStaticRegistry()
+		router := navaros.NewRouter()
+		router.PublicPost("/", func(ctx *navaros.Context) {
+			body, _ := io.ReadAll(ctx.RequestBodyReader())
+			ctx.Body = body
+		})
+		startService(t, newTransport(t, registry), router)
+		closedTransport := newTransport(t, registry)
+		require.NoError(t, closedTransport.Close(context.Background()))
+		transport := newTransport(t, registry)
+
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString("test body"))
+		err := transport.DispatchInstance("testService", closedTransport.Addr(), httptest.NewRecorder(), req)
+		require.ErrorIs(t, err, zephyr.ErrInstanceUnavailable)
+
+		res := httptest.NewRecorder()
+		require.NoError(t, transport.Dispatch("testService", res, req))
+		assert.Equal(t, "test body", res.Body.String())
+	})
+
+	t.Run("Returns an error when no peer has the service bound", func(t *testing.T) {
+		transport := newTransport(t, httptransport.NewStaticRegistry())
+		err := transport.Dispatch("missingService", httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		assert.Error(t, err)
+	})
+}
+
+func TestMulticastRegistry(t *testing.T) {
+	newRegistry := func(t *testing.T) *httptransport.MulticastRegistry {
+		registry, err := httptransport.NewMulticastRegistry("239.255.90.91:27946")
+		if err != nil {
+			t.Skipf("UDP multicast is not available: %v", err)
+		}
+		t.Cleanup(func() { registry.Close() })
+		return registry
+	}
+
+	t.Run("Finds peers registered through other registries", func(t *testing.T) {
+		registryA := newRegistry(t)
+		registryB := newRegistry(t)
+		require.NoError(t, registryA.Register("127.0.0.1:1001"))
+		require.NoError(t, registryB.Register("127.0.0.1:1002"))
+
+		hasPeers := func(registry *httptransport.MulticastRegistry) bool {
+			peers, err := registry.Peers()
+			return err == nil && len(peers) == 2
+		}
+		deadline := time.Now().Add(time.Second)
+		for !hasPeers(registryA) || !hasPeers(registryB) {
+			if time.Now().After(deadline) {
+				t.Skip("UDP multicast packets are not delivered on this host")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		require.NoError(t, registryB.Deregister("127.0.0.1:1002"))
+		assert.Eventually(t, func() bool {
+			peers, err := registryA.Peers()
+			return err == nil && len(peers) == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Carries announcements between transports", func(t *testing.T) {
+		router := navaros.NewRouter()
+		router.PublicGet("/", func(ctx *navaros.Context) {
+			ctx.Status = http.StatusNoContent
+		})
+		serviceTransport := newTransport(t, newRegistry(t))
+		gatewayRegistry := newRegistry(t)
+		gatewayTransport := newTransport(t, gatewayRegistry)
+
+		require.Eventually(t, func() bool {
+			peers, err := gatewayRegistry.Peers()
+			return err == nil && len(peers) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		startService(t, serviceTransport, router)
+		g := startGateway(t, gatewayTransport)
+
+		res := httptest.NewRecorder()
+		g.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusNoContent, res.Code)
+	})
+}
+
+func TestHTTPTransport_Conformance(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T, n int) []zephyr.Transport {
+		registry := httptransport.NewStaticRegistry()
+		transports := make([]zephyr.Transport, n)
+		for i := range transports {
+			transports[i] = newTransport(t, registry)
+		}
+		return transports
+	})
+}
@@ -0,0 +1,234 @@
+package httptransport
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/telemetrytv/trace"
+)
+
+var (
+	transportHTTPMulticastDebug = trace.Bind("zephyr:transport:http:multicast")
+)
+
+// DefaultMulticastGroup is the UDP multicast group used by a
+// MulticastRegistry if no group is given.
+const DefaultMulticastGroup = "239.255.90.90:7946"
+
+// MulticastInterval is how often a MulticastRegistry announces the addresses
+// registered through it. Peers which have not been heard from for three
+// intervals are dropped.
+var MulticastInterval = 2 * time.Second
+
+const (
+	multicastMessagePrefix = "zephyr-http "
+	multicastJoin          = "join"
+	multicastLeave         = "leave"
+	multicastQuery         = "query"
+)
+
+// MulticastRegistry finds peers on the local host or network by UDP
+// multicast. Each registry periodically sends the addresses registered through
+// it to the multicast group, and collects the addresses sent by others. A
+// registry asks its peers to announce themselves when it is created, so they
+// are found within moments rather than after a full interval.
+type MulticastRegistry struct {
+	group    *net.UDPAddr
+	listener *net.UDPConn
+	sender   *net.UDPConn
+	done     chan struct{}
+
+	mu            sync.Mutex
+	localAddrs    []string
+	peers         map[string]time.Time
+	watchHandlers map[int]func(addr string)
+	nextWatchID   int
+}
+
+var _ Registry = &MulticastRegistry{}
+var _ Watcher = &MulticastRegistry{}
+
+// NewMulticastRegistry creates a MulticastRegistry on the given multicast
+// group address. If group is empty, DefaultMulticastGroup is used. The
+// registry must be closed with Close once it is no longer needed.
+func NewMulticastRegistry(group string) (*MulticastRegistry, error) {
+	if group == "" {
+		group = DefaultMulticastGroup
+	}
+	groupAddr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+
+	transportHTTPMulticastDebug.Tracef("Joining multicast group %s", groupAddr)
+	listener, err := net.ListenMulticastUDP("udp4", nil, groupAddr)
+	if err != nil {
+		transportHTTPMulticastDebug.Tracef("Failed to join multicast group %s: %v", groupAddr, err)
+		return nil, err
+	}
+	sender, err := net.DialUDP("udp4", nil, groupAddr)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	r := &MulticastRegistry{
+		group:         groupAddr,
+		listener:      listener,
+		sender:        sender,
+		done:          make(chan struct{}),
+		peers:         map[string]time.Time{},
+		watchHandlers: map[int]func(addr string){},
+	}
+	go r.receive()
+	go r.announce()
+	r.send(multicastQuery, "")
+	return r, nil
+}
+
+func (r *MulticastRegistry) Register(addr string) error {
+	r.mu.Lock()
+	if !slices.Contains(r.localAddrs, addr) {
+		r.localAddrs = append(r.localAddrs, addr)
+	}
+	r.mu.Unlock()
+	return r.send(multicastJoin, addr)
+}
+
+func (r *MulticastRegistry) Deregister(addr string) error {
+	r.mu.Lock()
+	r.localAddrs = slices.DeleteFunc(r.localAddrs, func(localAddr string) bool {
+		return localAddr == addr
+	})
+	r.mu.Unlock()
+	return r.send(multicastLeave, addr)
+}
+
+func (r *MulticastRegistry) Peers() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs := slices.Clone(r.localAddrs)
+	expiry := time.Now().Add(-3 * MulticastInterval)
+	for addr, lastSeenAt := range r.peers {
+		if lastSeenAt.Before(expiry) {
+			delete(r.peers, addr)
+			continue
+		}
+		if !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// Watch calls handler whenever a peer is found, or is heard from again after
+// expiring.
+func (r *MulticastRegistry) Watch(handler func(addr string)) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	watchID := r.nextWatchID
+	r.nextWatchID++
+	r.watchHandlers[watchID] = handler
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.watchHandlers, watchID)
+	}
+}
+
+// Close stops announcing and listening for peers. Addresses still registered
+// are not removed from peers until they expire.
+func (r *MulticastRegistry) Close() error {
+	select {
+	case <-r.done:
+		return nil
+	default:
+	}
+	close(r.done)
+	return errors.Join(r.listener.Close(), r.sender.Close())
+}
+
+func (r *MulticastRegistry) send(kind string, addr string) error {
+	message := multicastMessagePrefix + kind
+	if addr != "" {
+		message += " " + addr
+	}
+	if _, err := r.sender.Write([]byte(message)); err != nil {
+		transportHTTPMulticastDebug.Tracef("Failed to send %s to multicast group %s: %v", kind, r.group, err)
+		return err
+	}
+	return nil
+}
+
+// sendLocalAddrs announces every address registered through the registry.
+func (r *MulticastRegistry) sendLocalAddrs() {
+	r.mu.Lock()
+	localAddrs := slices.Clone(r.localAddrs)
+	r.mu.Unlock()
+	for _, addr := range localAddrs {
+		r.send(multicastJoin, addr)
+	}
+}
+
+func (r *MulticastRegistry) announce() {
+	ticker := time.NewTicker(MulticastInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.sendLocalAddrs()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *MulticastRegistry) receive() {
+	buf := make([]byte, 512)
+	for {
+		n, _, err := r.listener.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.done:
+			default:
+				transportHTTPMulticastDebug.Tracef("Stopped receiving from multicast group %s: %v", r.group, err)
+			}
+			return
+		}
+
+		message, ok := strings.CutPrefix(string(buf[:n]), multicastMessagePrefix)
+		if !ok {
+			continue
+		}
+		kind, addr, _ := strings.Cut(message, " ")
+		switch kind {
+		case multicastJoin:
+			r.mu.Lock()
+			lastSeenAt, ok := r.peers[addr]
+			isNew := !ok || lastSeenAt.Before(time.Now().Add(-3*MulticastInterval))
+			r.peers[addr] = time.Now()
+			var watchHandlers []func(addr string)
+			if isNew {
+				transportHTTPMulticastDebug.Tracef("Found peer %s", addr)
+				for _, handler := range r.watchHandlers {
+					watchHandlers = append(watchHandlers, handler)
+				}
+			}
+			r.mu.Unlock()
+			for _, handler := range watchHandlers {
+				go handler(addr)
+			}
+		case multicastLeave:
+			transportHTTPMulticastDebug.Tracef("Peer %s left", addr)
+			r.mu.Lock()
+			delete(r.peers, addr)
+			r.mu.Unlock()
+		case multicastQuery:
+			r.sendLocalAddrs()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package httptransport
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Paths served by every transport for its peers.
+const (
+	pathAnnounceGateway = "/_zephyr/announce/gateway"
+	pathAnnounceService = "/_zephyr/announce/service"
+	pathServices        = "/_zephyr/services"
+)
+
+// Headers added to requests and responses passed between transports. They
+// are removed before requests reach handlers.
+const (
+	// headerService names the service a request is dispatched to.
+	headerService = "Zephyr-Service"
+
+	// headerAddr carries the address of the transport sending an
+	// announcement.
+	headerAddr = "Zephyr-Addr"
+
+	// headerHost, headerRemoteAddr and headerProto carry the fields of the
+	// original request which are lost when it is proxied.
+	headerHost       = "Zephyr-Host"
+	headerRemoteAddr = "Zephyr-Remote-Addr"
+	headerProto      = "Zephyr-Proto"
+
+	// headerUnbound is set on the response if the service is not bound on
+	// the transport the request was dispatched to.
+	headerUnbound = "Zephyr-Unbound"
+
+	// headerHandlerError and headerHandlerStack report a failed handler.
+	// They are sent as headers if the handler failed before responding, and
+	// as trailers otherwise. The stack is sent with one value per line.
+	headerHandlerError = "Zephyr-Handler-Error"
+	headerHandlerStack = "Zephyr-Handler-Stack"
+)
+
+// hopHeaders are headers which only apply to a single connection, and so are
+// not proxied. HTTP/2 also forbids most of them.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyHeader copies the headers in src to dst, other than hop-by-hop headers
+// and those named by the Connection header.
+func copyHeader(dst http.Header, src http.Header) {
+	connectionHeaders := map[string]bool{}
+	for _, value := range src.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			connectionHeaders[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	for key, values := range src {
+		if connectionHeaders[key] || isHopHeader(key) {
+			continue
+		}
+		dst[key] = append(dst[key], values...)
+	}
+}
+
+func isHopHeader(key string) bool {
+	for _, hopHeader := range hopHeaders {
+		if key == hopHeader {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package httptransport
+
+import (
+	"slices"
+	"sync"
+)
+
+// Registry keeps track of the addresses transports can be reached at.
+// Transports register their own address when they are created, and send
+// announcements to every address the registry lists.
+type Registry interface {
+
+	// Register adds the address of a transport to the registry.
+	Register(addr string) error
+
+	// Deregister removes the address of a transport from the registry.
+	Deregister(addr string) error
+
+	// Peers returns the addresses of all transports in the registry,
+	// including those registered through it.
+	Peers() ([]string, error)
+}
+
+// Watcher is an optional interface implemented by registries which find peers
+// as they appear. Transports using such a registry send the announcements they
+// have made to each new peer, rather than waiting for the next announcement.
+type Watcher interface {
+
+	// Watch calls handler with the address of every peer which appears in the
+	// registry. The returned function stops the handler being called.
+	Watch(handler func(addr string)) (unwatch func())
+}
+
+// StaticRegistry is a registry with a fixed list of peers, for deployments
+// where the address of every gateway, service and client is known up front.
+// Addresses registered through it are added to the list, so a single
+// StaticRegistry can also be shared by transports within one process.
+type StaticRegistry struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+var _ Registry = &StaticRegistry{}
+
+// NewStaticRegistry creates a StaticRegistry listing the given addresses.
+func NewStaticRegistry(addrs ...string) *StaticRegistry {
+	return &StaticRegistry{addrs: slices.Clone(addrs)}
+}
+
+func (r *StaticRegistry) Register(addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !slices.Contains(r.addrs, addr) {
+		r.addrs = append(r.addrs, addr)
+	}
+	return nil
+}
+
+func (r *StaticRegistry) Deregister(addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs = slices.DeleteFunc(r.addrs, func(existingAddr string) bool {
+		return existingAddr == addr
+	})
+	return nil
+}
+
+func (r *StaticRegistry) Peers() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.addrs), nil
+}
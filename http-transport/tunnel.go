@@ -0,0 +1,101 @@
+package httptransport
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/telemetrytv/zephyr"
+)
+
+// dispatchUpgrade sends an upgrade request to the peer at addr over its own
+// HTTP/1.1 connection, as HTTP/2 connections cannot be hijacked. If the
+// handler switches protocols, the 101 response is passed on to the client and
+// bytes are tunnelled between the client's connection and the peer's until
+// either side closes. Any other response is passed on as usual.
+func (c *HTTPTransport) dispatchUpgrade(serviceName string, addr string, res http.ResponseWriter, req *http.Request) error {
+	transportHTTPDispatchDebug.Tracef("Dialing %s for upgrade request", addr)
+	conn, err := net.DialTimeout(c.Network, addr, c.DispatchTimeout)
+	if err != nil {
+		transportHTTPDispatchDebug.Tracef("Failed to reach %s: %v", addr, err)
+		return fmt.Errorf("%w: %s", zephyr.ErrInstanceUnavailable, addr)
+	}
+
+	outReq := req.Clone(req.Context())
+	outReq.URL = &url.URL{Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+	outReq.Host = c.host(addr)
+	outReq.RequestURI = ""
+	setDispatchHeaders(outReq.Header, serviceName, req)
+
+	conn.SetDeadline(time.Now().Add(c.DispatchTimeout))
+	if err := outReq.Write(conn); err != nil {
+		conn.Close()
+		transportHTTPDispatchDebug.Tracef("Failed to send upgrade request to %s: %v", addr, err)
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	outRes, err := http.ReadResponse(reader, outReq)
+	if err != nil {
+		conn.Close()
+		transportHTTPDispatchDebug.Tracef("Failed to read upgrade response from %s: %v", addr, err)
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if outRes.StatusCode != http.StatusSwitchingProtocols {
+		transportHTTPDispatchDebug.Tracef("Service did not switch protocols, responding with %d", outRes.StatusCode)
+		defer conn.Close()
+		defer outRes.Body.Close()
+		return c.copyResponse(serviceName, addr, res, outRes, nil)
+	}
+
+	transportHTTPDispatchDebug.Trace("Service switched protocols, opening tunnel")
+	clientConn, err := zephyr.HijackConn(res)
+	if err != nil {
+		transportHTTPDispatchDebug.Tracef("Failed to hijack client connection: %v", err)
+		conn.Close()
+		return err
+	}
+	if _, err := fmt.Fprintf(clientConn, "HTTP/1.1 %s\r\n", outRes.Status); err != nil {
+		clientConn.Close()
+		conn.Close()
+		return err
+	}
+	if err := outRes.Header.Write(clientConn); err != nil {
+		clientConn.Close()
+		conn.Close()
+		return err
+	}
+	if _, err := clientConn.Write([]byte("\r\n")); err != nil {
+		clientConn.Close()
+		conn.Close()
+		return err
+	}
+	return zephyr.Tunnel(clientConn, &bufferedConn{Reader: reader, Conn: conn})
+}
+
+// Hijack hands the handler the connection the upgrade request arrived on.
+func (w *dispatchResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hasHijacked = true
+	return conn, brw, nil
+}
+
+var _ http.Hijacker = &dispatchResponseWriter{}
+
+// bufferedConn reads any bytes already buffered from a connection before
+// reading from the connection itself.
+type bufferedConn struct {
+	*bufio.Reader
+	net.Conn
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
@@ -1,15 +1,21 @@
 package localtransport
 
-import "github.com/telemetrytv/zephyr"
+import (
+	"slices"
+
+	"github.com/telemetrytv/zephyr"
+)
 
 func (c *LocalTransport) AnnounceGateway(gatewayDescriptor *zephyr.GatewayDescriptor) error {
 	transportLocalAnnounceDebug.Tracef("Announcing gateway %s with %d services",
 		gatewayDescriptor.Name, len(gatewayDescriptor.ServiceDescriptors))
 	
-	handlerCount := len(c.gatewayAnnounceHandlers)
-	transportLocalAnnounceDebug.Tracef("Notifying %d gateway announcement handlers", handlerCount)
+	c.mu.RLock()
+	handlers := slices.Clone(c.gatewayAnnounceHandlers)
+	c.mu.RUnlock()
+	transportLocalAnnounceDebug.Tracef("Notifying %d gateway announcement handlers", len(handlers))
 	
-	for _, handler := range c.gatewayAnnounceHandlers {
+	for _, handler := range handlers {
 		handler(gatewayDescriptor)
 	}
 	
@@ -19,12 +25,16 @@ func (c *LocalTransport) AnnounceGateway(gatewayDescriptor *zephyr.GatewayDescri
 
 func (c *LocalTransport) BindGatewayAnnounce(handler func(gatewayDescriptor *zephyr.GatewayDescriptor)) error {
 	transportLocalAnnounceDebug.Trace("Binding gateway announcement handler")
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.gatewayAnnounceHandlers = append(c.gatewayAnnounceHandlers, handler)
 	transportLocalAnnounceDebug.Tracef("Now have %d gateway announcement handlers", len(c.gatewayAnnounceHandlers))
 	return nil
 }
 
 func (c *LocalTransport) UnbindGatewayAnnounce() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	transportLocalAnnounceDebug.Tracef("Unbinding %d gateway announcement handlers", len(c.gatewayAnnounceHandlers))
 	c.gatewayAnnounceHandlers = nil
 	transportLocalAnnounceDebug.Trace("All gateway announcement handlers unbound")
@@ -1,15 +1,21 @@
 package localtransport
 
-import "github.com/telemetrytv/zephyr"
+import (
+	"slices"
+
+	"github.com/telemetrytv/zephyr"
+)
 
 func (c *LocalTransport) AnnounceService(serviceDescriptor *zephyr.ServiceDescriptor) error {
 	transportLocalAnnounceDebug.Tracef("Announcing service %s with %d routes", 
 		serviceDescriptor.Name, len(serviceDescriptor.RouteDescriptors))
 	
-	handlerCount := len(c.serviceAnnounceHandlers)
-	transportLocalAnnounceDebug.Tracef("Notifying %d service announcement handlers", handlerCount)
+	c.mu.RLock()
+	handlers := slices.Clone(c.serviceAnnounceHandlers)
+	c.mu.RUnlock()
+	transportLocalAnnounceDebug.Tracef("Notifying %d service announcement handlers", len(handlers))
 	
-	for _, handler := range c.serviceAnnounceHandlers {
+	for _, handler := range handlers {
 		handler(serviceDescriptor)
 	}
 	
@@ -19,12 +25,16 @@ func (c *LocalTransport) AnnounceService(serviceDescriptor *zephyr.ServiceDescri
 
 func (c *LocalTransport) BindServiceAnnounce(handler func(serviceDescriptor *zephyr.ServiceDescriptor)) error {
 	transportLocalAnnounceDebug.Trace("Binding service announcement handler")
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.serviceAnnounceHandlers = append(c.serviceAnnounceHandlers, handler)
 	transportLocalAnnounceDebug.Tracef("Now have %d service announcement handlers", len(c.serviceAnnounceHandlers))
 	return nil
 }
 
 func (c *LocalTransport) UnbindServiceAnnounce() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	transportLocalAnnounceDebug.Tracef("Unbinding %d service announcement handlers", len(c.serviceAnnounceHandlers))
 	c.serviceAnnounceHandlers = nil
 	transportLocalAnnounceDebug.Trace("All service announcement handlers unbound")
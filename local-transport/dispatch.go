@@ -1,30 +1,134 @@
 package localtransport
 
-import "net/http"
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
 
+	"github.com/telemetrytv/zephyr"
+)
+
+// Dispatch calls the handler bound to the service. If no handler is bound, an
+// error is returned and nothing is written to responseWriter, as with the
+// other transports, rather than leaving an empty 200 response.
 func (c *LocalTransport) Dispatch(serviceName string, responseWriter http.ResponseWriter, request *http.Request) error {
 	transportLocalDispatchDebug.Tracef("Dispatching request to service %s: %s %s", 
 		serviceName, request.Method, request.URL.Path)
 	
-	if handler, ok := c.dispatchHandlers[serviceName]; ok {
+	c.mu.RLock()
+	handler, ok := c.dispatchHandlers[serviceName]
+	c.mu.RUnlock()
+	if ok && c.Faithful {
+		transportLocalDispatchDebug.Tracef("Found handler for service %s, calling handler faithfully", serviceName)
+		return dispatchFaithfully(serviceName, handler, responseWriter, request)
+	}
+	if ok {
 		transportLocalDispatchDebug.Tracef("Found handler for service %s, calling handler", serviceName)
-		handler(responseWriter, request)
+		res := &dispatchResponseWriter{ResponseWriter: responseWriter}
+		if err := callHandler(handler, res, request); err != nil {
+			transportLocalDispatchDebug.Tracef("Handler for service %s failed: %v", serviceName, err)
+			err.Service = serviceName
+			return err
+		}
 		transportLocalDispatchDebug.Tracef("Handler for service %s completed", serviceName)
+
+		if res.tunnelErr != nil {
+			transportLocalDispatchDebug.Tracef("Waiting for tunnel to service %s to close", serviceName)
+			return <-res.tunnelErr
+		}
 	} else {
 		transportLocalDispatchDebug.Tracef("No handler found for service %s", serviceName)
+		return fmt.Errorf("localtransport: service %s is not bound", serviceName)
 	}
 	
 	return nil
 }
 
+// callHandler calls the handler, recovering any panic as the error returned
+// to the caller.
+func callHandler(handler func(http.ResponseWriter, *http.Request), res http.ResponseWriter, req *http.Request) (remoteErr *zephyr.RemoteError) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			remoteErr = zephyr.NewRemoteError(recovered)
+		}
+	}()
+	handler(res, req)
+	return nil
+}
+
 func (c *LocalTransport) BindDispatch(serviceName string, handler func(responseWriter http.ResponseWriter, request *http.Request)) error {
 	transportLocalDispatchDebug.Tracef("Binding dispatch handler for service %s", serviceName)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.dispatchHandlers[serviceName] = handler
 	return nil
 }
 
 func (c *LocalTransport) UnbindDispatch(serviceName string) error {
 	transportLocalDispatchDebug.Tracef("Unbinding dispatch handler for service %s", serviceName)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	delete(c.dispatchHandlers, serviceName)
 	return nil
 }
+
+// dispatchResponseWriter is given to service handlers so that hijacking works the same
+// way it does over other transports. Rather than handing the caller's
+// connection straight to the handler, the handler gets one end of an
+// in-memory pipe which is tunnelled to the caller's connection.
+type dispatchResponseWriter struct {
+	http.ResponseWriter
+	tunnelErr chan error
+}
+
+var _ http.Hijacker = &dispatchResponseWriter{}
+var _ http.Flusher = &dispatchResponseWriter{}
+
+func (r *dispatchResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.tunnelErr != nil {
+		return nil, nil, http.ErrHijacked
+	}
+
+	transportLocalDispatchDebug.Trace("Hijacking caller connection")
+	callerConn, err := zephyr.HijackConn(r.ResponseWriter)
+	if err != nil {
+		transportLocalDispatchDebug.Tracef("Failed to hijack caller connection: %v", err)
+		return nil, nil, err
+	}
+
+	handlerConn, tunnelConn := net.Pipe()
+	r.tunnelErr = make(chan error, 1)
+	go func() {
+		r.tunnelErr <- zephyr.Tunnel(callerConn, tunnelConn)
+	}()
+
+	return handlerConn, bufio.NewReadWriter(bufio.NewReader(handlerConn), bufio.NewWriter(handlerConn)), nil
+}
+
+func (r *dispatchResponseWriter) WriteHeader(statusCode int) {
+	if r.tunnelErr != nil {
+		return
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *dispatchResponseWriter) Write(p []byte) (int, error) {
+	if r.tunnelErr != nil {
+		return 0, http.ErrHijacked
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *dispatchResponseWriter) Flush() {
+	if r.tunnelErr != nil {
+		return
+	}
+	if err := http.NewResponseController(r.ResponseWriter).Flush(); err != nil {
+		transportLocalDispatchDebug.Tracef("Failed to flush response: %v", err)
+	}
+}
+
+func (r *dispatchResponseWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,239 @@
+package localtransport
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/telemetrytv/zephyr"
+)
+
+// faithfulHead carries the status and headers written by a handler running
+// faithfully to the caller's goroutine.
+type faithfulHead struct {
+	statusCode int
+	header     http.Header
+}
+
+// faithfulHijack asks the caller's goroutine to hijack the caller's
+// connection on behalf of a handler running faithfully.
+type faithfulHijack struct {
+	reply chan faithfulHijackResult
+}
+
+type faithfulHijackResult struct {
+	conn net.Conn
+	brw  *bufio.ReadWriter
+	err  error
+}
+
+// faithfulEnd tells the caller's goroutine that the handler has returned.
+type faithfulEnd struct {
+	remoteErr *zephyr.RemoteError
+	trailer   http.Header
+}
+
+// dispatchFaithfully runs the handler on its own goroutine, with a copy of the
+// request, and streams bodies between it and the caller through pipes. The
+// caller's response writer is only ever used from the caller's goroutine.
+func dispatchFaithfully(serviceName string, handler func(http.ResponseWriter, *http.Request), res http.ResponseWriter, req *http.Request) error {
+	handlerReq := req.Clone(context.Background())
+	var reqBodyReader *io.PipeReader
+	if req.Body != nil && req.Body != http.NoBody {
+		var reqBodyWriter *io.PipeWriter
+		reqBodyReader, reqBodyWriter = io.Pipe()
+		handlerReq.Body = reqBodyReader
+		go func() {
+			_, err := io.Copy(reqBodyWriter, req.Body)
+			// Trailers are only known once the body has been read, so they
+			// are copied before the handler reads the end of its body.
+			for key, values := range req.Trailer {
+				handlerReq.Trailer[key] = values
+			}
+			reqBodyWriter.CloseWithError(err)
+		}()
+	}
+
+	resBodyReader, resBodyWriter := io.Pipe()
+	messages := make(chan any)
+	handlerRes := &faithfulResponseWriter{
+		header:   http.Header{},
+		body:     resBodyWriter,
+		messages: messages,
+	}
+	go func() {
+		remoteErr := callHandler(handler, handlerRes, handlerReq)
+		if reqBodyReader != nil {
+			reqBodyReader.Close()
+		}
+		handlerRes.end(remoteErr)
+	}()
+
+	var tunnelErr chan error
+	for message := range messages {
+		switch message := message.(type) {
+		case *faithfulHijack:
+			dispatchRes := &dispatchResponseWriter{ResponseWriter: res}
+			conn, brw, err := dispatchRes.Hijack()
+			tunnelErr = dispatchRes.tunnelErr
+			message.reply <- faithfulHijackResult{conn: conn, brw: brw, err: err}
+
+		case *faithfulHead:
+			transportLocalDispatchDebug.Tracef("Handler for service %s responded with %d", serviceName, message.statusCode)
+			for key, values := range message.header {
+				res.Header()[key] = values
+			}
+			res.WriteHeader(message.statusCode)
+			copyFaithfulBody(res, resBodyReader)
+
+		case *faithfulEnd:
+			for key, values := range message.trailer {
+				res.Header()[key] = values
+			}
+			if message.remoteErr != nil {
+				transportLocalDispatchDebug.Tracef("Handler for service %s failed: %v", serviceName, message.remoteErr)
+				message.remoteErr.Service = serviceName
+				return message.remoteErr
+			}
+			if tunnelErr != nil {
+				transportLocalDispatchDebug.Tracef("Waiting for tunnel to service %s to close", serviceName)
+				return <-tunnelErr
+			}
+			transportLocalDispatchDebug.Tracef("Handler for service %s completed", serviceName)
+			return nil
+		}
+	}
+	return nil
+}
+
+// copyFaithfulBody copies the response body to the caller as the handler
+// writes it, until the handler returns. If the caller stops accepting the
+// body, the handler's writes fail from then on.
+func copyFaithfulBody(res http.ResponseWriter, body *io.PipeReader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, writeErr := res.Write(buf[:n]); writeErr != nil {
+				transportLocalDispatchDebug.Tracef("Failed to write response body: %v", writeErr)
+				body.CloseWithError(writeErr)
+				return
+			}
+			if flushErr := http.NewResponseController(res).Flush(); flushErr != nil {
+				transportLocalDispatchDebug.Tracef("Failed to flush response: %v", flushErr)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// faithfulResponseWriter is given to handlers running faithfully. Like the
+// response writer of a network transport, it sends the status and a copy of
+// the headers when the body is first written or flushed.
+type faithfulResponseWriter struct {
+	header      http.Header
+	body        *io.PipeWriter
+	messages    chan<- any
+	statusCode  int
+	hasSentHead bool
+	isHijacked  bool
+}
+
+var _ http.Hijacker = &faithfulResponseWriter{}
+var _ http.Flusher = &faithfulResponseWriter{}
+
+func (w *faithfulResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *faithfulResponseWriter) WriteHeader(statusCode int) {
+	if w.hasSentHead || w.isHijacked || w.statusCode != 0 || statusCode < http.StatusOK {
+		return
+	}
+	w.statusCode = statusCode
+}
+
+func (w *faithfulResponseWriter) Write(p []byte) (int, error) {
+	if w.isHijacked {
+		return 0, http.ErrHijacked
+	}
+	w.sendHead()
+	return w.body.Write(p)
+}
+
+func (w *faithfulResponseWriter) Flush() {
+	if w.isHijacked {
+		return
+	}
+	w.sendHead()
+}
+
+func (w *faithfulResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.isHijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	if w.hasSentHead {
+		return nil, nil, errors.New("cannot hijack connection after headers have been sent")
+	}
+	reply := make(chan faithfulHijackResult, 1)
+	w.messages <- &faithfulHijack{reply: reply}
+	result := <-reply
+	if result.err == nil {
+		w.isHijacked = true
+	}
+	return result.conn, result.brw, result.err
+}
+
+func (w *faithfulResponseWriter) sendHead() {
+	if w.hasSentHead {
+		return
+	}
+	w.hasSentHead = true
+	statusCode := w.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	w.messages <- &faithfulHead{statusCode: statusCode, header: w.header.Clone()}
+}
+
+// end finishes the response once the handler has returned. If the handler
+// panicked before sending the headers, nothing it wrote reaches the caller.
+func (w *faithfulResponseWriter) end(remoteErr *zephyr.RemoteError) {
+	defer close(w.messages)
+	if remoteErr != nil {
+		w.body.CloseWithError(remoteErr)
+		w.messages <- &faithfulEnd{remoteErr: remoteErr}
+		return
+	}
+	if !w.isHijacked {
+		w.sendHead()
+	}
+	w.body.Close()
+	w.messages <- &faithfulEnd{trailer: w.trailer()}
+}
+
+// trailer returns the trailers set by the handler, either declared in the
+// Trailer header or prefixed with http.TrailerPrefix.
+func (w *faithfulResponseWriter) trailer() http.Header {
+	trailer := http.Header{}
+	for key, values := range w.header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			trailer[key] = values
+		}
+	}
+	for _, declared := range w.header.Values("Trailer") {
+		for _, key := range strings.Split(declared, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+			if values, ok := w.header[key]; ok {
+				trailer[key] = values
+			}
+		}
+	}
+	return trailer
+}
@@ -2,6 +2,7 @@ package localtransport
 
 import (
 	"net/http"
+	"sync"
 
 	"github.com/telemetrytv/trace"
 	"github.com/telemetrytv/zephyr"
@@ -13,7 +14,27 @@ var (
 	transportLocalAnnounceDebug = trace.Bind("zephyr:transport:local:announce")
 )
 
+// Options configures a LocalTransport.
+type Options struct {
+
+	// Faithful makes the transport run handlers the way a network transport
+	// such as natstransport does, so tests which pass locally pass over the
+	// network too. Each handler runs on its own goroutine with a copy of the
+	// request, and request and response bodies are streamed between the
+	// caller and the handler through pipes. The response headers are sent as
+	// soon as the handler first writes or flushes, so changes made to them
+	// afterwards are lost. A panic in the handler is returned to the caller
+	// as a *zephyr.RemoteError, without the partial response written before
+	// it if the headers had not been sent yet.
+	Faithful bool
+}
+
+// LocalTransport is a transport which connects gateways, services and clients
+// within a single process. It is safe for concurrent use.
 type LocalTransport struct {
+	Options
+
+	mu                      sync.RWMutex
 	gatewayAnnounceHandlers []func(gatewayDescriptor *zephyr.GatewayDescriptor)
 	serviceAnnounceHandlers []func(serviceDescriptor *zephyr.ServiceDescriptor)
 	dispatchHandlers        map[string]func(responseWriter http.ResponseWriter, request *http.Request)
@@ -21,9 +42,15 @@ type LocalTransport struct {
 
 var _ zephyr.Transport = &LocalTransport{}
 
-func New() *LocalTransport {
+// New creates a LocalTransport. Options may be given to configure the
+// transport, otherwise the defaults are used.
+func New(options ...Options) *LocalTransport {
 	transportLocalDebug.Trace("Creating new local transport")
-	return &LocalTransport{
+	transport := &LocalTransport{
 		dispatchHandlers: map[string]func(responseWriter http.ResponseWriter, request *http.Request){},
 	}
+	if len(options) > 0 {
+		transport.Options = options[0]
+	}
+	return transport
 }
@@ -0,0 +1,196 @@
+package localtransport_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+	localtransport "github.com/telemetrytv/zephyr/local-transport"
+	"github.com/telemetrytv/zephyr/transporttest"
+)
+
+func TestLocalTransport(t *testing.T) {
+	t.Run("Is safe to bind, announce and dispatch concurrently", func(t *testing.T) {
+		transport := localtransport.New()
+		var wg sync.WaitGroup
+		for i := range 16 {
+			serviceName := fmt.Sprintf("service-%d", i)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, transport.BindServiceAnnounce(func(*zephyr.ServiceDescriptor) {}))
+				assert.NoError(t, transport.BindDispatch(serviceName, func(res http.ResponseWriter, req *http.Request) {
+					res.WriteHeader(http.StatusNoContent)
+				}))
+				assert.NoError(t, transport.AnnounceService(&zephyr.ServiceDescriptor{Name: serviceName}))
+				res := httptest.NewRecorder()
+				assert.NoError(t, transport.Dispatch(serviceName, res, httptest.NewRequest("GET", "/", nil)))
+				assert.Equal(t, http.StatusNoContent, res.Code)
+				assert.NoError(t, transport.UnbindDispatch(serviceName))
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("Returns an error rather than an empty response when the service is not bound", func(t *testing.T) {
+		transport := localtransport.New()
+
+		res := httptest.NewRecorder()
+		err := transport.Dispatch("testService", res, httptest.NewRequest("GET", "/", nil))
+
+		assert.EqualError(t, err, "localtransport: service testService is not bound")
+		assert.Empty(t, res.Body.String())
+	})
+}
+
+func TestLocalTransport_Faithful(t *testing.T) {
+	newTransport := func(handler func(res http.ResponseWriter, req *http.Request)) *localtransport.LocalTransport {
+		transport := localtransport.New(localtransport.Options{Faithful: true})
+		require.NoError(t, transport.BindDispatch("testService", handler))
+		return transport
+	}
+
+	t.Run("Ignores headers changed after the body is written", func(t *testing.T) {
+		transport := newTransport(func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Before", "1")
+			res.Write([]byte("test response"))
+			res.Header().Set("After", "1")
+		})
+
+		res := httptest.NewRecorder()
+		require.NoError(t, transport.Dispatch("testService", res, httptest.NewRequest("GET", "/", nil)))
+
+		assert.Equal(t, "1", res.Header().Get("Before"))
+		assert.Empty(t, res.Header().Get("After"))
+		assert.Equal(t, "test response", res.Body.String())
+	})
+
+	t.Run("Gives the handler a copy of the request", func(t *testing.T) {
+		transport := newTransport(func(res http.ResponseWriter, req *http.Request) {
+			req.Header.Set("Test-Header", "changed")
+			res.WriteHeader(http.StatusNoContent)
+		})
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Test-Header", "original")
+		require.NoError(t, transport.Dispatch("testService", httptest.NewRecorder(), req))
+
+		assert.Equal(t, "original", req.Header.Get("Test-Header"))
+	})
+
+	t.Run("Streams the request and response bodies", func(t *testing.T) {
+		transport := newTransport(func(res http.ResponseWriter, req *http.Request) {
+			reader := bufio.NewReader(req.Body)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				res.Write([]byte("echo: " + line))
+				res.(http.Flusher).Flush()
+			}
+		})
+
+		bodyReader, bodyWriter := io.Pipe()
+		res := newStreamRecorder()
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- transport.Dispatch("testService", res, httptest.NewRequest("POST", "/", bodyReader))
+		}()
+
+		for _, line := range []string{"one\n", "two\n"} {
+			_, err := bodyWriter.Write([]byte(line))
+			require.NoError(t, err)
+			assert.Equal(t, "echo: "+line, <-res.writes)
+		}
+		bodyWriter.Close()
+		assert.NoError(t, <-errChan)
+	})
+
+	t.Run("Returns a remote error without the partial response if the handler panics before writing", func(t *testing.T) {
+		transport := newTransport(func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Test-Header", "test-value")
+			res.WriteHeader(http.StatusCreated)
+			panic("test panic")
+		})
+
+		res := httptest.NewRecorder()
+		err := transport.Dispatch("testService", res, httptest.NewRequest("GET", "/", nil))
+
+		var remoteErr *zephyr.RemoteError
+		require.ErrorAs(t, err, &remoteErr)
+		assert.Equal(t, "testService", remoteErr.Service)
+		assert.Equal(t, "test panic", remoteErr.Message)
+		assert.Empty(t, res.Header().Get("Test-Header"))
+	})
+
+	t.Run("Returns a remote error after the partial response if the handler panics while writing", func(t *testing.T) {
+		transport := newTransport(func(res http.ResponseWriter, req *http.Request) {
+			res.Write([]byte("partial"))
+			panic("test panic")
+		})
+
+		res := httptest.NewRecorder()
+		err := transport.Dispatch("testService", res, httptest.NewRequest("GET", "/", nil))
+
+		var remoteErr *zephyr.RemoteError
+		require.ErrorAs(t, err, &remoteErr)
+		assert.Equal(t, "partial", res.Body.String())
+	})
+
+	t.Run("Carries response trailers", func(t *testing.T) {
+		transport := newTransport(func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Trailer", "Checksum")
+			res.Write([]byte("test response"))
+			res.Header().Set("Checksum", "abc123")
+		})
+
+		res := httptest.NewRecorder()
+		require.NoError(t, transport.Dispatch("testService", res, httptest.NewRequest("POST", "/", strings.NewReader("test body"))))
+
+		result := res.Result()
+		io.ReadAll(result.Body)
+		assert.Equal(t, "abc123", result.Trailer.Get("Checksum"))
+	})
+}
+
+// streamRecorder is a response recorder which passes on each write as it is
+// made.
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+	writes chan string
+}
+
+func newStreamRecorder() *streamRecorder {
+	return &streamRecorder{ResponseRecorder: httptest.NewRecorder(), writes: make(chan string, 16)}
+}
+
+func (r *streamRecorder) Write(p []byte) (int, error) {
+	r.writes <- string(p)
+	return r.ResponseRecorder.Write(p)
+}
+
+func TestLocalTransport_Conformance(t *testing.T) {
+	t.Run("Inline", func(t *testing.T) {
+		transporttest.Run(t, func(t *testing.T, n int) []zephyr.Transport {
+			transport := localtransport.New()
+			return slices.Repeat([]zephyr.Transport{transport}, n)
+		})
+	})
+
+	t.Run("Faithful", func(t *testing.T) {
+		transporttest.Run(t, func(t *testing.T, n int) []zephyr.Transport {
+			transport := localtransport.New(localtransport.Options{Faithful: true})
+			return slices.Repeat([]zephyr.Transport{transport}, n)
+		})
+	})
+}
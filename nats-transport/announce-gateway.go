@@ -22,7 +22,7 @@ func (c *NatsTransport) AnnounceGateway(gatewayDescriptor *zephyr.GatewayDescrip
 		return err
 	}
 	
-	gatewayAnnounceSubject := namespace("gateway.announce")
+	gatewayAnnounceSubject := c.namespace("gateway.announce")
 	transportNatsAnnounceDebug.Tracef("Publishing gateway announcement to %s", gatewayAnnounceSubject)
 	
 	if err := c.NatsConnection.Publish(gatewayAnnounceSubject, descriptorBuf); err != nil {
@@ -54,7 +54,7 @@ func (c *NatsTransport) BindGatewayAnnounce(handler func(gatewayDescriptor *zeph
 		handler(gatewayDescriptor)
 	}
 
-	gatewayAnnounceSubject := namespace("gateway.announce")
+	gatewayAnnounceSubject := c.namespace("gateway.announce")
 	transportNatsAnnounceDebug.Tracef("Subscribing to gateway announcements on %s", gatewayAnnounceSubject)
 	
 	gatewayAnnounceSub, err := c.NatsConnection.Subscribe(gatewayAnnounceSubject, subHandler)
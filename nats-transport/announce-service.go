@@ -17,7 +17,7 @@ func (c *NatsTransport) AnnounceService(serviceDescriptor *zephyr.ServiceDescrip
 		return err
 	}
 
-	serviceAnnounceSubject := namespace("service.announce")
+	serviceAnnounceSubject := c.namespace("service.announce")
 	transportNatsAnnounceDebug.Tracef("Publishing service announcement to %s", serviceAnnounceSubject)
 
 	if err := c.NatsConnection.Publish(serviceAnnounceSubject, serviceDescriptorBuf); err != nil {
@@ -49,7 +49,7 @@ func (c *NatsTransport) BindServiceAnnounce(handler func(serviceDescriptor *zeph
 		handler(serviceDescriptor)
 	}
 
-	serviceAnnounceSubject := namespace("service.announce")
+	serviceAnnounceSubject := c.namespace("service.announce")
 	transportNatsAnnounceDebug.Tracef("Subscribing to service announcements on %s", serviceAnnounceSubject)
 
 	serviceAnnounceSub, err := c.NatsConnection.Subscribe(serviceAnnounceSubject, subHandler)
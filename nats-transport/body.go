@@ -0,0 +1,208 @@
+package natstransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/telemetrytv/trace"
+)
+
+var (
+	transportNatsBodyDebug = trace.Bind("zephyr:transport:nats:body")
+)
+
+// DispatchBodyWindow is the default number of body chunks a sender may have
+// in flight before it must wait for the receiver to grant it more credit.
+// Together with DispatchBodyChunkSize it bounds the memory used by each
+// streaming body.
+const DispatchBodyWindow = 16
+
+// ErrBodyChunkMissing is returned when a body chunk is lost in transit, or
+// arrives too far ahead of the chunks before it to have been sent within the
+// receiver's window.
+var ErrBodyChunkMissing = errors.New("natstransport: body chunk missing")
+
+// errBodyClosed is returned by a body sender once the receiver has closed the
+// body without reading it to the end.
+var errBodyClosed = errors.New("natstransport: body closed by receiver")
+
+// BodyCredit is sent by the receiver of a body to its sender as it consumes
+// chunks. Index is the number of chunks consumed so far, so the sender may
+// publish up to Index plus the receiver's window. Closed is set if the
+// receiver will not read the rest of the body, so the sender can stop.
+type BodyCredit struct {
+	Index  int  `msgpack:"index"`
+	Closed bool `msgpack:"closed,omitempty"`
+}
+
+// bodySender publishes body chunks in order. When the receiver supports flow
+// control, creditInbox receives its credits, and the sender waits for
+// credit once window chunks are unacknowledged.
+type bodySender struct {
+	natsConnection *nats.Conn
+	wireMode       WireMode
+	subject        string
+	creditInbox    *inbox
+	window         int
+	idleTimeout    time.Duration
+	index          int
+	credit         int
+	isClosed       bool
+}
+
+// send publishes a chunk, first waiting for credit unless it is the EOF
+// chunk, which carries no data. If the receiver has closed the body,
+// errBodyClosed is returned instead.
+func (s *bodySender) send(ctx context.Context, bodyChunk *BodyChunk) error {
+	if s.isClosed {
+		return errBodyClosed
+	}
+	if !bodyChunk.IsEOF {
+		if err := s.waitForCredit(ctx); err != nil {
+			return err
+		}
+	}
+
+	bodyChunk.Index = s.index
+	if err := publishWireMsg(s.natsConnection, s.wireMode, s.subject, bodyChunk); err != nil {
+		return err
+	}
+	s.index += 1
+	return nil
+}
+
+func (s *bodySender) waitForCredit(ctx context.Context) error {
+	if s.creditInbox == nil {
+		return nil
+	}
+	for s.index-s.credit >= s.window {
+		transportNatsBodyDebug.Tracef("Window of %d chunks is full, waiting for credit", s.window)
+		creditMsg, err := nextMsg(ctx, s.creditInbox, s.idleTimeout)
+		if err != nil {
+			transportNatsBodyDebug.Tracef("Error waiting for body credit: %v", err)
+			return err
+		}
+		bodyCredit := &BodyCredit{}
+		if err := decodeWireMsg(creditMsg, bodyCredit); err != nil {
+			return err
+		}
+		if bodyCredit.Closed {
+			transportNatsBodyDebug.Trace("Receiver closed the body")
+			s.isClosed = true
+			return errBodyClosed
+		}
+		if bodyCredit.Index > s.credit {
+			s.credit = bodyCredit.Index
+		}
+	}
+	return nil
+}
+
+func (s *bodySender) close() {
+	if s.creditInbox != nil {
+		s.creditInbox.close()
+	}
+}
+
+// bodyReceiver returns body chunks in index order, whatever order they
+// arrive in. Duplicate chunks are dropped, and a chunk missing from the
+// sequence is reported as ErrBodyChunkMissing. If creditSubject is set, the
+// receiver grants the sender more credit as the chunks are consumed.
+type bodyReceiver struct {
+	natsConnection *nats.Conn
+	wireMode       WireMode
+	inbox          *inbox
+	creditSubject  string
+	window         int
+	idleTimeout    time.Duration
+	nextIndex      int
+	credited       int
+	pending        map[int]*BodyChunk
+}
+
+// next returns the next chunk of the body. Chunks returned by earlier calls
+// are considered consumed, and are credited to the sender.
+func (r *bodyReceiver) next(ctx context.Context) (*BodyChunk, error) {
+	if err := r.sendCredit(); err != nil {
+		return nil, err
+	}
+
+	for {
+		if bodyChunk, ok := r.pending[r.nextIndex]; ok {
+			delete(r.pending, r.nextIndex)
+			r.nextIndex += 1
+			return bodyChunk, nil
+		}
+
+		bodyChunkMsg, err := nextMsg(ctx, r.inbox, r.idleTimeout)
+		if err != nil {
+			if errors.Is(err, nats.ErrTimeout) && len(r.pending) != 0 {
+				return nil, fmt.Errorf("%w: chunk %d never arrived", ErrBodyChunkMissing, r.nextIndex)
+			}
+			return nil, err
+		}
+		bodyChunk := &BodyChunk{}
+		if err := decodeWireMsg(bodyChunkMsg, bodyChunk); err != nil {
+			return nil, err
+		}
+		if err := r.accept(bodyChunk); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// accept queues a received chunk until the chunks before it have been
+// returned.
+func (r *bodyReceiver) accept(bodyChunk *BodyChunk) error {
+	if bodyChunk.Index < r.nextIndex {
+		transportNatsBodyDebug.Tracef("Dropping duplicate body chunk %d", bodyChunk.Index)
+		return nil
+	}
+	if bodyChunk.Index > r.nextIndex+r.window {
+		return fmt.Errorf("%w: received chunk %d while waiting for chunk %d", ErrBodyChunkMissing, bodyChunk.Index, r.nextIndex)
+	}
+	if bodyChunk.Index != r.nextIndex {
+		transportNatsBodyDebug.Tracef("Received body chunk %d out of order, waiting for chunk %d", bodyChunk.Index, r.nextIndex)
+	}
+	if r.pending == nil {
+		r.pending = map[int]*BodyChunk{}
+	}
+	r.pending[bodyChunk.Index] = bodyChunk
+	return nil
+}
+
+// close informs the sender that the rest of the body will not be read, and
+// stops receiving chunks.
+func (r *bodyReceiver) close() error {
+	err := r.sendClosed()
+	r.inbox.close()
+	return err
+}
+
+// sendClosed informs the sender that the rest of the body will not be read,
+// without yet closing the inbox, so chunks already sent can still be
+// received.
+func (r *bodyReceiver) sendClosed() error {
+	if r.creditSubject == "" {
+		return nil
+	}
+	bodyCredit := &BodyCredit{Index: r.nextIndex, Closed: true}
+	return publishWireMsg(r.natsConnection, r.wireMode, r.creditSubject, bodyCredit)
+}
+
+// sendCredit informs the sender of the chunks consumed so far, once at least
+// half of the window has been consumed since the last credit was sent.
+func (r *bodyReceiver) sendCredit() error {
+	if r.creditSubject == "" || r.nextIndex-r.credited < max(1, r.window/2) {
+		return nil
+	}
+	bodyCredit := &BodyCredit{Index: r.nextIndex}
+	if err := publishWireMsg(r.natsConnection, r.wireMode, r.creditSubject, bodyCredit); err != nil {
+		return err
+	}
+	r.credited = r.nextIndex
+	return nil
+}
@@ -0,0 +1,41 @@
+package natstransport
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyReceiver(t *testing.T) {
+	t.Run("Returns chunks in index order", func(t *testing.T) {
+		receiver := &bodyReceiver{window: 4}
+		assert.NoError(t, receiver.accept(&BodyChunk{Index: 2, IsEOF: true}))
+		assert.NoError(t, receiver.accept(&BodyChunk{Index: 0, Data: []byte("a")}))
+		assert.NoError(t, receiver.accept(&BodyChunk{Index: 1, Data: []byte("b")}))
+
+		for _, expected := range []string{"a", "b", ""} {
+			bodyChunk, err := receiver.next(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, expected, string(bodyChunk.Data))
+		}
+		assert.Equal(t, 3, receiver.nextIndex)
+	})
+
+	t.Run("Drops duplicate chunks", func(t *testing.T) {
+		receiver := &bodyReceiver{window: 4}
+		assert.NoError(t, receiver.accept(&BodyChunk{Index: 0, Data: []byte("a")}))
+		bodyChunk, err := receiver.next(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "a", string(bodyChunk.Data))
+
+		assert.NoError(t, receiver.accept(&BodyChunk{Index: 0, Data: []byte("a")}))
+		assert.Empty(t, receiver.pending)
+	})
+
+	t.Run("Detects chunks sent beyond the window", func(t *testing.T) {
+		receiver := &bodyReceiver{window: 4}
+		err := receiver.accept(&BodyChunk{Index: 5, Data: []byte("f")})
+		assert.ErrorIs(t, err, ErrBodyChunkMissing)
+	})
+}
@@ -0,0 +1,64 @@
+package natstransport
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/telemetrytv/trace"
+	"github.com/telemetrytv/zephyr"
+)
+
+var (
+	transportNatsConnectionDebug = trace.Bind("zephyr:transport:nats:connection")
+)
+
+var _ zephyr.ConnectionNotifier = &NatsTransport{}
+var _ zephyr.ReadinessReporter = &NatsTransport{}
+
+// BindConnectionChange calls handler whenever the NATS connection is lost or
+// restored. It listens for status changes on the connection rather than
+// setting its disconnect and reconnect handlers, so any handlers given when
+// the connection was made are left in place. Once the returned unbind function
+// returns, handler is no longer running and will not be called again.
+func (c *NatsTransport) BindConnectionChange(handler func(isConnected bool)) (func(), error) {
+	transportNatsConnectionDebug.Trace("Binding connection change handler")
+	statusChan := c.NatsConnection.StatusChanged(nats.CONNECTED, nats.DISCONNECTED, nats.RECONNECTING, nats.CLOSED)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case status, ok := <-statusChan:
+				if !ok {
+					return
+				}
+				transportNatsConnectionDebug.Tracef("Connection status changed to %s", status)
+				handler(status == nats.CONNECTED)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var unbindOnce sync.Once
+	return func() {
+		unbindOnce.Do(func() {
+			transportNatsConnectionDebug.Trace("Unbinding connection change handler")
+			close(done)
+			<-stopped
+			// The connection stops sending to the channel once it is closed.
+			close(statusChan)
+		})
+	}, nil
+}
+
+// Ready returns an error unless the NATS connection is connected.
+func (c *NatsTransport) Ready() error {
+	if status := c.NatsConnection.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("natstransport: connection is %s", strings.ToLower(status.String()))
+	}
+	return nil
+}
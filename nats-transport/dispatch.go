@@ -1,25 +1,41 @@
 package natstransport
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/telemetrytv/trace"
-	"github.com/vmihailenco/msgpack/v5"
+	"github.com/telemetrytv/zephyr"
 )
 
 var (
-	transportNatsDebug       = trace.Bind("zephyr:transport:nats")
+	transportNatsDebug         = trace.Bind("zephyr:transport:nats")
 	transportNatsDispatchDebug = trace.Bind("zephyr:transport:nats:dispatch")
 )
 
+// DispatchTimeout is the default time to wait for a service to accept a
+// request, and to respond with its status and headers.
 const DispatchTimeout = 30 * time.Second
+
+// DispatchIdleTimeout is the default time to wait for the next body chunk
+// once a body is streaming. It is separate from DispatchTimeout so that long
+// lived responses, such as server-sent events, survive as long as the service
+// keeps writing and flushing.
+const DispatchIdleTimeout = 2 * time.Minute
+
 const DispatchBodyChunkSize = 1024 * 16
 
 type TLS struct {
@@ -55,10 +71,42 @@ type Request struct {
 
 	ResponseSubject     string `msgpack:"responseSubject"`
 	ResponseBodySubject string `msgpack:"responseBodySubject"`
+	TunnelSubject       string `msgpack:"tunnelSubject"`
+
+	// BodyWindow is the number of response body chunks the dispatching side
+	// will accept in flight, and CreditSubject is where the service sends
+	// credit as it consumes the request body. Both are empty if the
+	// dispatching side does not support flow control.
+	BodyWindow    int    `msgpack:"bodyWindow,omitempty"`
+	CreditSubject string `msgpack:"creditSubject,omitempty"`
+
+	// ObjectStore is the object store bucket the dispatching side reads large
+	// response bodies from, if it has one.
+	ObjectStore string `msgpack:"objectStore,omitempty"`
+
+	// InlineBody is set if the whole request body is carried in Body, with
+	// its trailers in Trailers, rather than streamed as body chunks. The
+	// service then replies to the request message with a Response rather than
+	// a RequestAck. Services without support for inline bodies ignore both
+	// fields and acknowledge the request as usual, in which case the body is
+	// streamed to them instead.
+	InlineBody bool   `msgpack:"inlineBody,omitempty"`
+	Body       []byte `msgpack:"body,omitempty"`
 }
 
 type RequestAck struct {
 	RequestBodySubject string `msgpack:"requestBodySubject"`
+
+	// BodyWindow is the number of request body chunks the service will accept
+	// in flight, and CreditSubject is where the dispatching side sends credit
+	// as it consumes the response body. Both are empty if the service does not
+	// support flow control.
+	BodyWindow    int    `msgpack:"bodyWindow,omitempty"`
+	CreditSubject string `msgpack:"creditSubject,omitempty"`
+
+	// ObjectStore is the object store bucket the service reads large request
+	// bodies from, if it has one.
+	ObjectStore string `msgpack:"objectStore,omitempty"`
 }
 
 type ResponseError struct {
@@ -66,28 +114,114 @@ type ResponseError struct {
 	Stack   string `msgpack:"stack"`
 }
 
+// remoteError converts an error received from a service into the error
+// returned by Dispatch.
+func (e *ResponseError) remoteError(serviceName string) *zephyr.RemoteError {
+	return &zephyr.RemoteError{
+		Service: serviceName,
+		Message: e.Message,
+		Stack:   e.Stack,
+	}
+}
+
 type Response struct {
-	StatusCode int                 `msgpack:"statusCode"`
-	Header     map[string][]string `msgpack:"header"`
-	Error      string              `msgpack:"error"`
+	StatusCode    int                 `msgpack:"statusCode"`
+	Header        map[string][]string `msgpack:"header"`
+	Error         string              `msgpack:"error"`
+	Hijacked      bool                `msgpack:"hijacked"`
+	TunnelSubject string              `msgpack:"tunnelSubject"`
+
+	// HandlerError is set in place of the status and headers if the handler
+	// failed before starting its response.
+	HandlerError *ResponseError `msgpack:"handlerError,omitempty"`
+
+	// InlineBody is set if the whole response body is carried in Body, with
+	// its trailers in Trailer, so no body chunks follow. It is only used in
+	// reply to a request with an inline body.
+	InlineBody bool                `msgpack:"inlineBody,omitempty"`
+	Body       []byte              `msgpack:"body,omitempty"`
+	Trailer    map[string][]string `msgpack:"trailer,omitempty"`
+
+	// CreditSubject is where the dispatching side sends credit as it consumes
+	// the response body, if the response to a request with an inline body
+	// is streamed. Otherwise it is sent in the RequestAck.
+	CreditSubject string `msgpack:"creditSubject,omitempty"`
 }
 
 type BodyChunk struct {
-	Index int    `msgpack:"index"`
-	Data  []byte `msgpack:"data"`
-	Error string `msgpack:"error"`
-	IsEOF bool   `msgpack:"end"`
+	Index   int                 `msgpack:"index"`
+	Data    []byte              `msgpack:"data"`
+	Error   string              `msgpack:"error"`
+	IsEOF   bool                `msgpack:"end"`
+	Trailer map[string][]string `msgpack:"trailer,omitempty"`
+
+	// HandlerError is set on the EOF chunk of a response if the handler
+	// failed after starting its response.
+	HandlerError *ResponseError `msgpack:"handlerError,omitempty"`
+
+	// BodyObject is set on the EOF chunk if the body was offloaded to the
+	// object store, and is the name of the object holding it.
+	BodyObject string `msgpack:"bodyObject,omitempty"`
 }
 
 func (c *NatsTransport) Dispatch(serviceName string, res http.ResponseWriter, req *http.Request) error {
 	transportNatsDispatchDebug.Tracef("Dispatching request to service %s: %s %s", serviceName, req.Method, req.URL.Path)
-	
-	requestSubject := namespace("service", serviceName)
-	responseSubject := nats.NewInbox()
-	responseBodySubject := nats.NewInbox()
-	
-	transportNatsDispatchDebug.Tracef("Using subjects - request: %s, response: %s, responseBody: %s", 
-		requestSubject, responseSubject, responseBodySubject)
+	return c.dispatch(serviceName, "", res, req)
+}
+
+// InstanceID returns the ID services bound to the transport announce, which
+// DispatchInstance dispatches to.
+func (c *NatsTransport) InstanceID() string {
+	return c.Options.InstanceID
+}
+
+// DispatchInstance dispatches a request to the instance of a service bound on
+// the transport with the given instance ID. If there is no such instance,
+// zephyr.ErrInstanceUnavailable is returned with the request body intact.
+func (c *NatsTransport) DispatchInstance(serviceName string, instanceID string, res http.ResponseWriter, req *http.Request) error {
+	transportNatsDispatchDebug.Tracef("Dispatching request to instance %s of service %s: %s %s",
+		instanceID, serviceName, req.Method, req.URL.Path)
+	return c.dispatch(serviceName, instanceID, res, req)
+}
+
+// dispatch sends the request to any instance of the service if instanceID is
+// empty, or to the instance with that ID otherwise.
+func (c *NatsTransport) dispatch(serviceName string, instanceID string, res http.ResponseWriter, req *http.Request) error {
+	requestSubject := c.namespace("service", serviceName)
+	if instanceID != "" {
+		requestSubject = c.namespace("service", serviceName, "instance", instanceID)
+	}
+
+	// The inboxes are closed however dispatch ends, so none are left behind
+	// on error paths.
+	responseInbox, err := c.newInbox()
+	if err != nil {
+		transportNatsDispatchDebug.Tracef("Failed to create response inbox: %v", err)
+		return err
+	}
+	defer responseInbox.close()
+	responseBodyInbox, err := c.newInbox()
+	if err != nil {
+		transportNatsDispatchDebug.Tracef("Failed to create response body inbox: %v", err)
+		return err
+	}
+	defer responseBodyInbox.close()
+
+	transportNatsDispatchDebug.Tracef("Using subjects - request: %s, response: %s, responseBody: %s",
+		requestSubject, responseInbox.subject, responseBodyInbox.subject)
+
+	// Cover the case of a nil body reader
+	var reqBody io.Reader = req.Body
+	if req.Body == nil {
+		transportNatsDispatchDebug.Trace("Request has nil body, using EOF reader")
+		reqBody = &eofReader{}
+	}
+
+	inlineBody, isInline, reqBody, err := readInlineBody(req, reqBody)
+	if err != nil {
+		transportNatsDispatchDebug.Tracef("Error reading request body: %v", err)
+		return err
+	}
 
 	request := &Request{
 		Method:           req.Method,
@@ -103,8 +237,23 @@ func (c *NatsTransport) Dispatch(serviceName string, res http.ResponseWriter, re
 		RemoteAddr:       req.RemoteAddr,
 		RequestURI:       req.RequestURI,
 
-		ResponseSubject:     responseSubject,
-		ResponseBodySubject: responseBodySubject,
+		ResponseSubject:     responseInbox.subject,
+		ResponseBodySubject: responseBodyInbox.subject,
+		BodyWindow:          c.dispatchBodyWindow(),
+		ObjectStore:         c.objectStoreBucket,
+	}
+	var requestCreditInbox *inbox
+	if isInline {
+		transportNatsDispatchDebug.Tracef("Sending request body of %d bytes inline", len(inlineBody))
+		request.InlineBody = true
+		request.Body = inlineBody
+	} else {
+		if requestCreditInbox, err = c.newInbox(); err != nil {
+			transportNatsDispatchDebug.Tracef("Failed to create request body credit inbox: %v", err)
+			return err
+		}
+		defer requestCreditInbox.close()
+		request.CreditSubject = requestCreditInbox.subject
 	}
 
 	if req.TLS != nil {
@@ -122,185 +271,347 @@ func (c *NatsTransport) Dispatch(serviceName string, res http.ResponseWriter, re
 		}
 	}
 
-	transportNatsDispatchDebug.Trace("Marshaling request")
-	requestBytes, err := msgpack.Marshal(request)
-	if err != nil {
-		transportNatsDispatchDebug.Tracef("Failed to marshal request: %v", err)
-		return err
+	var tunnelInbox *inbox
+	if zephyr.IsUpgradeRequest(req) {
+		if tunnelInbox, err = c.newInbox(); err != nil {
+			transportNatsDispatchDebug.Tracef("Failed to create tunnel inbox: %v", err)
+			return err
+		}
+		defer tunnelInbox.close()
+		request.TunnelSubject = tunnelInbox.subject
+		transportNatsDispatchDebug.Tracef("Using tunnel subject %s for upgrade request", request.TunnelSubject)
 	}
 
-	transportNatsDispatchDebug.Tracef("Setting up response subscription to %s", responseSubject)
-	responseSub, err := c.NatsConnection.SubscribeSync(responseSubject)
-	if err != nil {
-		transportNatsDispatchDebug.Tracef("Failed to subscribe to response subject %s: %v", responseSubject, err)
-		return err
-	}
-	
-	transportNatsDispatchDebug.Tracef("Setting up response body subscription to %s", responseBodySubject)
-	responseBodySub, err := c.NatsConnection.SubscribeSync(responseBodySubject)
+	transportNatsDispatchDebug.Tracef("Encoding request as %s", c.WireMode)
+	requestMsg, err := newWireMsg(c.WireMode, requestSubject, request)
 	if err != nil {
-		transportNatsDispatchDebug.Tracef("Failed to subscribe to response body subject %s: %v", responseBodySubject, err)
+		transportNatsDispatchDebug.Tracef("Failed to encode request: %v", err)
 		return err
 	}
 
 	transportNatsDispatchDebug.Tracef("Sending request to %s", requestSubject)
-	requestAckMsg, err := c.NatsConnection.Request(requestSubject, requestBytes, DispatchTimeout)
+	replyMsg, err := c.NatsConnection.RequestMsg(requestMsg, c.dispatchTimeout())
+	if instanceID != "" && errors.Is(err, nats.ErrNoResponders) {
+		transportNatsDispatchDebug.Tracef("Instance %s of service %s is not bound", instanceID, serviceName)
+		// Nothing was sent, so give back the body for the request to be
+		// dispatched again.
+		if req.Body != nil {
+			if isInline {
+				reqBody = bytes.NewReader(inlineBody)
+			}
+			req.Body = io.NopCloser(reqBody)
+		}
+		return fmt.Errorf("%w: %s", zephyr.ErrInstanceUnavailable, instanceID)
+	}
 	if err != nil {
 		transportNatsDispatchDebug.Tracef("Request to %s failed: %v", requestSubject, err)
 		return err
 	}
-	
-	transportNatsDispatchDebug.Trace("Received acknowledgment from service")
+
 	requestAck := &RequestAck{}
-	if err := msgpack.Unmarshal(requestAckMsg.Data, requestAck); err != nil {
-		transportNatsDispatchDebug.Tracef("Failed to unmarshal request acknowledgment: %v", err)
+	if err := decodeWireMsg(replyMsg, requestAck); err != nil {
+		transportNatsDispatchDebug.Tracef("Failed to decode request acknowledgment: %v", err)
 		return err
 	}
 
-	requestBodySubject := requestAck.RequestBodySubject
-	transportNatsDispatchDebug.Tracef("Using request body subject: %s", requestBodySubject)
+	// A service which supports inline bodies replies with its response
+	// rather than an acknowledgment, so only older services need the body
+	// streamed to them.
+	var responseMsg *nats.Msg
+	dispatchCtx := req.Context()
+	if isInline && requestAck.RequestBodySubject == "" {
+		transportNatsDispatchDebug.Trace("Received response from service in reply to the request")
+		responseMsg = replyMsg
+	} else {
+		transportNatsDispatchDebug.Trace("Received acknowledgment from service")
+		if isInline {
+			transportNatsDispatchDebug.Trace("Service does not support inline bodies, streaming request body")
+			reqBody = bytes.NewReader(inlineBody)
+		}
+		// The request body is sent while the response is received, as the
+		// service may stream its response before reading all of the request
+		// body. Sending the whole body first would deadlock once the windows
+		// in both directions fill up. If sending the body fails, ctx is
+		// cancelled with the error, which ends the dispatch.
+		ctx, cancel := context.WithCancelCause(req.Context())
+		requestBodyDone := make(chan struct{})
+		go func() {
+			defer close(requestBodyDone)
+			if err := c.sendRequestBody(ctx, req, reqBody, requestAck, requestCreditInbox); err != nil {
+				cancel(err)
+			}
+		}()
+		// The request body must not be read once dispatch returns.
+		defer func() {
+			cancel(nil)
+			<-requestBodyDone
+		}()
+		dispatchCtx = ctx
 
-	// Cover the case of a nil body reader
-	reqBody := req.Body
-	if reqBody == nil {
-		transportNatsDispatchDebug.Trace("Request has nil body, using EOF reader")
-		reqBody = &eofReader{}
+		transportNatsDispatchDebug.Trace("Waiting for response headers")
+		if responseMsg, err = nextMsg(dispatchCtx, responseInbox, c.dispatchTimeout()); err != nil {
+			transportNatsDispatchDebug.Tracef("Error waiting for response headers: %v", err)
+			return dispatchError(dispatchCtx, err)
+		}
 	}
+	responseInbox.close()
 
-	transportNatsDispatchDebug.Trace("Streaming request body")
-	i := 0
-	for {
-		requestBodyBytes := make([]byte, DispatchBodyChunkSize)
-		lenRead, err := reqBody.Read(requestBodyBytes)
-		isEOF := err == io.EOF
-		if !isEOF && err != nil {
-			transportNatsDispatchDebug.Tracef("Error reading request body: %v", err)
+	transportNatsDispatchDebug.Trace("Decoding response headers")
+	response := &Response{}
+	if err := decodeWireMsg(responseMsg, response); err != nil {
+		transportNatsDispatchDebug.Tracef("Failed to decode response: %v", err)
+		return err
+	}
+
+	if response.HandlerError != nil {
+		transportNatsDispatchDebug.Tracef("Service handler failed before responding: %s", response.HandlerError.Message)
+		return response.HandlerError.remoteError(serviceName)
+	}
+
+	if response.Hijacked {
+		transportNatsDispatchDebug.Trace("Service hijacked the connection, opening tunnel")
+		responseBodyInbox.close()
+		if tunnelInbox == nil {
+			transportNatsDispatchDebug.Trace("Service hijacked a request which was not an upgrade request")
+			return zephyr.ErrHijackUnsupported
+		}
+		serviceConn := newTunnelConn(c.NatsConnection, c.WireMode, tunnelInbox, response.TunnelSubject)
+		clientConn, err := zephyr.HijackConn(res)
+		if err != nil {
+			transportNatsDispatchDebug.Tracef("Failed to hijack client connection: %v", err)
+			serviceConn.Close()
 			return err
 		}
+		return zephyr.Tunnel(clientConn, serviceConn)
+	}
+	if tunnelInbox != nil {
+		tunnelInbox.close()
+	}
 
-		if lenRead != 0 {
-			transportNatsDispatchDebug.Tracef("Sending request body chunk %d, size: %d bytes", i, lenRead)
-			bodyChunk := &BodyChunk{
-				Index: i,
-				Data:  requestBodyBytes[:lenRead],
-			}
-			i += 1
+	transportNatsDispatchDebug.Tracef("Setting response headers and status code: %d", response.StatusCode)
+	for key, values := range response.Header {
+		for _, value := range values {
+			res.Header().Add(key, value)
+		}
+	}
+	res.WriteHeader(response.StatusCode)
 
-			bodyChunkBytes, err := msgpack.Marshal(bodyChunk)
-			if err != nil {
-				transportNatsDispatchDebug.Tracef("Failed to marshal request body chunk: %v", err)
+	if response.InlineBody {
+		transportNatsDispatchDebug.Tracef("Writing inline response body of %d bytes", len(response.Body))
+		// Empty bodies are not written, as responses such as 204 and 304 do
+		// not allow a body, not even an empty one.
+		if len(response.Body) > 0 {
+			if _, err := res.Write(response.Body); err != nil {
+				transportNatsDispatchDebug.Tracef("Failed to write response body: %v", err)
 				return err
 			}
+		}
+		setResponseTrailers(res.Header(), response.Trailer)
+		transportNatsDispatchDebug.Trace("Dispatch completed successfully")
+		return nil
+	}
+	flushResponse(res)
+
+	responseCreditSubject := requestAck.CreditSubject
+	if response.CreditSubject != "" {
+		responseCreditSubject = response.CreditSubject
+	}
+
+	transportNatsDispatchDebug.Trace("Reading response body chunks")
+	responseBodyReceiver := &bodyReceiver{
+		natsConnection: c.NatsConnection,
+		wireMode:       c.WireMode,
+		inbox:          responseBodyInbox,
+		creditSubject:  responseCreditSubject,
+		window:         request.BodyWindow,
+		idleTimeout:    c.dispatchIdleTimeout(),
+	}
+	// If dispatch ends before the whole body is received, for example because
+	// the client went away, the service is told to stop sending it rather
+	// than waiting for credit until its idle timeout.
+	hasReceivedBody := false
+	defer func() {
+		if hasReceivedBody {
+			return
+		}
+		if err := responseBodyReceiver.close(); err != nil {
+			transportNatsDispatchDebug.Tracef("Failed to close response body: %v", err)
+		}
+	}()
+	for {
+		transportNatsDispatchDebug.Tracef("Waiting for response body chunk %d", responseBodyReceiver.nextIndex)
+		bodyChunk, err := responseBodyReceiver.next(dispatchCtx)
+		if err != nil {
+			transportNatsDispatchDebug.Tracef("Error receiving response body chunk: %v", err)
+			return dispatchError(dispatchCtx, err)
+		}
 
-			if err := c.NatsConnection.Publish(requestBodySubject, bodyChunkBytes); err != nil {
-				transportNatsDispatchDebug.Tracef("Failed to publish request body chunk: %v", err)
+		if len(bodyChunk.Data) > 0 {
+			if _, err := res.Write(bodyChunk.Data); err != nil {
+				transportNatsDispatchDebug.Tracef("Failed to write response body chunk: %v", err)
 				return err
 			}
 		}
 
-		if isEOF {
-			transportNatsDispatchDebug.Tracef("Sending EOF request body chunk %d", i)
-			bodyChunk := &BodyChunk{
-				Index: i,
-				IsEOF: true,
+		if bodyChunk.IsEOF {
+			transportNatsDispatchDebug.Trace("Received final body chunk (EOF)")
+			hasReceivedBody = true
+			if bodyChunk.BodyObject != "" && bodyChunk.HandlerError == nil {
+				if err := c.copyBodyObject(dispatchCtx, res, bodyChunk.BodyObject); err != nil {
+					transportNatsDispatchDebug.Tracef("Failed to copy response body from the object store: %v", err)
+					return dispatchError(dispatchCtx, err)
+				}
 			}
-
-			bodyChunkBytes, err := msgpack.Marshal(bodyChunk)
-			if err != nil {
-				transportNatsDispatchDebug.Tracef("Failed to marshal EOF request body chunk: %v", err)
-				return err
+			setResponseTrailers(res.Header(), bodyChunk.Trailer)
+			if bodyChunk.HandlerError == nil && bodyChunk.Error != "" {
+				bodyChunk.HandlerError = &ResponseError{Message: bodyChunk.Error}
 			}
-
-			if err := c.NatsConnection.Publish(requestBodySubject, bodyChunkBytes); err != nil {
-				transportNatsDispatchDebug.Tracef("Failed to publish EOF request body chunk: %v", err)
-				return err
+			if bodyChunk.HandlerError != nil {
+				transportNatsDispatchDebug.Tracef("Service handler failed mid-response: %s", bodyChunk.HandlerError.Message)
+				return bodyChunk.HandlerError.remoteError(serviceName)
 			}
-
 			break
 		}
+		flushResponse(res)
 	}
-	transportNatsDispatchDebug.Trace("Finished streaming request body")
 
-	transportNatsDispatchDebug.Trace("Waiting for response headers")
-	responseMsg, err := responseSub.NextMsg(DispatchTimeout)
-	if err != nil {
-		transportNatsDispatchDebug.Tracef("Error waiting for response headers: %v", err)
-		return err
-	}
-	
-	transportNatsDispatchDebug.Trace("Unsubscribing from response subject")
-	if err := responseSub.Unsubscribe(); err != nil {
-		transportNatsDispatchDebug.Tracef("Failed to unsubscribe from response subject: %v", err)
-		return err
-	}
+	transportNatsDispatchDebug.Trace("Dispatch completed successfully")
+	return nil
+}
 
-	transportNatsDispatchDebug.Trace("Unmarshaling response headers")
-	response := &Response{}
-	if err := msgpack.Unmarshal(responseMsg.Data, response); err != nil {
-		transportNatsDispatchDebug.Tracef("Failed to unmarshal response: %v", err)
-		return err
-	}
+// sendRequestBody streams the request body to a service which has
+// acknowledged the request, or offloads it to the object store.
+func (c *NatsTransport) sendRequestBody(ctx context.Context, req *http.Request, reqBody io.Reader, requestAck *RequestAck, requestCreditInbox *inbox) error {
+	requestBodySubject := requestAck.RequestBodySubject
+	transportNatsDispatchDebug.Tracef("Using request body subject: %s", requestBodySubject)
 
-	transportNatsDispatchDebug.Tracef("Setting response headers and status code: %d", response.StatusCode)
-	for key, values := range response.Header {
-		for _, value := range values {
-			res.Header().Add(key, value)
-		}
+	requestBodySender := &bodySender{
+		natsConnection: c.NatsConnection,
+		wireMode:       c.WireMode,
+		subject:        requestBodySubject,
+		window:         requestAck.BodyWindow,
+		idleTimeout:    c.dispatchIdleTimeout(),
+	}
+	if requestAck.BodyWindow > 0 {
+		requestBodySender.creditInbox = requestCreditInbox
+	} else {
+		transportNatsDispatchDebug.Trace("Service does not support flow control, streaming request body without credit")
 	}
-	res.WriteHeader(response.StatusCode)
 
-	transportNatsDispatchDebug.Trace("Reading response body chunks")
-	for i := 0; true; i += 1 {
-		transportNatsDispatchDebug.Tracef("Waiting for response body chunk %d", i)
-		bodyChunkMsg, err := responseBodySub.NextMsg(DispatchTimeout)
+	if c.shouldOffload(req.ContentLength, requestAck.ObjectStore) {
+		transportNatsDispatchDebug.Tracef("Offloading request body of %d bytes to the object store", req.ContentLength)
+		objectName, err := c.putBodyObject(ctx, reqBody)
 		if err != nil {
-			transportNatsDispatchDebug.Tracef("Error receiving response body chunk: %v", err)
+			abortRequestBody(ctx, requestBodySender, err)
 			return err
 		}
-
-		bodyChunk := &BodyChunk{}
-		if err := msgpack.Unmarshal(bodyChunkMsg.Data, bodyChunk); err != nil {
-			transportNatsDispatchDebug.Tracef("Failed to unmarshal response body chunk: %v", err)
+		if err := requestBodySender.send(ctx, &BodyChunk{IsEOF: true, Trailer: req.Trailer, BodyObject: objectName}); err != nil {
+			transportNatsDispatchDebug.Tracef("Failed to send EOF request body chunk: %v", err)
 			return err
 		}
+	} else if err := streamRequestBody(ctx, req, reqBody, requestBodySender); err != nil {
+		return err
+	}
+	transportNatsDispatchDebug.Trace("Finished streaming request body")
+	return nil
+}
+
+// readInlineBody reads a request body small enough to be sent inline with the
+// request. If the request is an upgrade, or its body is of unknown length or
+// larger than a single chunk, the body is left to be streamed, and the
+// returned reader must be used in place of reqBody.
+func readInlineBody(req *http.Request, reqBody io.Reader) ([]byte, bool, io.Reader, error) {
+	if zephyr.IsUpgradeRequest(req) || req.ContentLength < 0 || req.ContentLength > DispatchBodyChunkSize {
+		return nil, false, reqBody, nil
+	}
+	inlineBody, err := io.ReadAll(io.LimitReader(reqBody, DispatchBodyChunkSize+1))
+	if err != nil {
+		return nil, false, reqBody, err
+	}
+	if len(inlineBody) > DispatchBodyChunkSize {
+		// The body is longer than its Content-Length claimed, so stream it
+		// from the start instead.
+		return nil, false, io.MultiReader(bytes.NewReader(inlineBody), reqBody), nil
+	}
+	return inlineBody, true, reqBody, nil
+}
 
-		if _, err := res.Write(bodyChunk.Data); err != nil {
-			transportNatsDispatchDebug.Tracef("Failed to write response body chunk: %v", err)
+// streamRequestBody sends the request body to the service as body chunks,
+// ending with an EOF chunk carrying the request's trailers.
+func streamRequestBody(ctx context.Context, req *http.Request, reqBody io.Reader, requestBodySender *bodySender) error {
+	transportNatsDispatchDebug.Trace("Streaming request body")
+	for {
+		requestBodyBytes := make([]byte, DispatchBodyChunkSize)
+		lenRead, err := reqBody.Read(requestBodyBytes)
+		isEOF := err == io.EOF
+		if !isEOF && err != nil {
+			transportNatsDispatchDebug.Tracef("Error reading request body: %v", err)
+			abortRequestBody(ctx, requestBodySender, err)
 			return err
 		}
 
-		if bodyChunk.IsEOF {
-			transportNatsDispatchDebug.Trace("Received final body chunk (EOF)")
-			break
+		if lenRead != 0 {
+			transportNatsDispatchDebug.Tracef("Sending request body chunk %d, size: %d bytes", requestBodySender.index, lenRead)
+			err := requestBodySender.send(ctx, &BodyChunk{Data: requestBodyBytes[:lenRead]})
+			if errors.Is(err, errBodyClosed) {
+				transportNatsDispatchDebug.Trace("Service closed the request body before reading it to the end")
+				return nil
+			}
+			if err != nil {
+				transportNatsDispatchDebug.Tracef("Failed to send request body chunk: %v", err)
+				return err
+			}
 		}
-	}
 
-	transportNatsDispatchDebug.Trace("Unsubscribing from response body subject")
-	if err := responseBodySub.Unsubscribe(); err != nil {
-		transportNatsDispatchDebug.Tracef("Failed to unsubscribe from response body subject: %v", err)
-		return err
+		if isEOF {
+			transportNatsDispatchDebug.Tracef("Sending EOF request body chunk %d", requestBodySender.index)
+			if err := requestBodySender.send(ctx, &BodyChunk{IsEOF: true, Trailer: req.Trailer}); err != nil {
+				transportNatsDispatchDebug.Tracef("Failed to send EOF request body chunk: %v", err)
+				return err
+			}
+			return nil
+		}
 	}
+}
 
-	transportNatsDispatchDebug.Trace("Dispatch completed successfully")
-	return nil
+// abortRequestBody informs the service that the request body could not be
+// read to the end, so the handler sees an error rather than waiting for the
+// rest of the body.
+func abortRequestBody(ctx context.Context, requestBodySender *bodySender, err error) {
+	if sendErr := requestBodySender.send(ctx, &BodyChunk{Error: err.Error(), IsEOF: true}); sendErr != nil {
+		transportNatsDispatchDebug.Tracef("Failed to send aborted request body chunk: %v", sendErr)
+	}
 }
 
+// BindDispatch binds a handler for requests dispatched to the service. Each
+// request is handled in its own goroutine, as NATS delivers a subscription's
+// messages one at a time, and a slow or streaming handler would otherwise
+// hold up every other request to the instance.
 func (c *NatsTransport) BindDispatch(serviceName string, handler func(res http.ResponseWriter, req *http.Request)) error {
-	dispatchSubject := namespace("service", serviceName)
+	dispatchSubject := c.namespace("service", serviceName)
 	sub, err := c.NatsConnection.QueueSubscribe(dispatchSubject, dispatchSubject, func(msg *nats.Msg) {
-		if err := c.handleDispatch(msg, handler); err != nil {
-			panic(err)
-		}
+		go c.serveDispatch(msg, handler)
 	})
 	if err != nil {
 		return err
 	}
+	instanceSubject := c.namespace("service", serviceName, "instance", c.Options.InstanceID)
+	instanceSub, err := c.NatsConnection.Subscribe(instanceSubject, func(msg *nats.Msg) {
+		go c.serveDispatch(msg, handler)
+	})
+	if err != nil {
+		sub.Unsubscribe()
+		return err
+	}
 
 	unbinders, ok := c.unbindDispatch[serviceName]
 	if !ok {
 		unbinders = []func() error{}
 	}
 	unbinders = append(unbinders, func() error {
+		if err := instanceSub.Unsubscribe(); err != nil {
+			return err
+		}
 		return sub.Unsubscribe()
 	})
 	c.unbindDispatch[serviceName] = unbinders
@@ -308,28 +619,49 @@ func (c *NatsTransport) BindDispatch(serviceName string, handler func(res http.R
 	return nil
 }
 
+// serveDispatch handles a dispatched request. Errors are only traced, as by
+// the time they occur the dispatching side may have gone away, and they must
+// not take down the service.
+func (c *NatsTransport) serveDispatch(msg *nats.Msg, handler func(res http.ResponseWriter, req *http.Request)) {
+	if err := c.handleDispatch(msg, handler); err != nil {
+		transportNatsDispatchDebug.Tracef("Failed to handle dispatched request: %v", err)
+	}
+}
+
 type requestReader struct {
-	natsSubscription *nats.Subscription
-	hasEnded         bool
-	buffer           bytes.Buffer
+	transport    *NatsTransport
+	bodyReceiver *bodyReceiver
+	trailer      http.Header
+	hasEnded     bool
+	buffer       bytes.Buffer
+	object       *bodyObjectReader
+	isAbandoned  bool
+	err          error
 }
 
 func (r *requestReader) Read(p []byte) (int, error) {
 	if !r.hasEnded {
 		for r.buffer.Len() < len(p) {
-			bodyChunkMsg, err := r.natsSubscription.NextMsg(DispatchTimeout)
+			bodyChunk, err := r.bodyReceiver.next(context.Background())
 			if err != nil {
 				return 0, err
 			}
-			bodyChunk := &BodyChunk{}
-			if err := msgpack.Unmarshal(bodyChunkMsg.Data, bodyChunk); err != nil {
-				return 0, err
-			}
 
 			if bodyChunk.IsEOF {
 				r.hasEnded = true
-				if err := r.natsSubscription.Unsubscribe(); err != nil {
-					return 0, err
+				r.bodyReceiver.inbox.close()
+				if bodyChunk.Error != "" {
+					r.err = errors.New(bodyChunk.Error)
+				}
+				for key, values := range bodyChunk.Trailer {
+					r.trailer[key] = values
+				}
+				if bodyChunk.BodyObject != "" {
+					object, err := r.transport.openBodyObject(context.Background(), bodyChunk.BodyObject)
+					if err != nil {
+						return 0, err
+					}
+					r.object = object
 				}
 				break
 			}
@@ -340,42 +672,111 @@ func (r *requestReader) Read(p []byte) (int, error) {
 		}
 	}
 
+	if r.buffer.Len() == 0 && r.err != nil {
+		return 0, r.err
+	}
+	if r.buffer.Len() == 0 && r.object != nil {
+		n, err := r.object.Read(p)
+		if err == io.EOF {
+			if closeErr := r.object.Close(); closeErr != nil {
+				transportNatsDispatchDebug.Tracef("Failed to close request body object: %v", closeErr)
+			}
+		}
+		return n, err
+	}
 	return r.buffer.Read(p)
 }
 
+// Close stops receiving the body if it has not been read to the end, and
+// informs the dispatching side so it stops sending it.
 func (r *requestReader) Close() error {
-	// TODO: currently is a noop, in future we may want to unsubscribe and
-	// inform the other side that we are closing the connection
-	return nil
+	if r.object != nil {
+		return r.object.Close()
+	}
+	if r.hasEnded {
+		return nil
+	}
+	r.hasEnded = true
+	r.isAbandoned = true
+	return r.bodyReceiver.sendClosed()
+}
+
+// deleteAbandonedObject deletes the object holding the request body if the
+// body was offloaded to the object store, but closed before it was opened.
+// An offloaded body is sent as a lone EOF chunk naming the object, so only
+// the first chunk is waited for, and only if no chunks have arrived yet.
+func (r *requestReader) deleteAbandonedObject() {
+	if !r.isAbandoned || r.bodyReceiver.nextIndex > 0 || r.transport.objectStore == nil {
+		return
+	}
+	bodyChunk, err := r.bodyReceiver.next(context.Background())
+	if err != nil {
+		transportNatsDispatchDebug.Tracef("Failed to receive abandoned request body: %v", err)
+		return
+	}
+	if bodyChunk.IsEOF && bodyChunk.BodyObject != "" {
+		transportNatsDispatchDebug.Tracef("Deleting abandoned request body object %s", bodyChunk.BodyObject)
+		r.transport.deleteBodyObject(bodyChunk.BodyObject)
+	}
 }
 
 type responseWriter struct {
-	responseSubject     string
-	responseBodySubject string
-	natsConnection      *nats.Conn
-	header              http.Header
-	statusCode          int
-	hasSentHeaders      bool
-	writeIndex          int
-	buffer              bytes.Buffer
-	err                 error
+	transport         *NatsTransport
+	responseSubject   string
+	tunnelSubject     string
+	remoteObjectStore string
+	natsConnection    *nats.Conn
+	wireMode          WireMode
+	bodySender        *bodySender
+	header            http.Header
+	statusCode        int
+	hasSentHeaders    bool
+	isHijacked        bool
+	isInline          bool
+	hasCheckedOffload bool
+	buffer            bytes.Buffer
+	object            *bodyObjectWriter
+	err               error
+	handlerError      *ResponseError
 }
 
+var _ http.Hijacker = &responseWriter{}
+var _ http.Flusher = &responseWriter{}
+
 func (r *responseWriter) Header() http.Header {
 	return r.header
 }
 
+// WriteHeader sets the status code of the response. As with net/http, calls
+// after the status code has been set, including implicitly by Write, are
+// ignored.
 func (r *responseWriter) WriteHeader(statusCode int) {
 	if r.statusCode != 0 {
-		panic("cannot write headers twice")
+		transportNatsDispatchDebug.Tracef("Ignoring superfluous WriteHeader(%d)", statusCode)
+		return
 	}
 	r.statusCode = statusCode
 }
 
 func (r *responseWriter) Write(p []byte) (int, error) {
+	if r.isHijacked {
+		return 0, http.ErrHijacked
+	}
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	if !r.hasCheckedOffload {
+		r.checkOffload()
+	}
+	if r.canInline(len(p)) {
+		return r.buffer.Write(p)
+	}
 	if err := r.ensureHeadersSent(); err != nil {
 		return 0, err
 	}
+	if r.object != nil {
+		return r.object.Write(p)
+	}
 	n, err := r.buffer.Write(p)
 	if err != nil {
 		return 0, err
@@ -389,33 +790,134 @@ func (r *responseWriter) Write(p []byte) (int, error) {
 	return n, nil
 }
 
+// Flush sends the headers, and any buffered body bytes, to the dispatching
+// side immediately rather than waiting for a full chunk to be buffered.
+func (r *responseWriter) Flush() {
+	if r.isHijacked {
+		return
+	}
+	if err := r.ensureHeadersSent(); err != nil {
+		transportNatsDispatchDebug.Tracef("Failed to send headers on flush: %v", err)
+		r.WriteError(err)
+		return
+	}
+	if r.object != nil {
+		return
+	}
+	for r.buffer.Len() > 0 {
+		if err := r.writeChunk(); err != nil {
+			transportNatsDispatchDebug.Tracef("Failed to send body chunk on flush: %v", err)
+			r.WriteError(err)
+			return
+		}
+	}
+}
+
 func (r *responseWriter) WriteError(err error) {
 	r.err = err
 }
 
+// Hijack takes over the connection of an upgrade request. The returned
+// connection is tunnelled over NATS to the dispatching side, which hijacks the
+// client's connection in turn.
+func (r *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.isHijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	if r.hasSentHeaders {
+		return nil, nil, errors.New("cannot hijack connection after headers have been sent")
+	}
+	if r.tunnelSubject == "" {
+		return nil, nil, zephyr.ErrHijackUnsupported
+	}
+
+	transportNatsTunnelDebug.Trace("Hijacking connection")
+	tunnelInbox, err := r.transport.newInbox()
+	if err != nil {
+		transportNatsTunnelDebug.Tracef("Failed to create tunnel inbox: %v", err)
+		return nil, nil, err
+	}
+
+	response := &Response{
+		Hijacked:      true,
+		TunnelSubject: tunnelInbox.subject,
+	}
+	if err := publishWireMsg(r.natsConnection, r.wireMode, r.responseSubject, response); err != nil {
+		tunnelInbox.close()
+		return nil, nil, err
+	}
+	r.hasSentHeaders = true
+	r.isHijacked = true
+
+	conn := newTunnelConn(r.natsConnection, r.wireMode, tunnelInbox, r.tunnelSubject)
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
 func (r *responseWriter) End() error {
+	if r.isHijacked {
+		return nil
+	}
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	if r.handlerError != nil && !r.hasSentHeaders {
+		r.hasSentHeaders = true
+		response := &Response{
+			Error:        r.handlerError.Message,
+			HandlerError: r.handlerError,
+		}
+		return publishWireMsg(r.natsConnection, r.wireMode, r.responseSubject, response)
+	}
+	if r.canInline(0) && r.err == nil {
+		r.hasSentHeaders = true
+		trailers := responseTrailers(r.header)
+		response := &Response{
+			StatusCode: r.statusCode,
+			Header:     headerWithoutTrailers(r.header, trailers),
+			InlineBody: true,
+			Body:       r.buffer.Bytes(),
+			Trailer:    trailers,
+		}
+		return publishWireMsg(r.natsConnection, r.wireMode, r.responseSubject, response)
+	}
 	if err := r.ensureHeadersSent(); err != nil {
 		return err
 	}
-	if r.buffer.Len() > 0 {
+	for r.buffer.Len() > 0 {
 		if err := r.writeChunk(); err != nil {
 			return err
 		}
 	}
 
 	bodyChunk := &BodyChunk{
-		Index: r.writeIndex,
-		IsEOF: true,
+		IsEOF:        true,
+		Trailer:      responseTrailers(r.header),
+		HandlerError: r.handlerError,
+	}
+	if r.object != nil {
+		if r.handlerError != nil {
+			r.object.abort(errors.New(r.handlerError.Message))
+		} else if err := r.object.Close(); err != nil {
+			r.WriteError(err)
+		} else {
+			bodyChunk.BodyObject = r.object.name
+		}
 	}
-	if r.err != nil {
+	switch {
+	case r.handlerError != nil:
+		bodyChunk.Error = r.handlerError.Message
+	case r.err != nil:
 		bodyChunk.Error = r.err.Error()
 	}
-	bodyChunkBytes, err := msgpack.Marshal(bodyChunk)
-	if err != nil {
+	if err := r.bodySender.send(context.Background(), bodyChunk); err != nil {
+		// The dispatching side will never read the object, so it is deleted
+		// here rather than left behind.
+		if bodyChunk.BodyObject != "" {
+			r.transport.deleteBodyObject(bodyChunk.BodyObject)
+		}
 		return err
 	}
-
-	return r.natsConnection.Publish(r.responseBodySubject, bodyChunkBytes)
+	return nil
 }
 
 func (r *responseWriter) ensureHeadersSent() error {
@@ -423,6 +925,9 @@ func (r *responseWriter) ensureHeadersSent() error {
 		return nil
 	}
 	r.hasSentHeaders = true
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
 
 	headers := map[string][]string{}
 	for key, values := range r.header {
@@ -432,66 +937,135 @@ func (r *responseWriter) ensureHeadersSent() error {
 		StatusCode: r.statusCode,
 		Header:     headers,
 	}
-	responseBytes, err := msgpack.Marshal(response)
-	if err != nil {
-		return err
+	if r.isInline && r.bodySender.window > 0 {
+		// The response to a request with an inline body is not acknowledged,
+		// so the credit subject is sent with the headers instead.
+		creditInbox, err := r.transport.newInbox()
+		if err != nil {
+			return err
+		}
+		response.CreditSubject = creditInbox.subject
+		r.bodySender.creditInbox = creditInbox
 	}
+	return publishWireMsg(r.natsConnection, r.wireMode, r.responseSubject, response)
+}
+
+// canInline reports whether the response can still be sent as a single reply
+// once n more body bytes are written to it.
+func (r *responseWriter) canInline(n int) bool {
+	return r.isInline && !r.hasSentHeaders && r.object == nil && r.buffer.Len()+n <= DispatchBodyChunkSize
+}
 
-	return r.natsConnection.Publish(r.responseSubject, responseBytes)
+// checkOffload decides, as the body starts being written, whether to write it
+// to the object store rather than streaming it as body chunks.
+func (r *responseWriter) checkOffload() {
+	r.hasCheckedOffload = true
+	contentLength, err := strconv.ParseInt(r.header.Get("Content-Length"), 10, 64)
+	if err != nil || !r.transport.shouldOffload(contentLength, r.remoteObjectStore) {
+		return
+	}
+	transportNatsDispatchDebug.Tracef("Offloading response body of %d bytes to the object store", contentLength)
+	r.object = r.transport.newBodyObjectWriter()
 }
 
 func (r *responseWriter) writeChunk() error {
-	bodyChunkBytes, err := msgpack.Marshal(&BodyChunk{
-		Index: r.writeIndex,
-		Data:  r.buffer.Next(DispatchBodyChunkSize),
+	return r.bodySender.send(context.Background(), &BodyChunk{
+		Data: r.buffer.Next(DispatchBodyChunkSize),
 	})
-	if err != nil {
-		return err
-	}
-	if err := r.natsConnection.Publish(r.responseBodySubject, bodyChunkBytes); err != nil {
-		return err
-	}
-	r.writeIndex += 1
-	return nil
 }
 
 func (c *NatsTransport) handleDispatch(msg *nats.Msg, handler func(res http.ResponseWriter, req *http.Request)) error {
 	transportNatsDispatchDebug.Trace("Handling dispatched request")
-	responseBodySubject := nats.NewInbox()
 
+	// Answer in the mode the request was sent in, so the dispatching side
+	// decides which mode is used.
+	wireMode := wireModeOf(msg)
 	request := &Request{}
-	if err := msgpack.Unmarshal(msg.Data, request); err != nil {
-		transportNatsDispatchDebug.Tracef("Failed to unmarshal request: %v", err)
+	if err := decodeWireMsg(msg, request); err != nil {
+		transportNatsDispatchDebug.Tracef("Failed to decode request: %v", err)
 		return err
 	}
 
 	transportNatsDispatchDebug.Tracef("Received request: %s %s", request.Method, request.URL)
-	
+
 	reqUrl, err := url.Parse(request.URL)
 	if err != nil {
 		transportNatsDispatchDebug.Tracef("Failed to parse URL: %v", err)
 		return err
 	}
 
-	reqBodySubscription, err := c.NatsConnection.SubscribeSync(responseBodySubject)
-	if err != nil {
-		transportNatsDispatchDebug.Tracef("Failed to subscribe to request body subject: %v", err)
-		return err
+	// The trailer map is always allocated, as the request may be copied by
+	// the handler before the trailers arrive with the end of the body.
+	trailer := http.Header{}
+	for key, values := range request.Trailers {
+		trailer[key] = values
 	}
 
 	reqReader := &requestReader{
-		natsSubscription: reqBodySubscription,
-		buffer:           bytes.Buffer{},
+		transport: c,
+		trailer:   trailer,
+		buffer:    bytes.Buffer{},
+	}
+
+	resBodySender := &bodySender{
+		natsConnection: c.NatsConnection,
+		wireMode:       wireMode,
+		subject:        request.ResponseBodySubject,
+		window:         request.BodyWindow,
+		idleTimeout:    c.dispatchIdleTimeout(),
 	}
+	defer resBodySender.close()
 
 	res := &responseWriter{
-		responseSubject:     request.ResponseSubject,
-		responseBodySubject: request.ResponseBodySubject,
-		natsConnection:      c.NatsConnection,
-		header:              map[string][]string{},
-		buffer:              bytes.Buffer{},
+		transport:         c,
+		responseSubject:   request.ResponseSubject,
+		tunnelSubject:     request.TunnelSubject,
+		remoteObjectStore: request.ObjectStore,
+		natsConnection:    c.NatsConnection,
+		wireMode:          wireMode,
+		bodySender:        resBodySender,
+		header:            map[string][]string{},
+		buffer:            bytes.Buffer{},
+	}
+
+	// A request with an inline body needs no acknowledgment, and its response
+	// is sent in reply to the request, inline too if it is small enough.
+	var requestAck *RequestAck
+	if request.InlineBody {
+		transportNatsDispatchDebug.Tracef("Request has inline body of %d bytes", len(request.Body))
+		reqReader.hasEnded = true
+		reqReader.buffer.Write(request.Body)
+		res.responseSubject = msg.Reply
+		res.isInline = true
+	} else {
+		reqBodyInbox, err := c.newInbox()
+		if err != nil {
+			transportNatsDispatchDebug.Tracef("Failed to create request body inbox: %v", err)
+			return err
+		}
+		defer reqBodyInbox.close()
+		reqReader.bodyReceiver = &bodyReceiver{
+			natsConnection: c.NatsConnection,
+			wireMode:       wireMode,
+			inbox:          reqBodyInbox,
+			creditSubject:  request.CreditSubject,
+			window:         c.dispatchBodyWindow(),
+			idleTimeout:    c.dispatchIdleTimeout(),
+		}
+
+		requestAck = &RequestAck{
+			RequestBodySubject: reqBodyInbox.subject,
+			BodyWindow:         reqReader.bodyReceiver.window,
+			ObjectStore:        c.objectStoreBucket,
+		}
+		if request.BodyWindow > 0 {
+			if resBodySender.creditInbox, err = c.newInbox(); err != nil {
+				transportNatsDispatchDebug.Tracef("Failed to create response body credit inbox: %v", err)
+				return err
+			}
+			requestAck.CreditSubject = resBodySender.creditInbox.subject
+		}
 	}
-	
 	transportNatsDispatchDebug.Trace("Set up response writer and request reader")
 
 	req := &http.Request{
@@ -504,7 +1078,7 @@ func (c *NatsTransport) handleDispatch(msg *nats.Msg, handler func(res http.Resp
 		ContentLength:    request.ContentLength,
 		TransferEncoding: request.TransferEncoding,
 		Host:             request.Host,
-		Trailer:          request.Trailers,
+		Trailer:          trailer,
 		RemoteAddr:       request.RemoteAddr,
 		RequestURI:       request.RequestURI,
 		Body:             reqReader,
@@ -524,33 +1098,40 @@ func (c *NatsTransport) handleDispatch(msg *nats.Msg, handler func(res http.Resp
 		}
 	}
 
-	requestAck := &RequestAck{
-		RequestBodySubject: responseBodySubject,
-	}
-	requestAckBytes, err := msgpack.Marshal(requestAck)
-	if err != nil {
-		return err
-	}
-	if err := c.NatsConnection.Publish(msg.Reply, requestAckBytes); err != nil {
-		return err
+	if requestAck != nil {
+		if err := publishWireMsg(c.NatsConnection, wireMode, msg.Reply, requestAck); err != nil {
+			return err
+		}
 	}
 
 	transportNatsDispatchDebug.Trace("Processing request with handler")
 	func() {
 		defer func() {
-			if err := recover(); err != nil {
-				transportNatsDispatchDebug.Tracef("Recovered from panic in handler: %v", err)
-				res.WriteError(err.(error))
+			if recovered := recover(); recovered != nil {
+				transportNatsDispatchDebug.Tracef("Recovered from panic in handler: %v", recovered)
+				remoteErr := zephyr.NewRemoteError(recovered)
+				res.handlerError = &ResponseError{
+					Message: remoteErr.Message,
+					Stack:   remoteErr.Stack,
+				}
 			}
 		}()
 
 		handler(res, req)
 	}()
-	
+
+	if err := reqReader.Close(); err != nil {
+		transportNatsDispatchDebug.Tracef("Failed to close request body: %v", err)
+	}
+
 	transportNatsDispatchDebug.Trace("Handler completed, sending response")
-	if err := res.End(); err != nil {
-		transportNatsDispatchDebug.Tracef("Failed to end response: %v", err)
-		return err
+	endErr := res.End()
+	if reqReader.bodyReceiver != nil {
+		reqReader.deleteAbandonedObject()
+	}
+	if endErr != nil {
+		transportNatsDispatchDebug.Tracef("Failed to end response: %v", endErr)
+		return endErr
 	}
 
 	transportNatsDispatchDebug.Trace("Request handling completed successfully")
@@ -569,6 +1150,58 @@ func (c *NatsTransport) UnbindDispatch(serviceName string) error {
 	return nil
 }
 
+func (c *NatsTransport) dispatchTimeout() time.Duration {
+	if c.DispatchTimeout != 0 {
+		return c.DispatchTimeout
+	}
+	return DispatchTimeout
+}
+
+func (c *NatsTransport) dispatchIdleTimeout() time.Duration {
+	if c.DispatchIdleTimeout != 0 {
+		return c.DispatchIdleTimeout
+	}
+	return DispatchIdleTimeout
+}
+
+func (c *NatsTransport) dispatchBodyWindow() int {
+	if c.DispatchBodyWindow > 0 {
+		return c.DispatchBodyWindow
+	}
+	return DispatchBodyWindow
+}
+
+// nextMsg waits for the next message sent to the inbox, giving up after
+// the timeout, or once ctx is done, for example because the client went away.
+func nextMsg(ctx context.Context, inbox *inbox, timeout time.Duration) (*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	msg, err := inbox.next(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, nats.ErrTimeout
+	}
+	return msg, err
+}
+
+// dispatchError returns the cause of ctx being cancelled in place of err, so
+// a failure to send the request body is reported rather than the
+// cancellation it caused.
+func dispatchError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+		return cause
+	}
+	return err
+}
+
+// flushResponse flushes res if it supports flushing, so streamed chunks reach
+// the client as soon as they arrive.
+func flushResponse(res http.ResponseWriter) {
+	err := http.NewResponseController(res).Flush()
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		transportNatsDispatchDebug.Tracef("Failed to flush response: %v", err)
+	}
+}
+
 type eofReader struct{}
 
 var _ io.ReadCloser = &eofReader{}
@@ -580,3 +1213,59 @@ func (r *eofReader) Read(p []byte) (int, error) {
 func (r *eofReader) Close() error {
 	return nil
 }
+
+// responseTrailers collects the trailers set by a handler once it has
+// finished writing its response. These are the keys announced in the Trailer
+// header, and any keys prefixed with http.TrailerPrefix.
+func responseTrailers(header http.Header) map[string][]string {
+	var trailers map[string][]string
+	setTrailer := func(key string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		if trailers == nil {
+			trailers = map[string][]string{}
+		}
+		trailers[key] = append(trailers[key], values...)
+	}
+	for _, announced := range header.Values("Trailer") {
+		for _, key := range strings.Split(announced, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+			if key != "" {
+				setTrailer(key, header[key])
+			}
+		}
+	}
+	for key, values := range header {
+		if trailerKey, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			setTrailer(http.CanonicalHeaderKey(trailerKey), values)
+		}
+	}
+	return trailers
+}
+
+// headerWithoutTrailers copies a handler's header map without the trailers
+// collected from it, so trailers sent inline with a response are not also
+// sent as headers.
+func headerWithoutTrailers(header http.Header, trailers map[string][]string) map[string][]string {
+	headers := map[string][]string{}
+	for key, values := range header {
+		if _, ok := trailers[key]; ok {
+			continue
+		}
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			continue
+		}
+		headers[key] = values
+	}
+	return headers
+}
+
+// setResponseTrailers sets trailers received from a service on the header
+// map of the dispatching side's response writer. http.TrailerPrefix is used so
+// the trailers are sent whether or not they were announced.
+func setResponseTrailers(header http.Header, trailers map[string][]string) {
+	for key, values := range trailers {
+		header[http.TrailerPrefix+key] = values
+	}
+}
@@ -0,0 +1,102 @@
+package natstransport
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseTrailers(t *testing.T) {
+	t.Run("Collects announced trailers", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Trailer", "Checksum, row-count")
+		header.Set("Content-Type", "text/plain")
+		header.Set("Checksum", "abc123")
+		header.Set("Row-Count", "7")
+
+		assert.Equal(t, map[string][]string{
+			"Checksum":  {"abc123"},
+			"Row-Count": {"7"},
+		}, responseTrailers(header))
+	})
+
+	t.Run("Collects trailers set with the trailer prefix", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Content-Type", "text/plain")
+		header[http.TrailerPrefix+"Checksum"] = []string{"abc123"}
+
+		assert.Equal(t, map[string][]string{
+			"Checksum": {"abc123"},
+		}, responseTrailers(header))
+	})
+
+	t.Run("Skips announced trailers which were never set", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Trailer", "Checksum")
+
+		assert.Nil(t, responseTrailers(header))
+	})
+}
+
+func TestSetResponseTrailers(t *testing.T) {
+	t.Run("Sends received trailers to the client", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		res.Header().Set("Trailer", "Checksum")
+		res.WriteHeader(200)
+		_, err := res.Write([]byte("test response"))
+		assert.NoError(t, err)
+
+		setResponseTrailers(res.Header(), map[string][]string{
+			"Checksum":  {"abc123"},
+			"Row-Count": {"7"},
+		})
+
+		result := res.Result()
+		assert.Equal(t, "abc123", result.Trailer.Get("Checksum"))
+		assert.Equal(t, "7", result.Trailer.Get("Row-Count"))
+	})
+}
+
+func TestReadInlineBody(t *testing.T) {
+	t.Run("Reads bodies which fit in a single chunk", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("small body"))
+		inlineBody, isInline, _, err := readInlineBody(req, req.Body)
+		assert.NoError(t, err)
+		assert.True(t, isInline)
+		assert.Equal(t, "small body", string(inlineBody))
+	})
+
+	t.Run("Leaves bodies of unknown length to be streamed", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("small body"))
+		req.ContentLength = -1
+		_, isInline, reqBody, err := readInlineBody(req, req.Body)
+		assert.NoError(t, err)
+		assert.False(t, isInline)
+		body, _ := io.ReadAll(reqBody)
+		assert.Equal(t, "small body", string(body))
+	})
+
+	t.Run("Leaves upgrade requests to be streamed", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		_, isInline, _, err := readInlineBody(req, req.Body)
+		assert.NoError(t, err)
+		assert.False(t, isInline)
+	})
+
+	t.Run("Streams bodies longer than their Content-Length from the start", func(t *testing.T) {
+		sentBody := strings.Repeat("a", DispatchBodyChunkSize*2)
+		req := httptest.NewRequest("POST", "/", strings.NewReader(sentBody))
+		req.ContentLength = 10
+		_, isInline, reqBody, err := readInlineBody(req, req.Body)
+		assert.NoError(t, err)
+		assert.False(t, isInline)
+		body, _ := io.ReadAll(reqBody)
+		assert.Equal(t, sentBody, string(body))
+	})
+}
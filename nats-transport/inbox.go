@@ -0,0 +1,144 @@
+package natstransport
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/telemetrytv/trace"
+)
+
+var (
+	transportNatsInboxDebug = trace.Bind("zephyr:transport:nats:inbox")
+)
+
+// inboxMux receives the messages for every inbox of a transport through a
+// single wildcard subscription, and hands each one to the inbox named by the
+// last token of its subject. This is the same approach nats.Conn.Request takes
+// for replies, and avoids creating a subscription on the server for every
+// subject used by a dispatch.
+type inboxMux struct {
+	mu           sync.Mutex
+	prefix       string
+	subscription *nats.Subscription
+	inboxes      map[string]*inbox
+}
+
+// newInbox creates an inbox with a subject unique to it. The inbox must be
+// closed once it is no longer needed.
+func (c *NatsTransport) newInbox() (*inbox, error) {
+	m := &c.inboxMux
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.subscription == nil {
+		prefix := c.NatsConnection.NewInbox()
+		transportNatsInboxDebug.Tracef("Subscribing to inboxes on %s.*", prefix)
+		subscription, err := c.NatsConnection.Subscribe(prefix+".*", m.deliver)
+		if err != nil {
+			transportNatsInboxDebug.Tracef("Failed to subscribe to inboxes on %s.*: %v", prefix, err)
+			return nil, err
+		}
+		m.prefix = prefix
+		m.subscription = subscription
+		m.inboxes = map[string]*inbox{}
+	}
+
+	token := nuid.Next()
+	i := &inbox{
+		mux:     m,
+		token:   token,
+		subject: m.prefix + "." + token,
+		notify:  make(chan struct{}, 1),
+	}
+	m.inboxes[token] = i
+	return i, nil
+}
+
+func (m *inboxMux) deliver(msg *nats.Msg) {
+	token := msg.Subject[strings.LastIndexByte(msg.Subject, '.')+1:]
+	m.mu.Lock()
+	i, ok := m.inboxes[token]
+	m.mu.Unlock()
+	if !ok {
+		transportNatsInboxDebug.Tracef("Dropping message for closed inbox %s", msg.Subject)
+		return
+	}
+	i.push(msg)
+}
+
+// inbox queues the messages sent to its subject until they are read with
+// next. Like a synchronous subscription, the queue is not bounded, so senders
+// which could outpace the reader must be flow controlled.
+type inbox struct {
+	mux     *inboxMux
+	token   string
+	subject string
+
+	mu       sync.Mutex
+	queue    []*nats.Msg
+	isClosed bool
+	notify   chan struct{}
+}
+
+func (i *inbox) push(msg *nats.Msg) {
+	i.mu.Lock()
+	if !i.isClosed {
+		i.queue = append(i.queue, msg)
+	}
+	i.mu.Unlock()
+	select {
+	case i.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next message sent to the inbox, waiting until one arrives
+// or ctx is done.
+func (i *inbox) next(ctx context.Context) (*nats.Msg, error) {
+	for {
+		i.mu.Lock()
+		if i.isClosed {
+			i.mu.Unlock()
+			return nil, nats.ErrBadSubscription
+		}
+		if len(i.queue) != 0 {
+			msg := i.queue[0]
+			i.queue[0] = nil
+			i.queue = i.queue[1:]
+			i.mu.Unlock()
+			return msg, nil
+		}
+		i.mu.Unlock()
+
+		select {
+		case <-i.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// close stops the inbox from receiving messages. It is safe to close an inbox
+// more than once.
+func (i *inbox) close() {
+	i.mu.Lock()
+	if i.isClosed {
+		i.mu.Unlock()
+		return
+	}
+	i.isClosed = true
+	i.queue = nil
+	i.mu.Unlock()
+
+	i.mux.mu.Lock()
+	delete(i.mux.inboxes, i.token)
+	i.mux.mu.Unlock()
+
+	select {
+	case i.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,67 @@
+package natstransport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInboxMux(t *testing.T) {
+	newInbox := func(m *inboxMux, token string) *inbox {
+		i := &inbox{mux: m, token: token, subject: m.prefix + "." + token, notify: make(chan struct{}, 1)}
+		m.inboxes[token] = i
+		return i
+	}
+
+	t.Run("Delivers messages to the inbox named by their subject", func(t *testing.T) {
+		m := &inboxMux{prefix: "_INBOX.test", inboxes: map[string]*inbox{}}
+		a := newInbox(m, "a")
+		b := newInbox(m, "b")
+
+		m.deliver(&nats.Msg{Subject: "_INBOX.test.b", Data: []byte("1")})
+		m.deliver(&nats.Msg{Subject: "_INBOX.test.a", Data: []byte("2")})
+		m.deliver(&nats.Msg{Subject: "_INBOX.test.b", Data: []byte("3")})
+
+		msg, err := a.next(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "2", string(msg.Data))
+		for _, expected := range []string{"1", "3"} {
+			msg, err := b.next(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, expected, string(msg.Data))
+		}
+	})
+
+	t.Run("Waits for messages until the context is done", func(t *testing.T) {
+		m := &inboxMux{prefix: "_INBOX.test", inboxes: map[string]*inbox{}}
+		a := newInbox(m, "a")
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			m.deliver(&nats.Msg{Subject: "_INBOX.test.a", Data: []byte("late")})
+		}()
+		msg, err := a.next(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "late", string(msg.Data))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = a.next(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("Forgets closed inboxes", func(t *testing.T) {
+		m := &inboxMux{prefix: "_INBOX.test", inboxes: map[string]*inbox{}}
+		a := newInbox(m, "a")
+		a.close()
+		a.close()
+
+		assert.Empty(t, m.inboxes)
+		m.deliver(&nats.Msg{Subject: "_INBOX.test.a"})
+		_, err := a.next(context.Background())
+		assert.ErrorIs(t, err, nats.ErrBadSubscription)
+	})
+}
@@ -5,10 +5,17 @@ import (
 	"unicode"
 )
 
+// NatsSubjectNamespace is the default subject prefix, used when no
+// SubjectPrefix is given in the transport's Options.
 const NatsSubjectNamespace = "zephyr"
 
-func namespace(strValues ...string) string {
-	namespaceChunks := []string{NatsSubjectNamespace}
+// namespace builds a subject under the transport's subject prefix.
+func (c *NatsTransport) namespace(strValues ...string) string {
+	subjectPrefix := c.SubjectPrefix
+	if subjectPrefix == "" {
+		subjectPrefix = NatsSubjectNamespace
+	}
+	namespaceChunks := []string{subjectPrefix}
 	for _, str := range strValues {
 		if str != "" {
 			namespaceChunks = append(namespaceChunks, formatForNamespace(str))
@@ -0,0 +1,19 @@
+package natstransport
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNatsTransport_namespace(t *testing.T) {
+	t.Run("Uses the default prefix", func(t *testing.T) {
+		transport := New(nil)
+		assert.Equal(t, "zephyr.service.test-service", transport.namespace("service", "testService"))
+	})
+
+	t.Run("Uses the configured prefix", func(t *testing.T) {
+		transport := New(nil, Options{SubjectPrefix: "staging.zephyr"})
+		assert.Equal(t, "staging.zephyr.service.announce", transport.namespace("service.announce"))
+	})
+}
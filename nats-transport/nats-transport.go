@@ -1,22 +1,99 @@
 package natstransport
 
 import (
+	"time"
+
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
 	"github.com/telemetrytv/zephyr"
 )
 
+// Options configures a NatsTransport. Any field left as its zero value falls
+// back to its default.
+type Options struct {
+
+	// SubjectPrefix is prepended to every subject the transport announces and
+	// dispatches on. Gateways and services only see each other if their
+	// transports share the same prefix, which allows separate environments or
+	// tenants to share a NATS cluster. If empty, NatsSubjectNamespace is used.
+	SubjectPrefix string
+
+	// DispatchTimeout is how long to wait for a service to accept a request,
+	// and to respond with its status and headers. If zero, the DispatchTimeout
+	// constant is used.
+	DispatchTimeout time.Duration
+
+	// DispatchIdleTimeout is how long to wait between body chunks while a
+	// request or response body is streaming. If zero, the
+	// DispatchIdleTimeout constant is used.
+	DispatchIdleTimeout time.Duration
+
+	// DispatchBodyWindow is the number of body chunks a sender may have in
+	// flight before waiting for the receiver to consume them. If zero, the
+	// DispatchBodyWindow constant is used.
+	DispatchBodyWindow int
+
+	// LargeBodyThreshold is the size, in bytes, above which bodies are
+	// offloaded to the object store enabled with UseObjectStore. If zero, the
+	// LargeBodyThreshold constant is used.
+	LargeBodyThreshold int64
+
+	// WireMode selects how requests dispatched by the transport are encoded.
+	// Requests handled by the transport are answered in the mode they were
+	// sent in, whatever this is set to. If zero, WireModeMsgpack is used.
+	WireMode WireMode
+
+	// InstanceID identifies this transport's instance of the services bound
+	// to it, allowing requests to be dispatched to it in particular. Giving
+	// each instance a stable ID, such as its host name, keeps sticky routing
+	// to it intact across restarts. It is used in subjects, so must not
+	// contain spaces or wildcards. If empty, a unique ID is generated.
+	InstanceID string
+}
+
 type NatsTransport struct {
-	NatsConnection        *nats.Conn
+	Options
+	NatsConnection *nats.Conn
+
+	inboxMux              inboxMux
+	objectStore           jetstream.ObjectStore
+	objectStoreBucket     string
 	unbindDispatch        map[string][]func() error
 	unbindServiceAnnounce func() error
 	unbindGatewayAnnounce func() error
 }
 
 var _ zephyr.Transport = &NatsTransport{}
+var _ zephyr.InstanceDispatcher = &NatsTransport{}
 
-func New(natsConnection *nats.Conn) *NatsTransport {
-	return &NatsTransport{
+// New creates a NatsTransport using the given connection. Options may be
+// given to configure the transport, otherwise the defaults are used.
+func New(natsConnection *nats.Conn, options ...Options) *NatsTransport {
+	transport := &NatsTransport{
 		NatsConnection: natsConnection,
 		unbindDispatch: map[string][]func() error{},
 	}
+	if len(options) > 0 {
+		transport.Options = options[0]
+	}
+	if transport.SubjectPrefix == "" {
+		transport.SubjectPrefix = NatsSubjectNamespace
+	}
+	if transport.DispatchTimeout == 0 {
+		transport.DispatchTimeout = DispatchTimeout
+	}
+	if transport.DispatchIdleTimeout == 0 {
+		transport.DispatchIdleTimeout = DispatchIdleTimeout
+	}
+	if transport.DispatchBodyWindow == 0 {
+		transport.DispatchBodyWindow = DispatchBodyWindow
+	}
+	if transport.Options.InstanceID == "" {
+		transport.Options.InstanceID = nuid.Next()
+	}
+	if transport.LargeBodyThreshold == 0 {
+		transport.LargeBodyThreshold = LargeBodyThreshold
+	}
+	return transport
 }
@@ -0,0 +1,688 @@
+package natstransport_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+	natstransport "github.com/telemetrytv/zephyr/nats-transport"
+	"github.com/telemetrytv/zephyr/nats-transport/natstest"
+	"github.com/telemetrytv/zephyr/transporttest"
+)
+
+func TestNatsTransport_SubjectPrefix(t *testing.T) {
+	newTransports := func(t *testing.T) (*natstransport.NatsTransport, *natstransport.NatsTransport) {
+		natsConnection := natstest.Connect(t)
+		transportA := natstransport.New(natsConnection, natstransport.Options{
+			SubjectPrefix:   "tenant-a",
+			DispatchTimeout: 200 * time.Millisecond,
+		})
+		transportB := natstransport.New(natsConnection, natstransport.Options{
+			SubjectPrefix:   "tenant-b",
+			DispatchTimeout: 200 * time.Millisecond,
+		})
+		return transportA, transportB
+	}
+
+	t.Run("Does not deliver announcements across prefixes", func(t *testing.T) {
+		transportA, transportB := newTransports(t)
+
+		var announcesA, announcesB atomic.Int32
+		require.NoError(t, transportA.BindServiceAnnounce(func(*zephyr.ServiceDescriptor) { announcesA.Add(1) }))
+		require.NoError(t, transportB.BindServiceAnnounce(func(*zephyr.ServiceDescriptor) { announcesB.Add(1) }))
+		require.NoError(t, transportA.BindGatewayAnnounce(func(*zephyr.GatewayDescriptor) { announcesA.Add(1) }))
+		require.NoError(t, transportB.BindGatewayAnnounce(func(*zephyr.GatewayDescriptor) { announcesB.Add(1) }))
+		t.Cleanup(func() {
+			transportA.UnbindServiceAnnounce()
+			transportB.UnbindServiceAnnounce()
+			transportA.UnbindGatewayAnnounce()
+			transportB.UnbindGatewayAnnounce()
+		})
+
+		require.NoError(t, transportA.AnnounceService(&zephyr.ServiceDescriptor{Name: "testService"}))
+		require.NoError(t, transportA.AnnounceGateway(&zephyr.GatewayDescriptor{Name: "testGateway"}))
+
+		assert.Eventually(t, func() bool { return announcesA.Load() == 2 }, time.Second, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, int32(0), announcesB.Load())
+	})
+
+	t.Run("Does not dispatch across prefixes", func(t *testing.T) {
+		transportA, transportB := newTransports(t)
+
+		handlerCalled := false
+		s := zephyr.NewService("testService", transportA, func(ctx *navaros.Context) {
+			handlerCalled = true
+			ctx.Body = "tenant a"
+		})
+		require.NoError(t, s.Start())
+		t.Cleanup(s.Stop)
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		assert.Error(t, transportB.Dispatch("testService", res, req))
+		assert.False(t, handlerCalled)
+
+		res = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/", nil)
+		require.NoError(t, transportA.Dispatch("testService", res, req))
+		assert.True(t, handlerCalled)
+		assert.Equal(t, "tenant a", res.Body.String())
+	})
+}
+
+func TestNatsTransport_WireMode(t *testing.T) {
+	t.Run("Dispatches requests with native NATS headers", func(t *testing.T) {
+		natsConnection := natstest.Connect(t)
+
+		gatewayTransport := natstransport.New(natsConnection, natstransport.Options{
+			WireMode: natstransport.WireModeHeaders,
+		})
+		serviceTransport := natstransport.New(natsConnection)
+
+		var recvBody []byte
+		s := zephyr.NewService("testService", serviceTransport, func(ctx *navaros.Context) {
+			recvBody, _ = io.ReadAll(ctx.Request().Body)
+			ctx.Headers.Set("Content-Type", "text/plain")
+			ctx.Body = "hello " + string(recvBody)
+		})
+		require.NoError(t, s.Start())
+		t.Cleanup(s.Stop)
+
+		requestMsgs, err := natsConnection.SubscribeSync("zephyr.service.test-service")
+		require.NoError(t, err)
+		t.Cleanup(func() { requestMsgs.Unsubscribe() })
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/greet", strings.NewReader("world"))
+		req.Header.Set("X-Request-Id", "abc123")
+		require.NoError(t, gatewayTransport.Dispatch("testService", res, req))
+
+		assert.Equal(t, "world", string(recvBody))
+		assert.Equal(t, 200, res.Code)
+		assert.Equal(t, "text/plain", res.Header().Get("Content-Type"))
+		assert.Equal(t, "hello world", res.Body.String())
+
+		requestMsg, err := requestMsgs.NextMsg(time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, "POST", requestMsg.Header.Get("Zephyr-Method"))
+		assert.Equal(t, "/greet", requestMsg.Header.Get("Zephyr-Url"))
+		assert.Equal(t, "abc123", requestMsg.Header.Get("X-Request-Id"))
+	})
+}
+
+func TestNatsTransport_InlineBody(t *testing.T) {
+	startService := func(t *testing.T, transport *natstransport.NatsTransport, handler func(ctx *navaros.Context)) {
+		s := zephyr.NewService("testService", transport, handler)
+		require.NoError(t, s.Start())
+		t.Cleanup(s.Stop)
+	}
+
+	t.Run("Answers small requests with a single reply", func(t *testing.T) {
+		natsConnection := natstest.Connect(t)
+		transport := natstransport.New(natsConnection)
+
+		var recvBody []byte
+		startService(t, transport, func(ctx *navaros.Context) {
+			recvBody, _ = io.ReadAll(ctx.Request().Body)
+			ctx.Status = 201
+			ctx.Body = "created"
+		})
+
+		inboxMsgs, err := natsConnection.SubscribeSync("_INBOX.>")
+		require.NoError(t, err)
+		t.Cleanup(func() { inboxMsgs.Unsubscribe() })
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/items", strings.NewReader(`{"name":"item"}`))
+		require.NoError(t, transport.Dispatch("testService", res, req))
+
+		assert.Equal(t, `{"name":"item"}`, string(recvBody))
+		assert.Equal(t, 201, res.Code)
+		assert.Equal(t, "created", res.Body.String())
+
+		require.NoError(t, natsConnection.Flush())
+		pending, _, err := inboxMsgs.Pending()
+		require.NoError(t, err)
+		assert.Equal(t, 1, pending)
+	})
+
+	t.Run("Sends the trailers of small responses only as trailers", func(t *testing.T) {
+		natsConnection := natstest.Connect(t)
+		transport := natstransport.New(natsConnection)
+
+		startService(t, transport, func(ctx *navaros.Context) {
+			res := ctx.ResponseWriter()
+			res.Header().Set("Trailer", "Checksum")
+			res.WriteHeader(200)
+			_, err := res.Write([]byte("small response"))
+			assert.NoError(t, err)
+			res.Header().Set("Checksum", "abc123")
+			res.Header().Set(http.TrailerPrefix+"Row-Count", "7")
+		})
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/items", nil)
+		require.NoError(t, transport.Dispatch("testService", res, req))
+
+		result := res.Result()
+		assert.Equal(t, "small response", res.Body.String())
+		assert.Empty(t, result.Header.Values("Checksum"))
+		assert.Empty(t, result.Header.Values("Row-Count"))
+		assert.Empty(t, result.Header.Values(http.TrailerPrefix+"Row-Count"))
+		assert.Equal(t, "abc123", result.Trailer.Get("Checksum"))
+		assert.Equal(t, "7", result.Trailer.Get("Row-Count"))
+	})
+
+	t.Run("Streams responses which do not fit in a single reply", func(t *testing.T) {
+		natsConnection := natstest.Connect(t)
+		transport := natstransport.New(natsConnection)
+
+		sentBody := strings.Repeat("a", natstransport.DispatchBodyChunkSize*4)
+		startService(t, transport, func(ctx *navaros.Context) {
+			ctx.Body = sentBody
+		})
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/items", nil)
+		require.NoError(t, transport.Dispatch("testService", res, req))
+
+		assert.Equal(t, 200, res.Code)
+		assert.Equal(t, sentBody, res.Body.String())
+	})
+}
+
+func TestNatsTransport_Inboxes(t *testing.T) {
+	t.Run("Does not leave subscriptions behind", func(t *testing.T) {
+		natsConnection := natstest.Connect(t)
+		transport := natstransport.New(natsConnection, natstransport.Options{
+			DispatchTimeout: 200 * time.Millisecond,
+		})
+
+		s := zephyr.NewService("testService", transport, func(ctx *navaros.Context) {
+			ctx.Body = strings.Repeat("a", natstransport.DispatchBodyChunkSize*2)
+		})
+		require.NoError(t, s.Start())
+		t.Cleanup(s.Stop)
+
+		dispatch := func(serviceName string, body string) error {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+			return transport.Dispatch(serviceName, res, req)
+		}
+
+		require.NoError(t, dispatch("testService", "small"))
+		subscriptions := natsConnection.NumSubscriptions()
+
+		for i := 0; i < 10; i += 1 {
+			assert.NoError(t, dispatch("testService", "small"))
+			assert.NoError(t, dispatch("testService", strings.Repeat("b", natstransport.DispatchBodyChunkSize*2)))
+			assert.Error(t, dispatch("missingService", "small"))
+		}
+		assert.Equal(t, subscriptions, natsConnection.NumSubscriptions())
+	})
+}
+
+func TestNatsTransport_Connection(t *testing.T) {
+	t.Run("Reports ready until the connection is closed", func(t *testing.T) {
+		natsConnection := natstest.Connect(t)
+		transport := natstransport.New(natsConnection)
+
+		connectionChanges := make(chan bool, 10)
+		unbind, err := transport.BindConnectionChange(func(isConnected bool) {
+			connectionChanges <- isConnected
+		})
+		require.NoError(t, err)
+		t.Cleanup(unbind)
+
+		assert.NoError(t, transport.Ready())
+
+		natsConnection.Close()
+		assert.ErrorContains(t, transport.Ready(), "closed")
+		select {
+		case isConnected := <-connectionChanges:
+			assert.False(t, isConnected)
+		case <-time.After(time.Second):
+			t.Fatal("connection change handler was not called")
+		}
+	})
+}
+
+func TestNatsTransport_Reconnect(t *testing.T) {
+	t.Run("Re-announces the gateway with its indexed services once reconnected", func(t *testing.T) {
+		server := natstest.Run(t)
+		natsConnection, err := nats.Connect(server.URL(), nats.ReconnectWait(10*time.Millisecond))
+		require.NoError(t, err)
+		t.Cleanup(natsConnection.Close)
+
+		gatewayAnnouncements := make(chan *zephyr.GatewayDescriptor, 10)
+		observer := natstransport.New(natsConnection)
+		require.NoError(t, observer.BindGatewayAnnounce(func(gatewayDescriptor *zephyr.GatewayDescriptor) {
+			gatewayAnnouncements <- gatewayDescriptor
+		}))
+		t.Cleanup(func() { observer.UnbindGatewayAnnounce() })
+
+		g := zephyr.NewGateway("testGateway", natstransport.New(natsConnection))
+		require.NoError(t, g.Start())
+		t.Cleanup(g.Stop)
+		require.NoError(t, observer.AnnounceService(&zephyr.ServiceDescriptor{
+			Name:         "testService",
+			GatewayNames: []string{"testGateway"},
+		}))
+		require.Eventually(t, func() bool {
+			return len(g.ServiceDescriptors()) == 1
+		}, time.Second, 10*time.Millisecond)
+
+	drain:
+		for {
+			select {
+			case <-gatewayAnnouncements:
+			case <-time.After(100 * time.Millisecond):
+				break drain
+			}
+		}
+
+		require.NoError(t, server.Restart())
+
+		select {
+		case gatewayDescriptor := <-gatewayAnnouncements:
+			assert.Equal(t, "testGateway", gatewayDescriptor.Name)
+			require.Len(t, gatewayDescriptor.ServiceDescriptors, 1)
+			assert.Equal(t, "testService", gatewayDescriptor.ServiceDescriptors[0].Name)
+		case <-time.After(5 * time.Second):
+			t.Fatal("gateway was not announced after reconnecting")
+		}
+		assert.NoError(t, g.Ready())
+	})
+}
+
+func TestNatsTransport_DispatchInstance(t *testing.T) {
+	natsConnection := natstest.Connect(t)
+	serviceTransportA := natstransport.New(natsConnection, natstransport.Options{InstanceID: "instance-a"})
+	serviceTransportB := natstransport.New(natsConnection, natstransport.Options{InstanceID: "instance-b"})
+	transport := natstransport.New(natsConnection)
+
+	for _, serviceTransport := range []*natstransport.NatsTransport{serviceTransportA, serviceTransportB} {
+		s := zephyr.NewService("testService", serviceTransport, func(ctx *navaros.Context) {
+			body, _ := io.ReadAll(ctx.RequestBodyReader())
+			ctx.Status = 200
+			ctx.Body = body
+		})
+		require.NoError(t, s.Start())
+		t.Cleanup(s.Stop)
+	}
+
+	t.Run("Dispatches to the instance with the given ID", func(t *testing.T) {
+		for _, instanceID := range []string{"instance-a", "instance-b", "instance-a"} {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/", strings.NewReader("test body"))
+			require.NoError(t, transport.DispatchInstance("testService", instanceID, res, req))
+			assert.Equal(t, instanceID, res.Header().Get(zephyr.InstanceIDHeader))
+			assert.Equal(t, "test body", res.Body.String())
+		}
+	})
+
+	t.Run("Returns the request body intact if the instance is unavailable", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/", strings.NewReader("test body"))
+		err := transport.DispatchInstance("testService", "instance-z", res, req)
+		require.ErrorIs(t, err, zephyr.ErrInstanceUnavailable)
+
+		require.NoError(t, transport.Dispatch("testService", res, req))
+		assert.Equal(t, "test body", res.Body.String())
+	})
+}
+
+func TestNatsTransport_ConcurrentDispatch(t *testing.T) {
+	t.Run("Does not hold up requests behind a slow handler", func(t *testing.T) {
+		natsConnection := natstest.Connect(t)
+		transport := natstransport.New(natsConnection, natstransport.Options{
+			DispatchTimeout: 5 * time.Second,
+		})
+
+		release := make(chan struct{})
+		require.NoError(t, transport.BindDispatch("testService", func(res http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/slow" {
+				<-release
+			}
+			res.WriteHeader(http.StatusNoContent)
+		}))
+		t.Cleanup(func() { transport.UnbindDispatch("testService") })
+
+		slowDone := make(chan error, 1)
+		go func() {
+			slowDone <- transport.Dispatch("testService", httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		start := time.Now()
+		res := httptest.NewRecorder()
+		require.NoError(t, transport.Dispatch("testService", res, httptest.NewRequest("GET", "/fast", nil)))
+		assert.Equal(t, http.StatusNoContent, res.Code)
+		assert.Less(t, time.Since(start), time.Second)
+
+		close(release)
+		assert.NoError(t, <-slowDone)
+	})
+}
+
+func TestNatsTransport_ClientGoesAway(t *testing.T) {
+	t.Run("Stops the service streaming the response", func(t *testing.T) {
+		natsConnection := natstest.Connect(t)
+		transport := natstransport.New(natsConnection, natstransport.Options{
+			DispatchIdleTimeout: 30 * time.Second,
+		})
+
+		writeErr := make(chan error, 1)
+		require.NoError(t, transport.BindDispatch("testService", func(res http.ResponseWriter, req *http.Request) {
+			chunk := []byte(strings.Repeat("a", natstransport.DispatchBodyChunkSize))
+			for {
+				if _, err := res.Write(chunk); err != nil {
+					writeErr <- err
+					return
+				}
+				res.(http.Flusher).Flush()
+			}
+		}))
+		t.Cleanup(func() { transport.UnbindDispatch("testService") })
+
+		ctx, cancel := context.WithCancel(context.Background())
+		res := &cancellingRecorder{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+		req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		assert.ErrorIs(t, transport.Dispatch("testService", res, req), context.Canceled)
+
+		select {
+		case err := <-writeErr:
+			assert.Error(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("service kept streaming after the client went away")
+		}
+	})
+}
+
+// cancellingRecorder cancels the request once the first body bytes are
+// written, as though the client went away mid-response.
+type cancellingRecorder struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (r *cancellingRecorder) Write(p []byte) (int, error) {
+	r.cancel()
+	return r.ResponseRecorder.Write(p)
+}
+
+func TestNatsTransport_Streaming(t *testing.T) {
+	newTransport := func(t *testing.T, options natstransport.Options, handler func(res http.ResponseWriter, req *http.Request)) *natstransport.NatsTransport {
+		transport := natstransport.New(natstest.Connect(t), options)
+		require.NoError(t, transport.BindDispatch("testService", handler))
+		t.Cleanup(func() { transport.UnbindDispatch("testService") })
+		return transport
+	}
+
+	t.Run("Delivers flushed events before the handler returns", func(t *testing.T) {
+		release := make(chan struct{})
+		transport := newTransport(t, natstransport.Options{}, func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Content-Type", "text/event-stream")
+			_, _ = res.Write([]byte("data: first\n\n"))
+			res.(http.Flusher).Flush()
+			<-release
+			_, _ = res.Write([]byte("data: second\n\n"))
+		})
+
+		res := newFlushRecorder()
+		dispatchErr := make(chan error, 1)
+		go func() {
+			dispatchErr <- transport.Dispatch("testService", res, httptest.NewRequest("GET", "/events", nil))
+		}()
+
+		res.waitFor(t, "write data: first\n\n")
+		res.waitFor(t, "flush")
+		close(release)
+
+		require.NoError(t, <-dispatchErr)
+		assert.Equal(t, "text/event-stream", res.Header().Get("Content-Type"))
+		assert.Equal(t, "data: first\n\ndata: second\n\n", res.Body.String())
+	})
+
+	t.Run("Keeps streams alive past DispatchTimeout while chunks keep arriving", func(t *testing.T) {
+		transport := newTransport(t, natstransport.Options{
+			DispatchTimeout:     100 * time.Millisecond,
+			DispatchIdleTimeout: time.Second,
+		}, func(res http.ResponseWriter, req *http.Request) {
+			for range 6 {
+				_, _ = res.Write([]byte("tick\n"))
+				res.(http.Flusher).Flush()
+				time.Sleep(50 * time.Millisecond)
+			}
+		})
+
+		res := newFlushRecorder()
+		require.NoError(t, transport.Dispatch("testService", res, httptest.NewRequest("GET", "/events", nil)))
+		assert.Equal(t, strings.Repeat("tick\n", 6), res.Body.String())
+	})
+
+	t.Run("Expires streams which stall for longer than DispatchIdleTimeout", func(t *testing.T) {
+		release := make(chan struct{})
+		t.Cleanup(func() { close(release) })
+		transport := newTransport(t, natstransport.Options{
+			DispatchTimeout:     5 * time.Second,
+			DispatchIdleTimeout: 100 * time.Millisecond,
+		}, func(res http.ResponseWriter, req *http.Request) {
+			_, _ = res.Write([]byte("tick\n"))
+			res.(http.Flusher).Flush()
+			<-release
+		})
+
+		res := newFlushRecorder()
+		startedAt := time.Now()
+		err := transport.Dispatch("testService", res, httptest.NewRequest("GET", "/events", nil))
+		assert.ErrorIs(t, err, nats.ErrTimeout)
+		assert.Less(t, time.Since(startedAt), 5*time.Second)
+		assert.Equal(t, "tick\n", res.Body.String())
+	})
+}
+
+// flushRecorder records each write and flush as it happens, so tests can
+// check what reached the client before the handler returned.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	events chan string
+}
+
+func newFlushRecorder() *flushRecorder {
+	return &flushRecorder{
+		ResponseRecorder: httptest.NewRecorder(),
+		events:           make(chan string, 64),
+	}
+}
+
+func (r *flushRecorder) Write(p []byte) (int, error) {
+	r.events <- "write " + string(p)
+	return r.ResponseRecorder.Write(p)
+}
+
+func (r *flushRecorder) Flush() {
+	r.events <- "flush"
+	r.ResponseRecorder.Flush()
+}
+
+func (r *flushRecorder) waitFor(t *testing.T, event string) {
+	t.Helper()
+	for {
+		select {
+		case recvEvent := <-r.events:
+			if recvEvent == event {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q never reached the recorder", event)
+		}
+	}
+}
+
+func TestNatsTransport_Upgrade(t *testing.T) {
+	startGateway := func(t *testing.T, handler func(ctx *navaros.Context)) *httptest.Server {
+		natsConnection := natstest.Connect(t)
+
+		g := zephyr.NewGateway("testGateway", natstransport.New(natsConnection))
+		require.NoError(t, g.Start())
+		t.Cleanup(g.Stop)
+
+		router := navaros.NewRouter()
+		router.PublicGet("/echo", handler)
+		s := zephyr.NewService("testService", natstransport.New(natsConnection), router)
+		require.NoError(t, s.Start())
+		t.Cleanup(s.Stop)
+
+		require.Eventually(t, func() bool {
+			return g.CanServeHTTP(httptest.NewRequest("GET", "/echo", nil))
+		}, time.Second, 10*time.Millisecond)
+
+		server := httptest.NewServer(g)
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	upgrade := func(t *testing.T, server *httptest.Server) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+		_, err = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: test\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+		require.NoError(t, err)
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+		return conn, reader
+	}
+
+	switchProtocols := func(t *testing.T, ctx *navaros.Context) (net.Conn, *bufio.ReadWriter, bool) {
+		conn, brw, err := zephyr.Hijack(ctx)
+		if !assert.NoError(t, err) {
+			return nil, nil, false
+		}
+		_, err = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		assert.NoError(t, err)
+		assert.NoError(t, brw.Flush())
+		return conn, brw, true
+	}
+
+	t.Run("Tunnels the connection in both directions until the client closes it", func(t *testing.T) {
+		handlerDone := make(chan struct{})
+		var readErr, writeErr error
+		server := startGateway(t, func(ctx *navaros.Context) {
+			defer close(handlerDone)
+			conn, brw, ok := switchProtocols(t, ctx)
+			if !ok {
+				return
+			}
+			for {
+				line, err := brw.ReadString('\n')
+				if err != nil {
+					readErr = err
+					break
+				}
+				_, _ = brw.WriteString("echo: " + line)
+				_ = brw.Flush()
+			}
+			assert.NoError(t, conn.Close())
+			_, writeErr = conn.Write([]byte("after close"))
+		})
+		conn, reader := upgrade(t, server)
+
+		largeLine := strings.Repeat("a", 3*natstransport.DispatchBodyChunkSize+1) + "\n"
+		for _, line := range []string{"hello\n", largeLine} {
+			_, err := conn.Write([]byte(line))
+			require.NoError(t, err)
+			echoed, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, "echo: "+line, echoed)
+		}
+
+		require.NoError(t, conn.Close())
+		select {
+		case <-handlerDone:
+		case <-time.After(5 * time.Second):
+			t.Fatal("service did not see the client close the connection")
+		}
+		assert.ErrorIs(t, readErr, io.EOF)
+		assert.ErrorIs(t, writeErr, net.ErrClosed)
+	})
+
+	t.Run("Times out reads at the read deadline", func(t *testing.T) {
+		server := startGateway(t, func(ctx *navaros.Context) {
+			conn, brw, ok := switchProtocols(t, ctx)
+			if !ok {
+				return
+			}
+			defer conn.Close()
+
+			assert.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+			_, err := brw.ReadString('\n')
+			assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+			assert.NoError(t, conn.SetReadDeadline(time.Time{}))
+			_, _ = brw.WriteString("timed out\n")
+			_ = brw.Flush()
+			line, err := brw.ReadString('\n')
+			assert.NoError(t, err)
+			_, _ = brw.WriteString("echo: " + line)
+			_ = brw.Flush()
+		})
+		conn, reader := upgrade(t, server)
+
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "timed out\n", line)
+
+		_, err = conn.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "echo: hello\n", line)
+	})
+
+	t.Run("Refuses to hijack requests which are not upgrades", func(t *testing.T) {
+		var hijackErr error
+		server := startGateway(t, func(ctx *navaros.Context) {
+			_, _, hijackErr = zephyr.Hijack(ctx)
+			ctx.Status = http.StatusNoContent
+		})
+
+		res, err := http.Get(server.URL + "/echo")
+		require.NoError(t, err)
+		res.Body.Close()
+
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+		assert.ErrorIs(t, hijackErr, zephyr.ErrHijackUnsupported)
+	})
+}
+
+func TestNatsTransport_Conformance(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T, n int) []zephyr.Transport {
+		natsConnection := natstest.Connect(t)
+		transports := make([]zephyr.Transport, n)
+		for i := range transports {
+			transports[i] = natstransport.New(natsConnection, natstransport.Options{
+				DispatchTimeout: time.Second,
+			})
+		}
+		return transports
+	})
+}
@@ -0,0 +1,183 @@
+// Package natstest runs an embedded NATS server in-process, so natstransport
+// can be used in tests and during development without a NATS server running
+// on the network.
+//
+//	transport := natstest.New(t)
+//	gateway := zephyr.NewGateway("testGateway", transport)
+package natstest
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	natstransport "github.com/telemetrytv/zephyr/nats-transport"
+)
+
+// ReadyTimeout is how long to wait for an embedded server to accept
+// connections once it has been started.
+var ReadyTimeout = 5 * time.Second
+
+// Options configures an embedded server.
+type Options struct {
+
+	// JetStream enables JetStream on the server, which the ObjectStore option
+	// of natstransport needs.
+	JetStream bool
+
+	// StoreDir is the directory JetStream stores its data in. If empty, a
+	// temporary directory is used, and removed when the server is closed.
+	StoreDir string
+
+	// Transport configures the transports created by New and
+	// Server.NewTransport.
+	Transport natstransport.Options
+}
+
+// Server is an embedded NATS server listening on a random loopback port.
+type Server struct {
+	*server.Server
+	Options Options
+
+	serverOptions *server.Options
+	tempDir       string
+}
+
+// Start starts an embedded NATS server, and waits for it to accept
+// connections. Options may be given to configure the server, otherwise the
+// defaults are used. The server must be closed with Close once it is no longer
+// needed.
+func Start(options ...Options) (*Server, error) {
+	var opts Options
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	s := &Server{Options: opts}
+	storeDir := opts.StoreDir
+	if opts.JetStream && storeDir == "" {
+		tempDir, err := os.MkdirTemp("", "natstest")
+		if err != nil {
+			return nil, err
+		}
+		s.tempDir = tempDir
+		storeDir = tempDir
+	}
+
+	s.serverOptions = &server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: opts.JetStream,
+		StoreDir:  storeDir,
+	}
+	if err := s.start(); err != nil {
+		s.removeTempDir()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Restart shuts the server down and starts it again on the same port, so
+// connections to it are lost and then reconnect. JetStream data is kept.
+func (s *Server) Restart() error {
+	s.serverOptions.Port = s.Addr().(*net.TCPAddr).Port
+	s.Shutdown()
+	s.WaitForShutdown()
+	return s.start()
+}
+
+func (s *Server) start() error {
+	natsServer, err := server.NewServer(s.serverOptions.Clone())
+	if err != nil {
+		return err
+	}
+	s.Server = natsServer
+	natsServer.Start()
+	if !natsServer.ReadyForConnections(ReadyTimeout) {
+		natsServer.Shutdown()
+		natsServer.WaitForShutdown()
+		return errors.New("natstest: server did not become ready for connections")
+	}
+	return nil
+}
+
+// URL returns the URL clients connect to the server with.
+func (s *Server) URL() string {
+	return s.ClientURL()
+}
+
+// Connect opens a new connection to the server.
+func (s *Server) Connect() (*nats.Conn, error) {
+	return nats.Connect(s.URL())
+}
+
+// NewTransport opens a new connection to the server, and returns a transport
+// using it, configured by the server's Transport options. Closing the
+// transport's NatsConnection closes the connection.
+func (s *Server) NewTransport() (*natstransport.NatsTransport, error) {
+	natsConnection, err := s.Connect()
+	if err != nil {
+		return nil, err
+	}
+	return natstransport.New(natsConnection, s.Options.Transport), nil
+}
+
+// Close shuts the server down, and removes its temporary store directory if it
+// has one.
+func (s *Server) Close() {
+	if s.Server != nil {
+		s.Shutdown()
+		s.WaitForShutdown()
+	}
+	s.removeTempDir()
+}
+
+func (s *Server) removeTempDir() {
+	if s.tempDir != "" {
+		os.RemoveAll(s.tempDir)
+	}
+}
+
+// Run starts an embedded NATS server for the duration of a test, failing the
+// test if it cannot be started. The server is closed with t.Cleanup.
+func Run(t testing.TB, options ...Options) *Server {
+	t.Helper()
+	s, err := Start(options...)
+	if err != nil {
+		t.Fatalf("natstest: failed to start server: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Connect starts an embedded NATS server for the duration of a test, and
+// returns a connection to it. The connection and server are closed with
+// t.Cleanup.
+func Connect(t testing.TB, options ...Options) *nats.Conn {
+	t.Helper()
+	s := Run(t, options...)
+	natsConnection, err := s.Connect()
+	if err != nil {
+		t.Fatalf("natstest: failed to connect to server: %v", err)
+	}
+	t.Cleanup(natsConnection.Close)
+	return natsConnection
+}
+
+// New starts an embedded NATS server for the duration of a test, and returns
+// a transport connected to it. The transport's connection and the server are
+// closed with t.Cleanup.
+func New(t testing.TB, options ...Options) *natstransport.NatsTransport {
+	t.Helper()
+	var transportOptions natstransport.Options
+	if len(options) > 0 {
+		transportOptions = options[0].Transport
+	}
+	return natstransport.New(Connect(t, options...), transportOptions)
+}
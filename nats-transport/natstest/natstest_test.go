@@ -0,0 +1,74 @@
+package natstest_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+	"github.com/telemetrytv/zephyr/nats-transport/natstest"
+)
+
+func TestEmbeddedServer(t *testing.T) {
+	t.Run("Returns a transport connected to a ready server", func(t *testing.T) {
+		transport := natstest.New(t)
+		require.NoError(t, transport.Ready())
+
+		service := zephyr.NewService("testService", transport, func(ctx *navaros.Context) {
+			ctx.Status = http.StatusNoContent
+		})
+		require.NoError(t, service.Start())
+		t.Cleanup(service.Stop)
+
+		res := httptest.NewRecorder()
+		require.NoError(t, transport.Dispatch("testService", res, httptest.NewRequest("GET", "/", nil)))
+		assert.Equal(t, http.StatusNoContent, res.Code)
+	})
+
+	t.Run("Starts servers with JetStream enabled", func(t *testing.T) {
+		natsConnection := natstest.Connect(t, natstest.Options{JetStream: true})
+
+		js, err := natsConnection.JetStream()
+		require.NoError(t, err)
+		_, err = js.AccountInfo()
+		assert.NoError(t, err)
+	})
+
+	t.Run("Connects several transports to one server", func(t *testing.T) {
+		server := natstest.Run(t)
+		first, err := server.NewTransport()
+		require.NoError(t, err)
+		t.Cleanup(first.NatsConnection.Close)
+		second, err := server.NewTransport()
+		require.NoError(t, err)
+		t.Cleanup(second.NatsConnection.Close)
+
+		service := zephyr.NewService("testService", first, func(ctx *navaros.Context) {
+			ctx.Status = http.StatusAccepted
+		})
+		require.NoError(t, service.Start())
+		t.Cleanup(service.Stop)
+		// The second transport dispatches without waiting for the service's
+		// announcement, so make sure its subscriptions have reached the server.
+		require.NoError(t, first.NatsConnection.Flush())
+
+		res := httptest.NewRecorder()
+		require.NoError(t, second.Dispatch("testService", res, httptest.NewRequest("GET", "/", nil)))
+		assert.Equal(t, http.StatusAccepted, res.Code)
+	})
+
+	t.Run("Restarts servers on the same URL", func(t *testing.T) {
+		server := natstest.Run(t)
+		url := server.URL()
+
+		require.NoError(t, server.Restart())
+
+		assert.Equal(t, url, server.URL())
+		natsConnection, err := server.Connect()
+		require.NoError(t, err)
+		natsConnection.Close()
+	})
+}
@@ -0,0 +1,191 @@
+package natstransport
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+	"github.com/telemetrytv/trace"
+)
+
+var (
+	transportNatsObjectStoreDebug = trace.Bind("zephyr:transport:nats:object-store")
+)
+
+// LargeBodyThreshold is the default size, in bytes, above which bodies are
+// offloaded to the object store once one is enabled with UseObjectStore.
+const LargeBodyThreshold = 8 << 20
+
+// BodyObjectTTL is how long a body stays in the object store before
+// JetStream removes it. Bodies are deleted as soon as they have been read,
+// or once it is clear they never will be, so this only cleans up after
+// processes which went away in the middle of a dispatch.
+const BodyObjectTTL = time.Hour
+
+// UseObjectStore enables offloading of large request and response bodies to
+// the JetStream object store bucket with the given name, creating the bucket
+// if it does not exist. Rather than streaming a body larger than
+// LargeBodyThreshold as core NATS messages, the sender writes it to the bucket
+// and the receiver reads it from there, deleting it once it has been read.
+// Bodies left in the bucket are removed after BodyObjectTTL.
+//
+// Bodies are only offloaded when both the gateway and the service use the
+// same bucket, and only if their length is declared up front with a
+// Content-Length.
+func (c *NatsTransport) UseObjectStore(ctx context.Context, bucket string) error {
+	transportNatsObjectStoreDebug.Tracef("Using object store bucket %s for large bodies", bucket)
+	js, err := jetstream.New(c.NatsConnection)
+	if err != nil {
+		return err
+	}
+	objectStore, err := js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:      bucket,
+		Description: "Large request and response bodies offloaded by zephyr",
+		TTL:         BodyObjectTTL,
+	})
+	if err != nil {
+		transportNatsObjectStoreDebug.Tracef("Failed to create object store bucket %s: %v", bucket, err)
+		return err
+	}
+	c.objectStore = objectStore
+	c.objectStoreBucket = bucket
+	return nil
+}
+
+// shouldOffload reports whether a body of the given length should be sent
+// through the object store, given the bucket used by the receiving side.
+func (c *NatsTransport) shouldOffload(contentLength int64, remoteBucket string) bool {
+	if c.objectStore == nil || remoteBucket != c.objectStoreBucket {
+		return false
+	}
+	return contentLength > c.largeBodyThreshold()
+}
+
+func (c *NatsTransport) largeBodyThreshold() int64 {
+	if c.LargeBodyThreshold > 0 {
+		return c.LargeBodyThreshold
+	}
+	return LargeBodyThreshold
+}
+
+// putBodyObject writes a body to the object store, returning the name of the
+// object it was stored under.
+func (c *NatsTransport) putBodyObject(ctx context.Context, body io.Reader) (string, error) {
+	name := nuid.Next()
+	transportNatsObjectStoreDebug.Tracef("Writing body to object %s", name)
+	if _, err := c.objectStore.Put(ctx, jetstream.ObjectMeta{Name: name}, body); err != nil {
+		transportNatsObjectStoreDebug.Tracef("Failed to write body to object %s: %v", name, err)
+		return "", err
+	}
+	return name, nil
+}
+
+// openBodyObject opens a body written to the object store by the other side.
+// The object is deleted once the returned reader is closed.
+func (c *NatsTransport) openBodyObject(ctx context.Context, name string) (*bodyObjectReader, error) {
+	transportNatsObjectStoreDebug.Tracef("Reading body from object %s", name)
+	result, err := c.objectStore.Get(ctx, name)
+	if err != nil {
+		transportNatsObjectStoreDebug.Tracef("Failed to read body from object %s: %v", name, err)
+		return nil, err
+	}
+	return &bodyObjectReader{
+		objectStore: c.objectStore,
+		name:        name,
+		result:      result,
+	}, nil
+}
+
+// copyBodyObject copies a body written to the object store by the other side
+// to res, deleting the object once it has been copied.
+func (c *NatsTransport) copyBodyObject(ctx context.Context, res io.Writer, name string) error {
+	object, err := c.openBodyObject(ctx, name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(res, object)
+	if closeErr := object.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type bodyObjectReader struct {
+	objectStore jetstream.ObjectStore
+	name        string
+	result      jetstream.ObjectResult
+	isClosed    bool
+}
+
+func (r *bodyObjectReader) Read(p []byte) (int, error) {
+	return r.result.Read(p)
+}
+
+func (r *bodyObjectReader) Close() error {
+	if r.isClosed {
+		return nil
+	}
+	r.isClosed = true
+	err := r.result.Close()
+	if deleteErr := r.objectStore.Delete(context.Background(), r.name); deleteErr != nil {
+		transportNatsObjectStoreDebug.Tracef("Failed to delete object %s: %v", r.name, deleteErr)
+		if err == nil {
+			err = deleteErr
+		}
+	}
+	return err
+}
+
+// deleteBodyObject deletes a body which will not be read from the object
+// store.
+func (c *NatsTransport) deleteBodyObject(name string) {
+	if err := c.objectStore.Delete(context.Background(), name); err != nil {
+		transportNatsObjectStoreDebug.Tracef("Failed to delete object %s: %v", name, err)
+	}
+}
+
+// bodyObjectWriter writes a body to the object store as it is written, so a
+// response body can be offloaded without buffering it in full.
+type bodyObjectWriter struct {
+	name    string
+	writer  *io.PipeWriter
+	putDone chan error
+}
+
+func (c *NatsTransport) newBodyObjectWriter() *bodyObjectWriter {
+	reader, writer := io.Pipe()
+	w := &bodyObjectWriter{
+		name:    nuid.Next(),
+		writer:  writer,
+		putDone: make(chan error, 1),
+	}
+	transportNatsObjectStoreDebug.Tracef("Writing body to object %s", w.name)
+	go func() {
+		_, err := c.objectStore.Put(context.Background(), jetstream.ObjectMeta{Name: w.name}, reader)
+		reader.CloseWithError(err)
+		w.putDone <- err
+	}()
+	return w
+}
+
+func (w *bodyObjectWriter) Write(p []byte) (int, error) {
+	return w.writer.Write(p)
+}
+
+// abort discards the object, as the body could not be written in full.
+func (w *bodyObjectWriter) abort(err error) {
+	w.writer.CloseWithError(err)
+	<-w.putDone
+}
+
+// Close finishes the object, returning once it has been stored.
+func (w *bodyObjectWriter) Close() error {
+	w.writer.Close()
+	if err := <-w.putDone; err != nil {
+		transportNatsObjectStoreDebug.Tracef("Failed to write body to object %s: %v", w.name, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package natstransport_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+	natstransport "github.com/telemetrytv/zephyr/nats-transport"
+	"github.com/telemetrytv/zephyr/nats-transport/natstest"
+)
+
+func TestNatsTransport_UseObjectStore(t *testing.T) {
+	startService := func(t *testing.T, transport *natstransport.NatsTransport, recvBody *[]byte) {
+		handler := func(ctx *navaros.Context) {
+			body, err := io.ReadAll(ctx.Request().Body)
+			assert.NoError(t, err)
+			*recvBody = body
+
+			ctx.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+			_, err = ctx.Write(body)
+			assert.NoError(t, err)
+		}
+		s := zephyr.NewService("testService", transport, handler)
+		require.NoError(t, s.Start())
+		t.Cleanup(s.Stop)
+	}
+
+	t.Run("Offloads large request and response bodies", func(t *testing.T) {
+		natsConnection := natstest.Connect(t, natstest.Options{JetStream: true})
+
+		gatewayTransport := natstransport.New(natsConnection)
+		gatewayTransport.LargeBodyThreshold = 64 * 1024
+		require.NoError(t, gatewayTransport.UseObjectStore(context.Background(), "zephyr-bodies"))
+
+		serviceTransport := natstransport.New(natsConnection)
+		serviceTransport.LargeBodyThreshold = 64 * 1024
+		require.NoError(t, serviceTransport.UseObjectStore(context.Background(), "zephyr-bodies"))
+
+		var recvBody []byte
+		startService(t, serviceTransport, &recvBody)
+
+		sentBody := make([]byte, 1024*1024)
+		_, err := rand.Read(sentBody)
+		require.NoError(t, err)
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(sentBody))
+		require.NoError(t, gatewayTransport.Dispatch("testService", res, req))
+
+		assert.Equal(t, sentBody, recvBody)
+		assert.Equal(t, 200, res.Code)
+		assert.Equal(t, sentBody, res.Body.Bytes())
+
+		js, err := natsConnection.JetStream()
+		require.NoError(t, err)
+		objectStore, err := js.ObjectStore("zephyr-bodies")
+		require.NoError(t, err)
+		_, err = objectStore.List()
+		assert.ErrorIs(t, err, nats.ErrNoObjectsFound)
+	})
+
+	t.Run("Streams large bodies when the service has no object store", func(t *testing.T) {
+		natsConnection := natstest.Connect(t, natstest.Options{JetStream: true})
+
+		gatewayTransport := natstransport.New(natsConnection)
+		gatewayTransport.LargeBodyThreshold = 64 * 1024
+		require.NoError(t, gatewayTransport.UseObjectStore(context.Background(), "zephyr-bodies"))
+
+		serviceTransport := natstransport.New(natsConnection)
+
+		var recvBody []byte
+		startService(t, serviceTransport, &recvBody)
+
+		sentBody := make([]byte, 256*1024)
+		_, err := rand.Read(sentBody)
+		require.NoError(t, err)
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(sentBody))
+		require.NoError(t, gatewayTransport.Dispatch("testService", res, req))
+
+		assert.Equal(t, sentBody, recvBody)
+		assert.Equal(t, sentBody, res.Body.Bytes())
+	})
+
+	t.Run("Deletes request bodies the handler never reads", func(t *testing.T) {
+		natsConnection := natstest.Connect(t, natstest.Options{JetStream: true})
+
+		gatewayTransport := natstransport.New(natsConnection)
+		gatewayTransport.LargeBodyThreshold = 64 * 1024
+		require.NoError(t, gatewayTransport.UseObjectStore(context.Background(), "zephyr-bodies"))
+
+		serviceTransport := natstransport.New(natsConnection)
+		serviceTransport.LargeBodyThreshold = 64 * 1024
+		require.NoError(t, serviceTransport.UseObjectStore(context.Background(), "zephyr-bodies"))
+
+		js, err := natsConnection.JetStream()
+		require.NoError(t, err)
+		objectStore, err := js.ObjectStore("zephyr-bodies")
+		require.NoError(t, err)
+
+		s := zephyr.NewService("testService", serviceTransport, func(ctx *navaros.Context) {
+			// Respond only once the body has been written to the bucket, so
+			// the gateway does not give up on writing it.
+			assert.Eventually(t, func() bool {
+				objects, err := objectStore.List()
+				return err == nil && len(objects) == 1 && !objects[0].Deleted
+			}, 5*time.Second, 10*time.Millisecond)
+			ctx.Status = 204
+		})
+		require.NoError(t, s.Start())
+		t.Cleanup(s.Stop)
+
+		sentBody := make([]byte, 1024*1024)
+		_, err = rand.Read(sentBody)
+		require.NoError(t, err)
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(sentBody))
+		require.NoError(t, gatewayTransport.Dispatch("testService", res, req))
+		assert.Equal(t, 204, res.Code)
+
+		status, err := objectStore.Status()
+		require.NoError(t, err)
+		assert.Equal(t, natstransport.BodyObjectTTL, status.TTL())
+
+		assert.Eventually(t, func() bool {
+			_, err := objectStore.List()
+			return err == nats.ErrNoObjectsFound
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
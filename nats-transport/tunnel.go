@@ -0,0 +1,179 @@
+package natstransport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/telemetrytv/trace"
+)
+
+var (
+	transportNatsTunnelDebug = trace.Bind("zephyr:transport:nats:tunnel")
+)
+
+// tunnelConn is a net.Conn which carries the bytes of a hijacked connection
+// over NATS. Each side of the tunnel receives on its own inbox, and
+// publishes what is written to it to the subject of the other side as body
+// chunks. Closing either side sends an EOF chunk to the other.
+type tunnelConn struct {
+	natsConnection *nats.Conn
+	wireMode       WireMode
+	inbox          *inbox
+	remoteSubject  string
+
+	readMu       sync.Mutex
+	readBuffer   []byte
+	hasEnded     bool
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+
+	writeMu    sync.Mutex
+	writeIndex int
+
+	closeOnce sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+var _ net.Conn = &tunnelConn{}
+
+func newTunnelConn(natsConnection *nats.Conn, wireMode WireMode, inbox *inbox, remoteSubject string) *tunnelConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &tunnelConn{
+		natsConnection: natsConnection,
+		wireMode:       wireMode,
+		inbox:          inbox,
+		remoteSubject:  remoteSubject,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.readBuffer) == 0 {
+		if c.hasEnded {
+			return 0, io.EOF
+		}
+
+		ctx := c.ctx
+		c.deadlineMu.Lock()
+		readDeadline := c.readDeadline
+		c.deadlineMu.Unlock()
+		if !readDeadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, readDeadline)
+			defer cancel()
+		}
+
+		msg, err := c.inbox.next(ctx)
+		if err != nil {
+			switch {
+			case errors.Is(err, context.DeadlineExceeded):
+				return 0, os.ErrDeadlineExceeded
+			case c.ctx.Err() != nil:
+				return 0, net.ErrClosed
+			}
+			return 0, err
+		}
+
+		bodyChunk := &BodyChunk{}
+		if err := decodeWireMsg(msg, bodyChunk); err != nil {
+			transportNatsTunnelDebug.Tracef("Failed to unmarshal tunnel chunk: %v", err)
+			return 0, err
+		}
+		if bodyChunk.IsEOF {
+			transportNatsTunnelDebug.Trace("Remote side closed the tunnel")
+			c.hasEnded = true
+		}
+		c.readBuffer = bodyChunk.Data
+	}
+
+	n := copy(p, c.readBuffer)
+	c.readBuffer = c.readBuffer[n:]
+	return n, nil
+}
+
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.ctx.Err() != nil {
+		return 0, net.ErrClosed
+	}
+
+	written := 0
+	for written < len(p) {
+		end := min(written+DispatchBodyChunkSize, len(p))
+		if err := c.publish(&BodyChunk{Data: p[written:end]}); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (c *tunnelConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		transportNatsTunnelDebug.Trace("Closing tunnel")
+		c.writeMu.Lock()
+		err = c.publish(&BodyChunk{IsEOF: true})
+		c.writeMu.Unlock()
+		c.cancel()
+		c.inbox.close()
+	})
+	return err
+}
+
+func (c *tunnelConn) publish(bodyChunk *BodyChunk) error {
+	bodyChunk.Index = c.writeIndex
+	if err := publishWireMsg(c.natsConnection, c.wireMode, c.remoteSubject, bodyChunk); err != nil {
+		return err
+	}
+	c.writeIndex += 1
+	return nil
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return tunnelAddr(c.inbox.subject)
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return tunnelAddr(c.remoteSubject)
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline is a noop, as writes are published to NATS without
+// blocking on the remote side.
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "nats"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
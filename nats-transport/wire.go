@@ -0,0 +1,514 @@
+package natstransport
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// WireMode selects how the messages exchanged during a dispatch are encoded.
+type WireMode int
+
+const (
+	// WireModeMsgpack encodes each message as a msgpack envelope in the
+	// message data. It is the default, and is understood by every version of
+	// the transport.
+	WireModeMsgpack WireMode = iota
+
+	// WireModeHeaders carries the HTTP method, URL, status and headers, along
+	// with the transport's own metadata, in the NATS message headers, and
+	// body bytes as the message data. This allows requests to be inspected
+	// and injected with standard NATS tooling, such as the nats CLI.
+	//
+	// Services answer in whichever mode a request was sent in, so only the
+	// dispatching side needs to be configured. Services running a version of
+	// the transport without header support cannot decode these requests, so
+	// only enable it once all services have been upgraded.
+	WireModeHeaders
+)
+
+func (m WireMode) String() string {
+	switch m {
+	case WireModeMsgpack:
+		return "msgpack"
+	case WireModeHeaders:
+		return "headers"
+	default:
+		return "WireMode(" + strconv.Itoa(int(m)) + ")"
+	}
+}
+
+// The headers used by WireModeHeaders for the transport's own metadata. HTTP
+// headers are carried under their own names, except for those which would
+// clash with these or with headers reserved by NATS, which are carried with
+// the wireHTTPHeaderPrefix added to their name.
+const (
+	wireModeHeader                = "Zephyr-Wire"
+	wireMethodHeader              = "Zephyr-Method"
+	wireURLHeader                 = "Zephyr-Url"
+	wireProtoHeader               = "Zephyr-Proto"
+	wireContentLengthHeader       = "Zephyr-Content-Length"
+	wireTransferEncodingHeader    = "Zephyr-Transfer-Encoding"
+	wireHostHeader                = "Zephyr-Host"
+	wireTrailerHeader             = "Zephyr-Trailer"
+	wireTrailerHeaderPrefix       = "Zephyr-Trailer-"
+	wireInlineBodyHeader          = "Zephyr-Inline-Body"
+	wireRemoteAddrHeader          = "Zephyr-Remote-Addr"
+	wireRequestURIHeader          = "Zephyr-Request-Uri"
+	wireTLSHeaderPrefix           = "Zephyr-Tls-"
+	wireResponseSubjectHeader     = "Zephyr-Response-Subject"
+	wireResponseBodySubjectHeader = "Zephyr-Response-Body-Subject"
+	wireRequestBodySubjectHeader  = "Zephyr-Request-Body-Subject"
+	wireTunnelSubjectHeader       = "Zephyr-Tunnel-Subject"
+	wireBodyWindowHeader          = "Zephyr-Body-Window"
+	wireCreditSubjectHeader       = "Zephyr-Credit-Subject"
+	wireObjectStoreHeader         = "Zephyr-Object-Store"
+	wireStatusHeader              = "Zephyr-Status"
+	wireHijackedHeader            = "Zephyr-Hijacked"
+	wireErrorHeader               = "Zephyr-Error"
+	wireHandlerErrorHeader        = "Zephyr-Handler-Error"
+	wireHandlerStackHeader        = "Zephyr-Handler-Stack"
+	wireIndexHeader               = "Zephyr-Index"
+	wireEndHeader                 = "Zephyr-End"
+	wireClosedHeader              = "Zephyr-Closed"
+	wireBodyObjectHeader          = "Zephyr-Body-Object"
+	wireHTTPHeaderPrefix          = "Zephyr-Http-"
+)
+
+// wireMessage is implemented by each of the messages exchanged during a
+// dispatch, so they can be encoded in either wire mode.
+type wireMessage interface {
+	marshalHeader(header nats.Header) []byte
+	unmarshalHeader(header nats.Header, data []byte) error
+}
+
+// newWireMsg encodes a message for publishing to subject in the given mode.
+func newWireMsg(mode WireMode, subject string, message wireMessage) (*nats.Msg, error) {
+	if mode != WireModeHeaders {
+		data, err := msgpack.Marshal(message)
+		if err != nil {
+			return nil, err
+		}
+		return &nats.Msg{Subject: subject, Data: data}, nil
+	}
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(wireModeHeader, WireModeHeaders.String())
+	msg.Data = message.marshalHeader(msg.Header)
+	return msg, nil
+}
+
+// publishWireMsg encodes a message in the given mode and publishes it.
+func publishWireMsg(natsConnection *nats.Conn, mode WireMode, subject string, message wireMessage) error {
+	msg, err := newWireMsg(mode, subject, message)
+	if err != nil {
+		return err
+	}
+	return natsConnection.PublishMsg(msg)
+}
+
+// wireModeOf reports the mode a received message was encoded in.
+func wireModeOf(msg *nats.Msg) WireMode {
+	if msg.Header.Get(wireModeHeader) == WireModeHeaders.String() {
+		return WireModeHeaders
+	}
+	return WireModeMsgpack
+}
+
+// decodeWireMsg decodes a received message in whichever mode it was encoded.
+func decodeWireMsg(msg *nats.Msg, message wireMessage) error {
+	if wireModeOf(msg) == WireModeHeaders {
+		return message.unmarshalHeader(msg.Header, msg.Data)
+	}
+	return msgpack.Unmarshal(msg.Data, message)
+}
+
+func (r *Request) marshalHeader(header nats.Header) []byte {
+	setWireHTTPHeader(header, r.Header)
+	header.Set(wireMethodHeader, r.Method)
+	header.Set(wireURLHeader, r.URL)
+	header.Set(wireProtoHeader, r.Proto)
+	header.Set(wireContentLengthHeader, strconv.FormatInt(r.ContentLength, 10))
+	setWireValues(header, wireTransferEncodingHeader, r.TransferEncoding)
+	setWireString(header, wireHostHeader, r.Host)
+	for key, values := range r.Trailers {
+		if len(values) == 0 {
+			header.Add(wireTrailerHeader, key)
+		} else {
+			header[wireTrailerHeaderPrefix+key] = values
+		}
+	}
+	setWireString(header, wireRemoteAddrHeader, r.RemoteAddr)
+	setWireString(header, wireRequestURIHeader, r.RequestURI)
+	if r.TLS != nil {
+		r.TLS.marshalHeader(header)
+	}
+	setWireString(header, wireResponseSubjectHeader, r.ResponseSubject)
+	setWireString(header, wireResponseBodySubjectHeader, r.ResponseBodySubject)
+	setWireString(header, wireTunnelSubjectHeader, r.TunnelSubject)
+	setWireInt(header, wireBodyWindowHeader, r.BodyWindow)
+	setWireString(header, wireCreditSubjectHeader, r.CreditSubject)
+	setWireString(header, wireObjectStoreHeader, r.ObjectStore)
+	if r.InlineBody {
+		header.Set(wireInlineBodyHeader, "true")
+		return r.Body
+	}
+	return nil
+}
+
+func (r *Request) unmarshalHeader(header nats.Header, data []byte) error {
+	var err error
+	r.Header = wireHTTPHeader(header)
+	r.Method = header.Get(wireMethodHeader)
+	r.URL = header.Get(wireURLHeader)
+	r.Proto = header.Get(wireProtoHeader)
+	if r.Proto == "" {
+		r.Proto = "HTTP/1.1"
+	}
+	var ok bool
+	if r.ProtoMajor, r.ProtoMinor, ok = http.ParseHTTPVersion(r.Proto); !ok {
+		return &wireHeaderError{wireProtoHeader, r.Proto}
+	}
+	r.ContentLength = -1
+	if value := header.Get(wireContentLengthHeader); value != "" {
+		if r.ContentLength, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return &wireHeaderError{wireContentLengthHeader, value}
+		}
+	}
+	r.TransferEncoding = header.Values(wireTransferEncodingHeader)
+	r.Host = header.Get(wireHostHeader)
+	r.Trailers = wireTrailer(header)
+	for _, key := range header.Values(wireTrailerHeader) {
+		if r.Trailers == nil {
+			r.Trailers = map[string][]string{}
+		}
+		r.Trailers[http.CanonicalHeaderKey(key)] = nil
+	}
+	r.RemoteAddr = header.Get(wireRemoteAddrHeader)
+	r.RequestURI = header.Get(wireRequestURIHeader)
+	if header.Get(wireTLSHeaderPrefix+"Version") != "" {
+		r.TLS = &TLS{}
+		if err := r.TLS.unmarshalHeader(header); err != nil {
+			return err
+		}
+	}
+	r.ResponseSubject = header.Get(wireResponseSubjectHeader)
+	r.ResponseBodySubject = header.Get(wireResponseBodySubjectHeader)
+	r.TunnelSubject = header.Get(wireTunnelSubjectHeader)
+	if r.BodyWindow, err = wireInt(header, wireBodyWindowHeader); err != nil {
+		return err
+	}
+	r.CreditSubject = header.Get(wireCreditSubjectHeader)
+	r.ObjectStore = header.Get(wireObjectStoreHeader)
+	if header.Get(wireInlineBodyHeader) == "true" {
+		r.InlineBody = true
+		r.Body = data
+	}
+	return nil
+}
+
+func (t *TLS) marshalHeader(header nats.Header) {
+	header.Set(wireTLSHeaderPrefix+"Version", strconv.FormatUint(uint64(t.Version), 10))
+	header.Set(wireTLSHeaderPrefix+"Handshake-Complete", strconv.FormatBool(t.HandshakeComplete))
+	header.Set(wireTLSHeaderPrefix+"Did-Resume", strconv.FormatBool(t.DidResume))
+	header.Set(wireTLSHeaderPrefix+"Cipher-Suite", strconv.FormatUint(uint64(t.CipherSuite), 10))
+	setWireString(header, wireTLSHeaderPrefix+"Negotiated-Protocol", t.NegotiatedProtocol)
+	setWireString(header, wireTLSHeaderPrefix+"Server-Name", t.ServerName)
+	for _, timestamp := range t.SignedCertificateTimestamps {
+		header.Add(wireTLSHeaderPrefix+"Signed-Certificate-Timestamp", base64.StdEncoding.EncodeToString(timestamp))
+	}
+	if len(t.OCSPResponse) != 0 {
+		header.Set(wireTLSHeaderPrefix+"Ocsp-Response", base64.StdEncoding.EncodeToString(t.OCSPResponse))
+	}
+	if len(t.TLSUnique) != 0 {
+		header.Set(wireTLSHeaderPrefix+"Unique", base64.StdEncoding.EncodeToString(t.TLSUnique))
+	}
+}
+
+func (t *TLS) unmarshalHeader(header nats.Header) error {
+	var err error
+	if t.Version, err = wireUint16(header, wireTLSHeaderPrefix+"Version"); err != nil {
+		return err
+	}
+	t.HandshakeComplete = header.Get(wireTLSHeaderPrefix+"Handshake-Complete") == "true"
+	t.DidResume = header.Get(wireTLSHeaderPrefix+"Did-Resume") == "true"
+	if t.CipherSuite, err = wireUint16(header, wireTLSHeaderPrefix+"Cipher-Suite"); err != nil {
+		return err
+	}
+	t.NegotiatedProtocol = header.Get(wireTLSHeaderPrefix + "Negotiated-Protocol")
+	t.ServerName = header.Get(wireTLSHeaderPrefix + "Server-Name")
+	for _, value := range header.Values(wireTLSHeaderPrefix + "Signed-Certificate-Timestamp") {
+		timestamp, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return &wireHeaderError{wireTLSHeaderPrefix + "Signed-Certificate-Timestamp", value}
+		}
+		t.SignedCertificateTimestamps = append(t.SignedCertificateTimestamps, timestamp)
+	}
+	if t.OCSPResponse, err = wireBytes(header, wireTLSHeaderPrefix+"Ocsp-Response"); err != nil {
+		return err
+	}
+	if t.TLSUnique, err = wireBytes(header, wireTLSHeaderPrefix+"Unique"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *RequestAck) marshalHeader(header nats.Header) []byte {
+	header.Set(wireRequestBodySubjectHeader, a.RequestBodySubject)
+	setWireInt(header, wireBodyWindowHeader, a.BodyWindow)
+	setWireString(header, wireCreditSubjectHeader, a.CreditSubject)
+	setWireString(header, wireObjectStoreHeader, a.ObjectStore)
+	return nil
+}
+
+func (a *RequestAck) unmarshalHeader(header nats.Header, data []byte) error {
+	var err error
+	a.RequestBodySubject = header.Get(wireRequestBodySubjectHeader)
+	if a.BodyWindow, err = wireInt(header, wireBodyWindowHeader); err != nil {
+		return err
+	}
+	a.CreditSubject = header.Get(wireCreditSubjectHeader)
+	a.ObjectStore = header.Get(wireObjectStoreHeader)
+	return nil
+}
+
+func (r *Response) marshalHeader(header nats.Header) []byte {
+	setWireHTTPHeader(header, r.Header)
+	setWireInt(header, wireStatusHeader, r.StatusCode)
+	setWireString(header, wireErrorHeader, r.Error)
+	if r.Hijacked {
+		header.Set(wireHijackedHeader, "true")
+	}
+	setWireString(header, wireTunnelSubjectHeader, r.TunnelSubject)
+	if r.HandlerError != nil {
+		r.HandlerError.marshalHeader(header)
+	}
+	setWireString(header, wireCreditSubjectHeader, r.CreditSubject)
+	if r.InlineBody {
+		header.Set(wireInlineBodyHeader, "true")
+		setWireTrailer(header, r.Trailer)
+		return r.Body
+	}
+	return nil
+}
+
+func (r *Response) unmarshalHeader(header nats.Header, data []byte) error {
+	var err error
+	r.Header = wireHTTPHeader(header)
+	if r.StatusCode, err = wireInt(header, wireStatusHeader); err != nil {
+		return err
+	}
+	r.Error = header.Get(wireErrorHeader)
+	r.Hijacked = header.Get(wireHijackedHeader) == "true"
+	r.TunnelSubject = header.Get(wireTunnelSubjectHeader)
+	r.HandlerError = unmarshalResponseErrorHeader(header)
+	r.CreditSubject = header.Get(wireCreditSubjectHeader)
+	if header.Get(wireInlineBodyHeader) == "true" {
+		r.InlineBody = true
+		r.Body = data
+		r.Trailer = wireTrailer(header)
+	}
+	return nil
+}
+
+// marshalHeader writes the error to the headers. As header values cannot span
+// lines, each line of the stack is written as a separate value.
+func (e *ResponseError) marshalHeader(header nats.Header) {
+	header.Set(wireHandlerErrorHeader, e.Message)
+	for _, line := range strings.Split(strings.TrimRight(e.Stack, "\n"), "\n") {
+		if line != "" {
+			header.Add(wireHandlerStackHeader, line)
+		}
+	}
+}
+
+func unmarshalResponseErrorHeader(header nats.Header) *ResponseError {
+	if _, ok := header[wireHandlerErrorHeader]; !ok {
+		return nil
+	}
+	responseError := &ResponseError{Message: header.Get(wireHandlerErrorHeader)}
+	if lines := header.Values(wireHandlerStackHeader); len(lines) != 0 {
+		responseError.Stack = strings.Join(lines, "\n") + "\n"
+	}
+	return responseError
+}
+
+// marshalHeader writes the chunk's metadata to the headers, returning its data
+// as the message data. Trailers are carried as HTTP headers of the EOF chunk.
+func (c *BodyChunk) marshalHeader(header nats.Header) []byte {
+	setWireHTTPHeader(header, c.Trailer)
+	header.Set(wireIndexHeader, strconv.Itoa(c.Index))
+	setWireString(header, wireErrorHeader, c.Error)
+	if c.IsEOF {
+		header.Set(wireEndHeader, "true")
+	}
+	if c.HandlerError != nil {
+		c.HandlerError.marshalHeader(header)
+	}
+	setWireString(header, wireBodyObjectHeader, c.BodyObject)
+	return c.Data
+}
+
+func (c *BodyChunk) unmarshalHeader(header nats.Header, data []byte) error {
+	var err error
+	if c.Index, err = wireInt(header, wireIndexHeader); err != nil {
+		return err
+	}
+	c.Data = data
+	c.Error = header.Get(wireErrorHeader)
+	c.IsEOF = header.Get(wireEndHeader) == "true"
+	if trailer := wireHTTPHeader(header); len(trailer) != 0 {
+		c.Trailer = trailer
+	}
+	c.HandlerError = unmarshalResponseErrorHeader(header)
+	c.BodyObject = header.Get(wireBodyObjectHeader)
+	return nil
+}
+
+func (c *BodyCredit) marshalHeader(header nats.Header) []byte {
+	header.Set(wireIndexHeader, strconv.Itoa(c.Index))
+	if c.Closed {
+		header.Set(wireClosedHeader, "true")
+	}
+	return nil
+}
+
+func (c *BodyCredit) unmarshalHeader(header nats.Header, data []byte) error {
+	var err error
+	if c.Index, err = wireInt(header, wireIndexHeader); err != nil {
+		return err
+	}
+	c.Closed = header.Get(wireClosedHeader) == "true"
+	return nil
+}
+
+// isReservedWireHeader reports whether an HTTP header must be prefixed to be
+// carried in the NATS headers, as its name is used by NATS or the transport.
+func isReservedWireHeader(key string) bool {
+	switch {
+	case strings.EqualFold(key, "Status"), strings.EqualFold(key, "Description"):
+		return true
+	case len(key) >= len("Nats-") && strings.EqualFold(key[:len("Nats-")], "Nats-"):
+		return true
+	case len(key) >= len("Zephyr-") && strings.EqualFold(key[:len("Zephyr-")], "Zephyr-"):
+		return true
+	}
+	return false
+}
+
+func setWireHTTPHeader(header nats.Header, httpHeader map[string][]string) {
+	for key, values := range httpHeader {
+		if isReservedWireHeader(key) {
+			key = wireHTTPHeaderPrefix + key
+		}
+		header[key] = append(header[key], values...)
+	}
+}
+
+// wireHTTPHeader collects the HTTP headers from the NATS headers, leaving out
+// the transport's own metadata.
+func wireHTTPHeader(header nats.Header) map[string][]string {
+	httpHeader := map[string][]string{}
+	for key, values := range header {
+		if len(key) > len(wireHTTPHeaderPrefix) && strings.EqualFold(key[:len(wireHTTPHeaderPrefix)], wireHTTPHeaderPrefix) {
+			key = key[len(wireHTTPHeaderPrefix):]
+		} else if isReservedWireHeader(key) {
+			continue
+		}
+		key = http.CanonicalHeaderKey(key)
+		httpHeader[key] = append(httpHeader[key], values...)
+	}
+	return httpHeader
+}
+
+// setWireTrailer writes trailers to the headers, each with the
+// wireTrailerHeaderPrefix added to its name so they are kept apart from the
+// HTTP headers sent in the same message.
+func setWireTrailer(header nats.Header, trailer map[string][]string) {
+	for key, values := range trailer {
+		header[wireTrailerHeaderPrefix+key] = values
+	}
+}
+
+// wireTrailer collects the trailers written with setWireTrailer.
+func wireTrailer(header nats.Header) map[string][]string {
+	var trailer map[string][]string
+	for key, values := range header {
+		if len(key) <= len(wireTrailerHeaderPrefix) || !strings.EqualFold(key[:len(wireTrailerHeaderPrefix)], wireTrailerHeaderPrefix) {
+			continue
+		}
+		if trailer == nil {
+			trailer = map[string][]string{}
+		}
+		trailer[http.CanonicalHeaderKey(key[len(wireTrailerHeaderPrefix):])] = values
+	}
+	return trailer
+}
+
+// wireHeaderError is returned when a header used by WireModeHeaders holds a
+// value that cannot be decoded.
+type wireHeaderError struct {
+	key   string
+	value string
+}
+
+func (e *wireHeaderError) Error() string {
+	return "natstransport: invalid value for header " + e.key + ": " + strconv.Quote(e.value)
+}
+
+func setWireString(header nats.Header, key, value string) {
+	if value != "" {
+		header.Set(key, value)
+	}
+}
+
+func setWireValues(header nats.Header, key string, values []string) {
+	if len(values) != 0 {
+		header[key] = values
+	}
+}
+
+func setWireInt(header nats.Header, key string, value int) {
+	if value != 0 {
+		header.Set(key, strconv.Itoa(value))
+	}
+}
+
+func wireInt(header nats.Header, key string) (int, error) {
+	value := header.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, &wireHeaderError{key, value}
+	}
+	return n, nil
+}
+
+func wireUint16(header nats.Header, key string) (uint16, error) {
+	value := header.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, &wireHeaderError{key, value}
+	}
+	return uint16(n), nil
+}
+
+func wireBytes(header nats.Header, key string) ([]byte, error) {
+	value := header.Get(key)
+	if value == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, &wireHeaderError{key, value}
+	}
+	return b, nil
+}
@@ -0,0 +1,146 @@
+package natstransport
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWireMsg(t *testing.T) {
+	roundTrip := func(t *testing.T, mode WireMode, sent, recv wireMessage) {
+		msg, err := newWireMsg(mode, "test.subject", sent)
+		require.NoError(t, err)
+		assert.Equal(t, mode, wireModeOf(msg))
+		require.NoError(t, decodeWireMsg(msg, recv))
+	}
+
+	t.Run("Carries HTTP headers as NATS headers", func(t *testing.T) {
+		sent := &Request{
+			Method:        "POST",
+			URL:           "/items?sort=name",
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        map[string][]string{"Content-Type": {"application/json"}, "Accept": {"text/plain", "text/html"}},
+			ContentLength: 13,
+			Host:          "example.com",
+			Trailers:      map[string][]string{"Checksum": nil},
+			RemoteAddr:    "10.0.0.1:1234",
+			TLS:           &TLS{Version: 0x0304, HandshakeComplete: true, ServerName: "example.com", TLSUnique: []byte{1, 2, 3}},
+
+			ResponseSubject:     "_INBOX.response",
+			ResponseBodySubject: "_INBOX.response-body",
+			BodyWindow:          16,
+			CreditSubject:       "_INBOX.credit",
+		}
+		msg, err := newWireMsg(WireModeHeaders, "test.subject", sent)
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", msg.Header.Get("Content-Type"))
+		assert.Equal(t, "POST", msg.Header.Get(wireMethodHeader))
+		assert.Empty(t, msg.Data)
+
+		recv := &Request{}
+		require.NoError(t, decodeWireMsg(msg, recv))
+		assert.Equal(t, sent, recv)
+	})
+
+	t.Run("Prefixes HTTP headers reserved by NATS or the transport", func(t *testing.T) {
+		sent := &Response{
+			StatusCode: 200,
+			Header: map[string][]string{
+				"Status":        {"ok"},
+				"Nats-Msg-Id":   {"abc"},
+				"Zephyr-Status": {"teapot"},
+				"Content-Type":  {"text/plain"},
+			},
+		}
+		msg, err := newWireMsg(WireModeHeaders, "test.subject", sent)
+		require.NoError(t, err)
+		assert.Empty(t, msg.Header.Get("Status"))
+		assert.Equal(t, "ok", msg.Header.Get("Zephyr-Http-Status"))
+		assert.Equal(t, "200", msg.Header.Get(wireStatusHeader))
+
+		recv := &Response{}
+		require.NoError(t, decodeWireMsg(msg, recv))
+		assert.Equal(t, sent, recv)
+	})
+
+	t.Run("Carries body chunks as message data", func(t *testing.T) {
+		sent := &BodyChunk{
+			Index:   3,
+			Data:    []byte("last bytes"),
+			IsEOF:   true,
+			Trailer: map[string][]string{"Checksum": {"abc123"}},
+			HandlerError: &ResponseError{
+				Message: "boom",
+				Stack:   "goroutine 1 [running]:\nmain.main()\n",
+			},
+		}
+		msg, err := newWireMsg(WireModeHeaders, "test.subject", sent)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("last bytes"), msg.Data)
+		assert.Equal(t, []string{"goroutine 1 [running]:", "main.main()"}, msg.Header.Values(wireHandlerStackHeader))
+
+		recv := &BodyChunk{}
+		require.NoError(t, decodeWireMsg(msg, recv))
+		assert.Equal(t, sent, recv)
+	})
+
+	t.Run("Carries inline bodies as message data", func(t *testing.T) {
+		sentRequest := &Request{
+			Method:     "POST",
+			URL:        "/items",
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     map[string][]string{},
+			Trailers:   map[string][]string{"Checksum": {"abc123"}},
+			InlineBody: true,
+			Body:       []byte(`{"name":"item"}`),
+		}
+		msg, err := newWireMsg(WireModeHeaders, "test.subject", sentRequest)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(`{"name":"item"}`), msg.Data)
+		recvRequest := &Request{}
+		require.NoError(t, decodeWireMsg(msg, recvRequest))
+		assert.Equal(t, sentRequest, recvRequest)
+
+		sentResponse := &Response{
+			StatusCode: 201,
+			Header:     map[string][]string{"Content-Type": {"application/json"}},
+			InlineBody: true,
+			Body:       []byte(`{"id":1}`),
+			Trailer:    map[string][]string{"Checksum": {"def456"}},
+		}
+		msg, err = newWireMsg(WireModeHeaders, "test.subject", sentResponse)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(`{"id":1}`), msg.Data)
+		recvResponse := &Response{}
+		require.NoError(t, decodeWireMsg(msg, recvResponse))
+		assert.Equal(t, sentResponse, recvResponse)
+	})
+
+	t.Run("Round trips every message in either mode", func(t *testing.T) {
+		for _, mode := range []WireMode{WireModeMsgpack, WireModeHeaders} {
+			recvAck := &RequestAck{}
+			roundTrip(t, mode, &RequestAck{RequestBodySubject: "_INBOX.body", BodyWindow: 8, ObjectStore: "bodies"}, recvAck)
+			assert.Equal(t, &RequestAck{RequestBodySubject: "_INBOX.body", BodyWindow: 8, ObjectStore: "bodies"}, recvAck)
+
+			recvCredit := &BodyCredit{}
+			roundTrip(t, mode, &BodyCredit{Index: 5, Closed: true}, recvCredit)
+			assert.Equal(t, &BodyCredit{Index: 5, Closed: true}, recvCredit)
+
+			recvResponse := &Response{}
+			roundTrip(t, mode, &Response{Hijacked: true, TunnelSubject: "_INBOX.tunnel", Header: map[string][]string{}}, recvResponse)
+			assert.Equal(t, &Response{Hijacked: true, TunnelSubject: "_INBOX.tunnel", Header: map[string][]string{}}, recvResponse)
+		}
+	})
+
+	t.Run("Reports invalid header values", func(t *testing.T) {
+		msg, err := newWireMsg(WireModeHeaders, "test.subject", &BodyCredit{Index: 1})
+		require.NoError(t, err)
+		msg.Header.Set(wireIndexHeader, "one")
+		assert.EqualError(t, decodeWireMsg(msg, &BodyCredit{}), `natstransport: invalid value for header Zephyr-Index: "one"`)
+	})
+}
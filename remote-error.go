@@ -0,0 +1,43 @@
+package zephyr
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// RemoteError is returned by Transport.Dispatch, and by ServiceClient.Do,
+// when a service's handler fails while handling the request. Stack holds the
+// stack trace captured by the service when the handler panicked, if any.
+//
+// If the service had not yet started its response, nothing has been written
+// to the response writer. Otherwise the response was cut short, and should
+// not be treated as complete.
+type RemoteError struct {
+	Service string
+	Message string
+	Stack   string
+}
+
+var _ error = &RemoteError{}
+
+func (e *RemoteError) Error() string {
+	if e.Service == "" {
+		return fmt.Sprintf("service handler failed: %s", e.Message)
+	}
+	return fmt.Sprintf("service %s handler failed: %s", e.Service, e.Message)
+}
+
+// NewRemoteError creates a RemoteError from a value recovered from a panic
+// in a service handler. Transports use it so that handlers panicking with
+// values other than errors are reported the same way. If the value is
+// already a RemoteError, it is returned as is.
+func NewRemoteError(recovered any) *RemoteError {
+	switch recovered := recovered.(type) {
+	case *RemoteError:
+		return recovered
+	case error:
+		return &RemoteError{Message: recovered.Error(), Stack: string(debug.Stack())}
+	default:
+		return &RemoteError{Message: fmt.Sprint(recovered), Stack: string(debug.Stack())}
+	}
+}
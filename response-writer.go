@@ -0,0 +1,40 @@
+package zephyr
+
+import (
+	"net/http"
+
+	"github.com/telemetrytv/trace"
+)
+
+var (
+	responseWriterDebug = trace.Bind("zephyr:response-writer")
+)
+
+// trackingResponseWriter records whether anything has been written to the
+// client, so the gateway and ServeHTTP know if they can still respond with an
+// error.
+type trackingResponseWriter struct {
+	http.ResponseWriter
+	hasWritten bool
+}
+
+func (w *trackingResponseWriter) WriteHeader(statusCode int) {
+	w.hasWritten = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *trackingResponseWriter) Write(p []byte) (int, error) {
+	w.hasWritten = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *trackingResponseWriter) Flush() {
+	w.hasWritten = true
+	if err := http.NewResponseController(w.ResponseWriter).Flush(); err != nil {
+		responseWriterDebug.Tracef("Failed to flush response: %v", err)
+	}
+}
+
+func (w *trackingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
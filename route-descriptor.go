@@ -11,24 +11,32 @@ import (
 type RouteDescriptor struct {
 	Method  string
 	Pattern *navaros.Pattern
+
+	// MaxBodySize overrides the gateway's maximum request body size for this
+	// route. If zero, the gateway's limit applies. If negative, request bodies
+	// sent to this route are not limited.
+	MaxBodySize int64
 }
 
 // MarshalMsgpack returns the msgpack representation of the route descriptor.
 func (r *RouteDescriptor) MarshalMsgpack() ([]byte, error) {
 	return msgpack.Marshal(struct {
-		Method  string
-		Pattern string
+		Method      string
+		Pattern     string
+		MaxBodySize int64
 	}{
-		Method:  string(r.Method),
-		Pattern: r.Pattern.String(),
+		Method:      string(r.Method),
+		Pattern:     r.Pattern.String(),
+		MaxBodySize: r.MaxBodySize,
 	})
 }
 
 // UnmarshalMsgpack parses the msgpack representation of the route descriptor.
 func (r *RouteDescriptor) UnmarshalMsgpack(data []byte) error {
 	fromMsgpackStruct := struct {
-		Method  string
-		Pattern string
+		Method      string
+		Pattern     string
+		MaxBodySize int64
 	}{}
 	if err := msgpack.Unmarshal(data, &fromMsgpackStruct); err != nil {
 		return err
@@ -41,21 +49,38 @@ func (r *RouteDescriptor) UnmarshalMsgpack(data []byte) error {
 
 	r.Method = fromMsgpackStruct.Method
 	r.Pattern = pattern
+	r.MaxBodySize = fromMsgpackStruct.MaxBodySize
 
 	return nil
 }
 
 // NewRouteDescriptor creates a new RouteDescriptor from a method and a path
 // pattern. The pattern determines which URL path this route will match.
+// Options such as WithMaxBodySize may be given to configure the route.
 //
 // To understand the pattern syntax, see the [navaros package](https://github.com/RobertWHurst/Navaros?tab=readme-ov-file#route-patterns).
-func NewRouteDescriptor(method string, patternStr string) (*RouteDescriptor, error) {
+func NewRouteDescriptor(method string, patternStr string, options ...RouteOption) (*RouteDescriptor, error) {
 	pattern, err := navaros.NewPattern(patternStr)
 	if err != nil {
 		return nil, err
 	}
-	return &RouteDescriptor{
+	routeDescriptor := &RouteDescriptor{
 		Method:  method,
 		Pattern: pattern,
-	}, nil
+	}
+	for _, option := range options {
+		option(routeDescriptor)
+	}
+	return routeDescriptor, nil
+}
+
+// RouteOption configures a RouteDescriptor created by NewRouteDescriptor.
+type RouteOption func(*RouteDescriptor)
+
+// WithMaxBodySize sets the maximum request body size, in bytes, the gateway
+// will accept for the route. See RouteDescriptor.MaxBodySize.
+func WithMaxBodySize(maxBodySize int64) RouteOption {
+	return func(r *RouteDescriptor) {
+		r.MaxBodySize = maxBodySize
+	}
 }
@@ -8,6 +8,8 @@ type ServiceDescriptor struct {
 	Name             string             `msgpack:"name"`
 	GatewayNames     []string           `msgpack:"gatewayNames"`
 	RouteDescriptors []*RouteDescriptor `msgpack:"httpRouteDescriptors"`
+	InstanceID       string             `msgpack:"instanceId,omitempty"`
+	InstanceIDs      []string           `msgpack:"-"`
 	LastSeenAt       *time.Time         `msgpack:"-"`
 	UnreachableAt    *time.Time         `msgpack:"-"`
 	UnreachableCount int                `msgpack:"-"`
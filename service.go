@@ -3,6 +3,7 @@ package zephyr
 import (
 	"fmt"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/RobertWHurst/navaros"
 	"github.com/telemetrytv/trace"
@@ -51,7 +52,15 @@ type Service struct {
 	// either a Navaros router or a standard http.Handler or http.HandlerFunc.
 	Handler any
 
-	stopChan chan struct{}
+	// MaxBodySize overrides the gateway's maximum request body size for every
+	// route the service announces, including those taken from a Navaros
+	// router. Routes which set their own MaxBodySize keep it. If zero, the
+	// gateway's limit applies.
+	MaxBodySize int64
+
+	stopChan               chan struct{}
+	isStarted              atomic.Bool
+	unbindConnectionChange func()
 }
 
 // NewService creates a new service with the given name, connection, and handler.
@@ -95,9 +104,26 @@ func (s *Service) Start() error {
 	err = s.Transport.BindDispatch(s.Name, func(res http.ResponseWriter, req *http.Request) {
 		serviceHandleDebug.Tracef("Handling request %s %s", req.Method, req.URL.Path)
 		
-		ctx := navaros.NewContext(res, req, s.Handler)
+		if instanceDispatcher, ok := s.Transport.(InstanceDispatcher); ok && instanceDispatcher.InstanceID() != "" {
+			res.Header().Set(InstanceIDHeader, instanceDispatcher.InstanceID())
+		}
+		req = withTransportResponseWriter(res, req)
+		serviceRes := &serviceResponseWriter{ResponseWriter: res}
+		ctx := navaros.NewContext(serviceRes, req, s.Handler)
 		ctx.Next()
+		if ctx.Error != nil && !serviceRes.hasWritten {
+			serviceRes.isDiscarding = true
+		}
 		navaros.CtxFinalize(ctx)
+
+		if ctx.FinalError != nil {
+			serviceHandleDebug.Tracef("Handler failed for request %s %s: %v", req.Method, req.URL.Path, ctx.FinalError)
+			panic(&RemoteError{
+				Service: s.Name,
+				Message: ctx.FinalError.Error(),
+				Stack:   ctx.FinalErrorStack,
+			})
+		}
 		
 		serviceHandleDebug.Tracef("Completed handling request %s %s", req.Method, req.URL.Path)
 	})
@@ -106,11 +132,19 @@ func (s *Service) Start() error {
 		return err
 	}
 
+	serviceDebug.Trace("Binding connection change handler")
+	s.unbindConnectionChange, err = bindConnectionChange(s.Transport, s.handleConnectionChange)
+	if err != nil {
+		serviceDebug.Tracef("Failed to bind connection change handler: %v", err)
+		return err
+	}
+
 	serviceDebug.Trace("Announcing service to gateways")
 	if err := s.doAnnounce(); err != nil {
 		serviceDebug.Tracef("Failed to announce service: %v", err)
 		return err
 	}
+	s.isStarted.Store(true)
 
 	serviceDebug.Tracef("Service %s started successfully", s.Name)
 	return nil
@@ -121,6 +155,14 @@ func (s *Service) Start() error {
 func (s *Service) Stop() {
 	serviceDebug.Tracef("Stopping service %s", s.Name)
 	
+	s.isStarted.Store(false)
+
+	serviceDebug.Trace("Unbinding connection change handler")
+	if s.unbindConnectionChange != nil {
+		s.unbindConnectionChange()
+		s.unbindConnectionChange = nil
+	}
+
 	serviceDebug.Trace("Unbinding gateway announcement handler")
 	if err := s.Transport.UnbindGatewayAnnounce(); err != nil {
 		serviceDebug.Tracef("Failed to unbind gateway announcement handler: %v", err)
@@ -139,6 +181,48 @@ func (s *Service) Stop() {
 	serviceDebug.Tracef("Service %s stopped successfully", s.Name)
 }
 
+// serviceResponseWriter lets a service report a failed handler to its
+// transport, rather than having Navaros respond with a 500. Once the handler
+// has failed, anything Navaros writes while finalizing the response is
+// discarded, unless the handler had already started writing the response.
+type serviceResponseWriter struct {
+	http.ResponseWriter
+	hasWritten   bool
+	isDiscarding bool
+}
+
+var _ http.Flusher = &serviceResponseWriter{}
+
+func (w *serviceResponseWriter) WriteHeader(statusCode int) {
+	if w.isDiscarding {
+		return
+	}
+	w.hasWritten = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *serviceResponseWriter) Write(p []byte) (int, error) {
+	if w.isDiscarding {
+		return len(p), nil
+	}
+	w.hasWritten = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *serviceResponseWriter) Flush() {
+	if w.isDiscarding {
+		return
+	}
+	w.hasWritten = true
+	if err := http.NewResponseController(w.ResponseWriter).Flush(); err != nil {
+		serviceHandleDebug.Tracef("Failed to flush response: %v", err)
+	}
+}
+
+func (w *serviceResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (s *Service) handleGatewayAnnounce(gatewayDescriptor *GatewayDescriptor) {
 	serviceAnnounceDebug.Tracef("Received gateway announcement from %s", gatewayDescriptor.Name)
 	
@@ -175,6 +259,33 @@ func (s *Service) handleGatewayAnnounce(gatewayDescriptor *GatewayDescriptor) {
 	}
 }
 
+// handleConnectionChange announces the service as soon as its transport
+// reconnects, so gateways that lost track of it while the connection was down
+// can route to it again without waiting for their next announcement.
+func (s *Service) handleConnectionChange(isConnected bool) {
+	if !isConnected {
+		serviceDebug.Tracef("Service %s transport disconnected", s.Name)
+		return
+	}
+	serviceDebug.Tracef("Service %s transport reconnected", s.Name)
+	if err := s.doAnnounce(); err != nil {
+		serviceAnnounceDebug.Tracef("Failed to announce service after reconnecting: %v", err)
+	}
+}
+
+// Ready returns nil if the service has been started and its transport is
+// ready to carry requests, or an error describing why not. It is intended
+// for use in readiness probes.
+func (s *Service) Ready() error {
+	if !s.isStarted.Load() {
+		return fmt.Errorf("service %s is not started", s.Name)
+	}
+	if err := transportReady(s.Transport); err != nil {
+		return fmt.Errorf("service %s transport is not ready: %w", s.Name, err)
+	}
+	return nil
+}
+
 // Run starts the service and blocks until the service is stopped.
 func (s *Service) Run() error {
 	serviceDebug.Tracef("Running service %s", s.Name)
@@ -208,6 +319,10 @@ func (s *Service) doAnnounce() error {
 			}
 		}
 	}
+
+	if s.MaxBodySize != 0 {
+		routeDescriptors = withMaxBodySize(routeDescriptors, s.MaxBodySize)
+	}
 	
 	if len(routeDescriptors) > 0 {
 		serviceAnnounceDebug.Tracef("Announcing %d routes", len(routeDescriptors))
@@ -218,9 +333,29 @@ func (s *Service) doAnnounce() error {
 		serviceAnnounceDebug.Trace("No routes to announce")
 	}
 	
+	var instanceID string
+	if instanceDispatcher, ok := s.Transport.(InstanceDispatcher); ok {
+		instanceID = instanceDispatcher.InstanceID()
+	}
+
 	return s.Transport.AnnounceService(&ServiceDescriptor{
 		Name:             s.Name,
 		GatewayNames:     s.GatewayNames,
 		RouteDescriptors: routeDescriptors,
+		InstanceID:       instanceID,
 	})
 }
+
+// withMaxBodySize returns copies of the route descriptors, with maxBodySize
+// set on those which do not set their own.
+func withMaxBodySize(routeDescriptors []*RouteDescriptor, maxBodySize int64) []*RouteDescriptor {
+	limitedRouteDescriptors := make([]*RouteDescriptor, 0, len(routeDescriptors))
+	for _, routeDescriptor := range routeDescriptors {
+		limitedRouteDescriptor := *routeDescriptor
+		if limitedRouteDescriptor.MaxBodySize == 0 {
+			limitedRouteDescriptor.MaxBodySize = maxBodySize
+		}
+		limitedRouteDescriptors = append(limitedRouteDescriptors, &limitedRouteDescriptor)
+	}
+	return limitedRouteDescriptors
+}
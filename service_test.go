@@ -48,6 +48,27 @@ func TestService(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, "test response", string(sendResponseBody))
 	})
+	t.Run("Will return handler failures as a RemoteError", func(t *testing.T) {
+		transport := localtransport.New()
+
+		handler := func(ctx *navaros.Context) {
+			panic("something went wrong")
+		}
+		s := zephyr.NewService("testService", transport, handler)
+
+		err := s.Start()
+		assert.NoError(t, err)
+
+		client := zephyr.NewClient(transport)
+		res, err := client.Service("testService").Get("/")
+		assert.Nil(t, res)
+
+		var remoteErr *zephyr.RemoteError
+		assert.ErrorAs(t, err, &remoteErr)
+		assert.Equal(t, "testService", remoteErr.Service)
+		assert.Equal(t, "something went wrong", remoteErr.Message)
+		assert.NotEmpty(t, remoteErr.Stack)
+	})
 }
 
 func TestService_Start(t *testing.T) {
@@ -114,4 +135,70 @@ func TestService_Start(t *testing.T) {
 
 		assert.Nil(t, serviceDescriptor)
 	})
+	t.Run("Will carry request and response trailers", func(t *testing.T) {
+		transport := localtransport.New()
+
+		var recvBody string
+		var recvTrailer http.Header
+		handler := func(ctx *navaros.Context) {
+			body, err := io.ReadAll(ctx.Request().Body)
+			assert.NoError(t, err)
+			recvBody = string(body)
+			recvTrailer = ctx.Request().Trailer.Clone()
+
+			res := ctx.ResponseWriter()
+			res.Header().Set("Trailer", "Checksum")
+			res.WriteHeader(200)
+			_, err = res.Write([]byte("test response"))
+			assert.NoError(t, err)
+			res.Header().Set("Checksum", "abc123")
+			res.Header().Set(http.TrailerPrefix+"Row-Count", "7")
+		}
+		s := zephyr.NewService("testService", transport, handler)
+
+		err := s.Start()
+		assert.NoError(t, err)
+
+		sentResponseWriter := httptest.NewRecorder()
+		sentRequest := httptest.NewRequest("POST", "http://server.url", &trailerReader{
+			Reader:  bytes.NewBufferString("test body"),
+			trailer: http.Header{"Request-Checksum": {"def456"}},
+		})
+		sentRequest.Trailer = http.Header{"Request-Checksum": nil}
+		sentRequest.Body.(*trailerReader).request = sentRequest
+		err = transport.Dispatch("testService", sentResponseWriter, sentRequest)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "test body", recvBody)
+		assert.Equal(t, "def456", recvTrailer.Get("Request-Checksum"))
+
+		sentResponse := sentResponseWriter.Result()
+		sendResponseBody, err := io.ReadAll(sentResponse.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "test response", string(sendResponseBody))
+		assert.Equal(t, "abc123", sentResponse.Trailer.Get("Checksum"))
+		assert.Equal(t, "7", sentResponse.Trailer.Get("Row-Count"))
+	})
+}
+
+// trailerReader fills in the trailers of its request once the body has been
+// read to the end, as the HTTP server does.
+type trailerReader struct {
+	io.Reader
+	request *http.Request
+	trailer http.Header
+}
+
+func (r *trailerReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		for key, values := range r.trailer {
+			r.request.Trailer[key] = values
+		}
+	}
+	return n, err
+}
+
+func (r *trailerReader) Close() error {
+	return nil
 }
@@ -0,0 +1,159 @@
+package simtransport
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/telemetrytv/zephyr"
+)
+
+func (c *SimTransport) AnnounceGateway(gatewayDescriptor *zephyr.GatewayDescriptor) error {
+	transportSimAnnounceDebug.Tracef("Node %s announcing gateway %s", c.Name, gatewayDescriptor.Name)
+	// The descriptor is copied so its address identifies this announcement
+	// when it is delivered.
+	announcedDescriptor := *gatewayDescriptor
+	c.network.setAnnouncer(&announcedDescriptor, c.Name)
+	defer c.network.clearAnnouncer(&announcedDescriptor)
+	return c.network.Transport.AnnounceGateway(&announcedDescriptor)
+}
+
+func (c *SimTransport) BindGatewayAnnounce(handler func(gatewayDescriptor *zephyr.GatewayDescriptor)) error {
+	transportSimAnnounceDebug.Tracef("Node %s binding gateway announcement handler", c.Name)
+	n := c.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.isGatewayAnnounceBound {
+		if err := n.Transport.BindGatewayAnnounce(n.deliverGatewayAnnounce); err != nil {
+			return err
+		}
+		n.isGatewayAnnounceBound = true
+	}
+	c.gatewayAnnounceHandlers = append(c.gatewayAnnounceHandlers, handler)
+	return nil
+}
+
+func (c *SimTransport) UnbindGatewayAnnounce() error {
+	transportSimAnnounceDebug.Tracef("Node %s unbinding gateway announcement handlers", c.Name)
+	n := c.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c.gatewayAnnounceHandlers = nil
+	for _, node := range n.nodes {
+		if len(node.gatewayAnnounceHandlers) > 0 {
+			return nil
+		}
+	}
+	if !n.isGatewayAnnounceBound {
+		return nil
+	}
+	n.isGatewayAnnounceBound = false
+	return n.Transport.UnbindGatewayAnnounce()
+}
+
+func (c *SimTransport) AnnounceService(serviceDescriptor *zephyr.ServiceDescriptor) error {
+	transportSimAnnounceDebug.Tracef("Node %s announcing service %s", c.Name, serviceDescriptor.Name)
+	announcedDescriptor := *serviceDescriptor
+	c.network.setAnnouncer(&announcedDescriptor, c.Name)
+	defer c.network.clearAnnouncer(&announcedDescriptor)
+	return c.network.Transport.AnnounceService(&announcedDescriptor)
+}
+
+func (c *SimTransport) BindServiceAnnounce(handler func(serviceDescriptor *zephyr.ServiceDescriptor)) error {
+	transportSimAnnounceDebug.Tracef("Node %s binding service announcement handler", c.Name)
+	n := c.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.isServiceAnnounceBound {
+		if err := n.Transport.BindServiceAnnounce(n.deliverServiceAnnounce); err != nil {
+			return err
+		}
+		n.isServiceAnnounceBound = true
+	}
+	c.serviceAnnounceHandlers = append(c.serviceAnnounceHandlers, handler)
+	return nil
+}
+
+func (c *SimTransport) UnbindServiceAnnounce() error {
+	transportSimAnnounceDebug.Tracef("Node %s unbinding service announcement handlers", c.Name)
+	n := c.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c.serviceAnnounceHandlers = nil
+	for _, node := range n.nodes {
+		if len(node.serviceAnnounceHandlers) > 0 {
+			return nil
+		}
+	}
+	if !n.isServiceAnnounceBound {
+		return nil
+	}
+	n.isServiceAnnounceBound = false
+	return n.Transport.UnbindServiceAnnounce()
+}
+
+func (n *Network) setAnnouncer(descriptor any, name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.announcers[descriptor] = name
+}
+
+func (n *Network) clearAnnouncer(descriptor any) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.announcers, descriptor)
+}
+
+func (n *Network) deliverGatewayAnnounce(gatewayDescriptor *zephyr.GatewayDescriptor) {
+	deliver(n, gatewayDescriptor, func(node *SimTransport) []func(*zephyr.GatewayDescriptor) {
+		return node.gatewayAnnounceHandlers
+	})
+}
+
+func (n *Network) deliverServiceAnnounce(serviceDescriptor *zephyr.ServiceDescriptor) {
+	deliver(n, serviceDescriptor, func(node *SimTransport) []func(*zephyr.ServiceDescriptor) {
+		return node.serviceAnnounceHandlers
+	})
+}
+
+// delivery is an announcement on its way to the handlers of one node.
+type delivery[D any] struct {
+	delay    time.Duration
+	handlers []func(descriptor *D)
+}
+
+// deliver passes an announcement received from the wrapped transport on to
+// the handlers of every node it is not lost on the way to. Deliveries to each
+// node are delayed independently, so they arrive in order of their delay.
+func deliver[D any](n *Network, descriptor *D, handlersOf func(node *SimTransport) []func(*D)) {
+	n.mu.Lock()
+	announcer := n.announcers[descriptor]
+	var deliveries []delivery[D]
+	for _, name := range n.nodeNames() {
+		handlers := handlersOf(n.nodes[name])
+		if len(handlers) == 0 {
+			continue
+		}
+		if n.isPartitioned(announcer, name) {
+			transportSimAnnounceDebug.Tracef("Announcement from %s lost on the way to %s: partitioned", announcer, name)
+			continue
+		}
+		if n.chance(n.options.DropAnnouncementRate) {
+			transportSimAnnounceDebug.Tracef("Announcement from %s dropped on the way to %s", announcer, name)
+			continue
+		}
+		deliveries = append(deliveries, delivery[D]{delay: n.delay(), handlers: slices.Clone(handlers)})
+	}
+	n.mu.Unlock()
+
+	slices.SortStableFunc(deliveries, func(a, b delivery[D]) int {
+		return cmp.Compare(a.delay, b.delay)
+	})
+	startedAt := time.Now()
+	for _, delivery := range deliveries {
+		time.Sleep(delivery.delay - time.Since(startedAt))
+		for _, handler := range delivery.handlers {
+			handler(descriptor)
+		}
+	}
+}
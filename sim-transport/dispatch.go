@@ -0,0 +1,184 @@
+package simtransport
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// headerNode carries the name of the dispatching node to the wrapped
+// transport's handler, so it can pick a node the request can reach.
+const headerNode = "Zephyr-Sim-Node"
+
+func (c *SimTransport) Dispatch(serviceName string, res http.ResponseWriter, req *http.Request) error {
+	transportSimDispatchDebug.Tracef("Node %s dispatching request to service %s: %s %s",
+		c.Name, serviceName, req.Method, req.URL.Path)
+
+	n := c.network
+	n.mu.Lock()
+	nodeNames := n.dispatchNodes[serviceName]
+	isReachable := len(nodeNames) == 0 || slices.ContainsFunc(nodeNames, func(name string) bool {
+		return !n.isPartitioned(c.Name, name)
+	})
+	if !isReachable {
+		n.mu.Unlock()
+		transportSimDispatchDebug.Tracef("Node %s is partitioned from service %s", c.Name, serviceName)
+		return fmt.Errorf("%w: %s cannot reach service %s", ErrPartitioned, c.Name, serviceName)
+	}
+	delay := n.delay()
+	isFailed := n.chance(n.options.DispatchFailureRate)
+	isTruncated := !isFailed && n.chance(n.options.TruncateBodyRate)
+	var requestLimit, responseLimit int64
+	if isTruncated {
+		requestLimit = n.truncateAfter()
+		responseLimit = n.truncateAfter()
+	}
+	n.mu.Unlock()
+
+	time.Sleep(delay)
+	if isFailed {
+		transportSimDispatchDebug.Tracef("Request from %s to service %s failed", c.Name, serviceName)
+		return fmt.Errorf("%w: request from %s to service %s was lost", ErrDispatchFailed, c.Name, serviceName)
+	}
+
+	outReq := req.Clone(req.Context())
+	outReq.Header.Set(headerNode, c.Name)
+	// Trailers are set on the original request once its body has been read,
+	// so the clone shares its trailer map.
+	outReq.Trailer = req.Trailer
+	if !isTruncated {
+		return n.Transport.Dispatch(serviceName, res, outReq)
+	}
+
+	transportSimDispatchDebug.Tracef("Truncating request body after %d bytes and response body after %d bytes",
+		requestLimit, responseLimit)
+	if outReq.Body != nil && outReq.Body != http.NoBody {
+		outReq.Body = &truncatedBody{ReadCloser: outReq.Body, remaining: requestLimit}
+	}
+	truncatedRes := &truncatedResponseWriter{ResponseWriter: res, remaining: responseLimit}
+	if err := n.Transport.Dispatch(serviceName, truncatedRes, outReq); err != nil {
+		return err
+	}
+	if truncatedRes.isTruncated {
+		return fmt.Errorf("%w: response body from service %s was truncated", io.ErrUnexpectedEOF, serviceName)
+	}
+	return nil
+}
+
+func (c *SimTransport) BindDispatch(serviceName string, handler func(res http.ResponseWriter, req *http.Request)) error {
+	transportSimDispatchDebug.Tracef("Node %s binding dispatch handler for service %s", c.Name, serviceName)
+	n := c.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.dispatchNodes[serviceName]) == 0 {
+		if err := n.Transport.BindDispatch(serviceName, func(res http.ResponseWriter, req *http.Request) {
+			n.serveDispatch(serviceName, res, req)
+		}); err != nil {
+			return err
+		}
+	}
+	if c.dispatchHandlers == nil {
+		c.dispatchHandlers = map[string]func(res http.ResponseWriter, req *http.Request){}
+	}
+	c.dispatchHandlers[serviceName] = handler
+	if !slices.Contains(n.dispatchNodes[serviceName], c.Name) {
+		n.dispatchNodes[serviceName] = append(n.dispatchNodes[serviceName], c.Name)
+	}
+	return nil
+}
+
+func (c *SimTransport) UnbindDispatch(serviceName string) error {
+	transportSimDispatchDebug.Tracef("Node %s unbinding dispatch handler for service %s", c.Name, serviceName)
+	n := c.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(c.dispatchHandlers, serviceName)
+	nodeNames := slices.DeleteFunc(n.dispatchNodes[serviceName], func(name string) bool {
+		return name == c.Name
+	})
+	if len(nodeNames) > 0 {
+		n.dispatchNodes[serviceName] = nodeNames
+		return nil
+	}
+	if _, ok := n.dispatchNodes[serviceName]; !ok {
+		return nil
+	}
+	delete(n.dispatchNodes, serviceName)
+	return n.Transport.UnbindDispatch(serviceName)
+}
+
+// serveDispatch hands a request received from the wrapped transport to one of
+// the nodes with the service bound which the dispatching node can reach.
+func (n *Network) serveDispatch(serviceName string, res http.ResponseWriter, req *http.Request) {
+	dispatcher := req.Header.Get(headerNode)
+	req.Header.Del(headerNode)
+
+	n.mu.Lock()
+	var handlers []func(res http.ResponseWriter, req *http.Request)
+	for _, name := range n.dispatchNodes[serviceName] {
+		if n.isPartitioned(dispatcher, name) {
+			continue
+		}
+		if handler, ok := n.nodes[name].dispatchHandlers[serviceName]; ok {
+			handlers = append(handlers, handler)
+		}
+	}
+	var handler func(res http.ResponseWriter, req *http.Request)
+	if len(handlers) > 0 {
+		handler = handlers[n.rng.IntN(len(handlers))]
+	}
+	n.mu.Unlock()
+
+	if handler == nil {
+		panic(fmt.Errorf("%w: %s cannot reach service %s", ErrPartitioned, dispatcher, serviceName))
+	}
+	handler(res, req)
+}
+
+// truncatedBody is a request body which ends early, as though the connection
+// it was arriving on was lost.
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// truncatedResponseWriter discards everything written after its limit, as
+// though the connection the response was leaving on was lost.
+type truncatedResponseWriter struct {
+	http.ResponseWriter
+	remaining   int64
+	isTruncated bool
+}
+
+func (w *truncatedResponseWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= w.remaining {
+		n, err := w.ResponseWriter.Write(p)
+		w.remaining -= int64(n)
+		return n, err
+	}
+	w.isTruncated = true
+	n, err := w.ResponseWriter.Write(p[:w.remaining])
+	w.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, io.ErrShortWrite
+}
+
+func (w *truncatedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,223 @@
+package simtransport
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/telemetrytv/trace"
+	"github.com/telemetrytv/zephyr"
+)
+
+var (
+	transportSimDebug         = trace.Bind("zephyr:transport:sim")
+	transportSimAnnounceDebug = trace.Bind("zephyr:transport:sim:announce")
+	transportSimDispatchDebug = trace.Bind("zephyr:transport:sim:dispatch")
+)
+
+// DefaultTruncateAfter is the default upper bound on how many bytes of a body
+// get through before it is truncated.
+const DefaultTruncateAfter = 512
+
+// ErrPartitioned is returned by Dispatch when every node with the service
+// bound is partitioned from the dispatching node.
+var ErrPartitioned = errors.New("simtransport: network is partitioned")
+
+// ErrDispatchFailed is returned by Dispatch when the network fails a request
+// before it reaches the service.
+var ErrDispatchFailed = errors.New("simtransport: dispatch failed")
+
+// Options configures the faults a Network injects. Rates are probabilities
+// between 0 and 1. The zero value injects no faults at all.
+type Options struct {
+
+	// Latency is how long every announcement and request takes to arrive.
+	Latency time.Duration
+
+	// Jitter is the upper bound of a random delay added to Latency.
+	Jitter time.Duration
+
+	// DropAnnouncementRate is the chance of an announcement not reaching each
+	// of the nodes listening for it.
+	DropAnnouncementRate float64
+
+	// DispatchFailureRate is the chance of a request failing with
+	// ErrDispatchFailed before it reaches the service.
+	DispatchFailureRate float64
+
+	// TruncateBodyRate is the chance of a request's bodies being cut short.
+	// The service reads io.ErrUnexpectedEOF at the end of the truncated
+	// request body, and Dispatch returns io.ErrUnexpectedEOF once the response
+	// body has been cut short.
+	TruncateBodyRate float64
+
+	// TruncateAfter is the upper bound on how many bytes of a truncated body
+	// get through. If zero, DefaultTruncateAfter is used.
+	TruncateAfter int
+}
+
+// Network simulates an unreliable network between named nodes on top of
+// another transport. Each node is a transport of its own, created with Node,
+// for a gateway, service or client to use. Announcements and requests between
+// nodes go through the wrapped transport, with faults injected on the way as
+// configured by the network's Options. Every random decision is drawn from a
+// single RNG seeded when the network is created, so a test which drives the
+// network from one goroutine sees the same faults on every run.
+//
+// Nodes may also be partitioned from one another, after which announcements
+// between them are lost and requests between them fail with ErrPartitioned.
+// Partitions only apply to announcements which the wrapped transport delivers
+// in the same process, as localtransport does.
+type Network struct {
+	Transport zephyr.Transport
+
+	mu                     sync.Mutex
+	options                Options
+	rng                    *rand.Rand
+	nodes                  map[string]*SimTransport
+	partitions             map[[2]string]bool
+	announcers             map[any]string
+	isGatewayAnnounceBound bool
+	isServiceAnnounceBound bool
+	dispatchNodes          map[string][]string
+}
+
+// NewNetwork creates a Network on top of the given transport, drawing every
+// random decision from an RNG seeded with seed. Options may be given to
+// configure the faults the network injects, otherwise none are.
+func NewNetwork(transport zephyr.Transport, seed uint64, options ...Options) *Network {
+	transportSimDebug.Tracef("Creating simulated network with seed %d", seed)
+	network := &Network{
+		Transport:     transport,
+		rng:           rand.New(rand.NewPCG(seed, seed)),
+		nodes:         map[string]*SimTransport{},
+		partitions:    map[[2]string]bool{},
+		announcers:    map[any]string{},
+		dispatchNodes: map[string][]string{},
+	}
+	if len(options) > 0 {
+		network.options = options[0]
+	}
+	return network
+}
+
+// SetOptions replaces the faults the network injects. The RNG carries on from
+// where it was, so the sequence of faults stays reproducible.
+func (n *Network) SetOptions(options Options) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.options = options
+}
+
+// Node returns the transport of the node with the given name, creating it if
+// it does not exist yet.
+func (n *Network) Node(name string) *SimTransport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if node, ok := n.nodes[name]; ok {
+		return node
+	}
+	transportSimDebug.Tracef("Adding node %s", name)
+	node := &SimTransport{Name: name, network: n}
+	n.nodes[name] = node
+	return node
+}
+
+// Partition stops announcements and requests passing between nodes a and b,
+// in both directions.
+func (n *Network) Partition(a string, b string) {
+	transportSimDebug.Tracef("Partitioning %s from %s", a, b)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions[partitionKey(a, b)] = true
+}
+
+// Heal undoes a partition between nodes a and b.
+func (n *Network) Heal(a string, b string) {
+	transportSimDebug.Tracef("Healing partition between %s and %s", a, b)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.partitions, partitionKey(a, b))
+}
+
+// HealAll undoes every partition.
+func (n *Network) HealAll() {
+	transportSimDebug.Trace("Healing all partitions")
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	clear(n.partitions)
+}
+
+func partitionKey(a string, b string) [2]string {
+	if b < a {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// isPartitioned reports whether nodes a and b are partitioned. A node is never
+// partitioned from itself, nor from a node the network does not know about.
+// It must be called with mu held.
+func (n *Network) isPartitioned(a string, b string) bool {
+	if a == "" || b == "" || a == b {
+		return false
+	}
+	return n.partitions[partitionKey(a, b)]
+}
+
+// chance reports whether an event with the given probability happens. It must
+// be called with mu held.
+func (n *Network) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	return n.rng.Float64() < rate
+}
+
+// delay returns how long a message takes to arrive. It must be called with mu
+// held.
+func (n *Network) delay() time.Duration {
+	delay := n.options.Latency
+	if n.options.Jitter > 0 {
+		delay += time.Duration(n.rng.Int64N(int64(n.options.Jitter)))
+	}
+	return delay
+}
+
+// truncateAfter returns how many bytes of a truncated body get through. It
+// must be called with mu held.
+func (n *Network) truncateAfter() int64 {
+	limit := n.options.TruncateAfter
+	if limit <= 0 {
+		limit = DefaultTruncateAfter
+	}
+	return n.rng.Int64N(int64(limit))
+}
+
+// nodeNames returns the names of the nodes in a stable order, so random
+// decisions made for each of them are reproducible. It must be called with mu
+// held.
+func (n *Network) nodeNames() []string {
+	names := make([]string, 0, len(n.nodes))
+	for name := range n.nodes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// SimTransport is the transport of a single node on a simulated Network.
+type SimTransport struct {
+	Name string
+
+	network *Network
+
+	gatewayAnnounceHandlers []func(gatewayDescriptor *zephyr.GatewayDescriptor)
+	serviceAnnounceHandlers []func(serviceDescriptor *zephyr.ServiceDescriptor)
+	dispatchHandlers        map[string]func(res http.ResponseWriter, req *http.Request)
+}
+
+var _ zephyr.Transport = &SimTransport{}
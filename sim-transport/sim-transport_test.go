@@ -0,0 +1,181 @@
+package simtransport_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+	localtransport "github.com/telemetrytv/zephyr/local-transport"
+	simtransport "github.com/telemetrytv/zephyr/sim-transport"
+	"github.com/telemetrytv/zephyr/transporttest"
+)
+
+func newEchoRouter() *navaros.Router {
+	router := navaros.NewRouter()
+	router.PublicPost("/echo", func(ctx *navaros.Context) {
+		body, err := io.ReadAll(ctx.RequestBodyReader())
+		if err != nil {
+			ctx.Status = http.StatusBadRequest
+			ctx.Body = err.Error()
+			return
+		}
+		ctx.Body = body
+	})
+	return router
+}
+
+func startService(t *testing.T, transport zephyr.Transport) *zephyr.Service {
+	t.Helper()
+	s := zephyr.NewService("testService", transport, newEchoRouter())
+	require.NoError(t, s.Start())
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func startGateway(t *testing.T, transport zephyr.Transport) *zephyr.Gateway {
+	t.Helper()
+	g := zephyr.NewGateway("testGateway", transport)
+	require.NoError(t, g.Start())
+	t.Cleanup(g.Stop)
+	return g
+}
+
+func postEcho(g *zephyr.Gateway, body string) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "http://example.com/echo", strings.NewReader(body))
+	g.ServeHTTP(res, req)
+	return res
+}
+
+func TestNetwork(t *testing.T) {
+	t.Run("Passes announcements and requests through when no faults are configured", func(t *testing.T) {
+		network := simtransport.NewNetwork(localtransport.New(), 1)
+		startService(t, network.Node("service"))
+		g := startGateway(t, network.Node("gateway"))
+
+		res := postEcho(g, "test body")
+
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "test body", res.Body.String())
+	})
+
+	t.Run("Loses announcements between partitioned nodes", func(t *testing.T) {
+		network := simtransport.NewNetwork(localtransport.New(), 1)
+		network.Partition("gateway", "service")
+		startService(t, network.Node("service"))
+		g := startGateway(t, network.Node("gateway"))
+
+		res := postEcho(g, "test body")
+
+		assert.Equal(t, http.StatusNotFound, res.Code)
+	})
+
+	t.Run("Fails requests between partitioned nodes until healed", func(t *testing.T) {
+		network := simtransport.NewNetwork(localtransport.New(), 1)
+		startService(t, network.Node("service"))
+		client := zephyr.NewClient(network.Node("client")).Service("testService")
+
+		network.Partition("client", "service")
+		_, err := client.Post("/echo", "text/plain", strings.NewReader("test body"))
+		assert.ErrorIs(t, err, simtransport.ErrPartitioned)
+
+		network.Heal("client", "service")
+		res, err := client.Post("/echo", "text/plain", strings.NewReader("test body"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("Drops announcements", func(t *testing.T) {
+		network := simtransport.NewNetwork(localtransport.New(), 1, simtransport.Options{
+			DropAnnouncementRate: 1,
+		})
+		startService(t, network.Node("service"))
+		g := startGateway(t, network.Node("gateway"))
+
+		res := postEcho(g, "test body")
+
+		assert.Equal(t, http.StatusNotFound, res.Code)
+	})
+
+	t.Run("Fails dispatches", func(t *testing.T) {
+		network := simtransport.NewNetwork(localtransport.New(), 1, simtransport.Options{
+			DispatchFailureRate: 1,
+		})
+		startService(t, network.Node("service"))
+		client := zephyr.NewClient(network.Node("client")).Service("testService")
+
+		_, err := client.Post("/echo", "text/plain", strings.NewReader("test body"))
+
+		assert.ErrorIs(t, err, simtransport.ErrDispatchFailed)
+	})
+
+	t.Run("Truncates request and response bodies", func(t *testing.T) {
+		network := simtransport.NewNetwork(localtransport.New(), 1, simtransport.Options{
+			TruncateBodyRate: 1,
+			TruncateAfter:    4,
+		})
+		startService(t, network.Node("service"))
+		client := zephyr.NewClient(network.Node("client")).Service("testService")
+
+		_, err := client.Post("/echo", "text/plain", strings.NewReader("a body well over four bytes long"))
+
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("Delays requests by the configured latency", func(t *testing.T) {
+		network := simtransport.NewNetwork(localtransport.New(), 1)
+		startService(t, network.Node("service"))
+		client := zephyr.NewClient(network.Node("client")).Service("testService")
+		network.SetOptions(simtransport.Options{
+			Latency: 20 * time.Millisecond,
+			Jitter:  10 * time.Millisecond,
+		})
+
+		startedAt := time.Now()
+		_, err := client.Post("/echo", "text/plain", strings.NewReader("test body"))
+
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(startedAt), 20*time.Millisecond)
+	})
+
+	t.Run("Injects the same faults for the same seed", func(t *testing.T) {
+		run := func(seed uint64) []bool {
+			network := simtransport.NewNetwork(localtransport.New(), seed, simtransport.Options{
+				DispatchFailureRate: 0.5,
+			})
+			startService(t, network.Node("service"))
+			client := zephyr.NewClient(network.Node("client")).Service("testService")
+			var failures []bool
+			for range 32 {
+				_, err := client.Post("/echo", "text/plain", strings.NewReader("test body"))
+				failures = append(failures, errors.Is(err, simtransport.ErrDispatchFailed))
+			}
+			return failures
+		}
+
+		first := run(42)
+		assert.Equal(t, first, run(42))
+		assert.Contains(t, first, true)
+		assert.Contains(t, first, false)
+	})
+}
+
+func TestNetwork_Conformance(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T, n int) []zephyr.Transport {
+		network := simtransport.NewNetwork(localtransport.New(), 1)
+		transports := make([]zephyr.Transport, n)
+		for i := range transports {
+			transports[i] = network.Node(fmt.Sprintf("node-%d", i))
+		}
+		return transports
+	})
+}
@@ -0,0 +1,128 @@
+package zephyr
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// InstanceIDHeader is set on every response by the service instance which
+// handled the request. A ServiceClient can be pinned to the instance with
+// Instance, so later requests reach the same one.
+const InstanceIDHeader = "Zephyr-Instance-Id"
+
+// ErrInstanceUnavailable is returned by InstanceDispatcher.DispatchInstance
+// when no instance with the given ID is bound, for example because it has
+// stopped. Nothing of the request has been consumed when it is returned, so
+// it can be dispatched again to any instance.
+var ErrInstanceUnavailable = errors.New("service instance unavailable")
+
+// InstanceDispatcher is an optional interface implemented by transports which
+// can dispatch a request to one particular instance of a service, rather than
+// to any instance bound to its name. Services announce the ID of their
+// transport's instance, which allows gateways to route requests with the same
+// StickyKey to the same instance.
+type InstanceDispatcher interface {
+
+	// InstanceID returns the ID of the instance handlers bound with
+	// BindDispatch on this transport are reachable at.
+	InstanceID() string
+
+	// DispatchInstance works like Dispatch, but only dispatches to the
+	// instance with the given ID, returning ErrInstanceUnavailable if it is not
+	// bound.
+	DispatchInstance(serviceName string, instanceID string, res http.ResponseWriter, req *http.Request) error
+}
+
+// StickyKey returns the key used to route a request to a service instance.
+// Requests with the same key are dispatched to the same instance for as long
+// as the set of instances does not change. If it returns an empty string the
+// request is dispatched to any instance. routeDescriptor is the route the
+// request was resolved to.
+type StickyKey func(req *http.Request, routeDescriptor *RouteDescriptor) string
+
+// StickyCookie routes requests by the value of the named cookie.
+func StickyCookie(name string) StickyKey {
+	return func(req *http.Request, _ *RouteDescriptor) string {
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+}
+
+// StickyHeader routes requests by the value of the named header.
+func StickyHeader(name string) StickyKey {
+	return func(req *http.Request, _ *RouteDescriptor) string {
+		return req.Header.Get(name)
+	}
+}
+
+// StickyPathParam routes requests by the value of the named parameter of the
+// route they were resolved to. Requests to routes without the parameter are
+// dispatched to any instance.
+func StickyPathParam(name string) StickyKey {
+	return func(req *http.Request, routeDescriptor *RouteDescriptor) string {
+		if routeDescriptor == nil || routeDescriptor.Pattern == nil {
+			return ""
+		}
+		params, ok := routeDescriptor.Pattern.Match(req.URL.Path)
+		if !ok {
+			return ""
+		}
+		return params.Get(name)
+	}
+}
+
+// stickyHashRingReplicas is the number of points each instance has on a hash
+// ring. More points spread keys more evenly between instances.
+const stickyHashRingReplicas = 128
+
+// hashRing maps keys to instance IDs by consistent hashing, so that adding or
+// removing an instance only moves the keys of that instance.
+type hashRing struct {
+	hashes      []uint64
+	instanceIDs map[uint64]string
+}
+
+func newHashRing(instanceIDs []string) *hashRing {
+	ring := &hashRing{
+		hashes:      make([]uint64, 0, len(instanceIDs)*stickyHashRingReplicas),
+		instanceIDs: make(map[uint64]string, len(instanceIDs)*stickyHashRingReplicas),
+	}
+	for _, instanceID := range instanceIDs {
+		for i := 0; i < stickyHashRingReplicas; i++ {
+			hash := hashKey(instanceID + "#" + strconv.Itoa(i))
+			ring.hashes = append(ring.hashes, hash)
+			ring.instanceIDs[hash] = instanceID
+		}
+	}
+	slices.Sort(ring.hashes)
+	return ring
+}
+
+// get returns the instance ID the key maps to, or false if the ring is empty.
+func (r *hashRing) get(key string) (string, bool) {
+	if len(r.hashes) == 0 {
+		return "", false
+	}
+	hash := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.instanceIDs[r.hashes[i]], true
+}
+
+// hashKey hashes keys and instance IDs onto the ring. FNV and similar hashes
+// spread short keys which differ only in their last characters, such as
+// sequential user IDs, unevenly, so a cryptographic hash is used instead.
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,196 @@
+package zephyr_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+	localtransport "github.com/telemetrytv/zephyr/local-transport"
+)
+
+// stickyNetwork connects transports which each have their own instance ID.
+// Announcements and dispatches to any instance go through a shared local
+// transport.
+type stickyNetwork struct {
+	*localtransport.LocalTransport
+
+	mu       sync.Mutex
+	handlers map[string]func(res http.ResponseWriter, req *http.Request)
+}
+
+func newStickyNetwork() *stickyNetwork {
+	return &stickyNetwork{
+		LocalTransport: localtransport.New(),
+		handlers:       map[string]func(res http.ResponseWriter, req *http.Request){},
+	}
+}
+
+func (n *stickyNetwork) transport(instanceID string) *stickyTransport {
+	return &stickyTransport{LocalTransport: n.LocalTransport, network: n, instanceID: instanceID}
+}
+
+type stickyTransport struct {
+	*localtransport.LocalTransport
+	network    *stickyNetwork
+	instanceID string
+}
+
+var _ zephyr.InstanceDispatcher = &stickyTransport{}
+
+func (c *stickyTransport) InstanceID() string {
+	return c.instanceID
+}
+
+func (c *stickyTransport) BindDispatch(serviceName string, handler func(res http.ResponseWriter, req *http.Request)) error {
+	c.network.mu.Lock()
+	c.network.handlers[serviceName+"/"+c.instanceID] = handler
+	c.network.mu.Unlock()
+	return c.LocalTransport.BindDispatch(serviceName, handler)
+}
+
+func (c *stickyTransport) UnbindDispatch(serviceName string) error {
+	c.network.mu.Lock()
+	delete(c.network.handlers, serviceName+"/"+c.instanceID)
+	c.network.mu.Unlock()
+	return nil
+}
+
+func (c *stickyTransport) DispatchInstance(serviceName string, instanceID string, res http.ResponseWriter, req *http.Request) error {
+	c.network.mu.Lock()
+	handler, ok := c.network.handlers[serviceName+"/"+instanceID]
+	c.network.mu.Unlock()
+	if !ok {
+		return zephyr.ErrInstanceUnavailable
+	}
+	handler(res, req)
+	return nil
+}
+
+func TestGateway_StickyKey(t *testing.T) {
+	startServices := func(t *testing.T, network *stickyNetwork, instanceIDs ...string) map[string]*zephyr.Service {
+		services := map[string]*zephyr.Service{}
+		for _, instanceID := range instanceIDs {
+			routeDescriptor, err := zephyr.NewRouteDescriptor("GET", "/users/:userID")
+			require.NoError(t, err)
+			s := zephyr.NewService("testService", network.transport(instanceID), func(ctx *navaros.Context) {
+				ctx.Status = http.StatusOK
+			})
+			s.RouteDescriptors = []*zephyr.RouteDescriptor{routeDescriptor}
+			require.NoError(t, s.Start())
+			services[instanceID] = s
+		}
+		return services
+	}
+	request := func(g *zephyr.Gateway, path string, userID string) string {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		if userID != "" {
+			req.AddCookie(&http.Cookie{Name: "user", Value: userID})
+		}
+		g.ServeHTTP(res, req)
+		return res.Header().Get(zephyr.InstanceIDHeader)
+	}
+
+	t.Run("Routes requests with the same key to the same instance", func(t *testing.T) {
+		network := newStickyNetwork()
+		g := zephyr.NewGateway("testGateway", network.transport("gateway"))
+		g.StickyKey = zephyr.StickyCookie("user")
+		require.NoError(t, g.Start())
+		startServices(t, network, "instance-a", "instance-b", "instance-c")
+
+		seenInstanceIDs := map[string]bool{}
+		for i := 0; i < 50; i++ {
+			userID := "user-" + strconv.Itoa(i)
+			instanceID := request(g, "/users/1", userID)
+			require.NotEmpty(t, instanceID)
+			for j := 0; j < 3; j++ {
+				assert.Equal(t, instanceID, request(g, "/users/1", userID))
+			}
+			seenInstanceIDs[instanceID] = true
+		}
+		assert.Len(t, seenInstanceIDs, 3)
+	})
+
+	t.Run("Routes requests to other instances once an instance stops", func(t *testing.T) {
+		network := newStickyNetwork()
+		g := zephyr.NewGateway("testGateway", network.transport("gateway"))
+		g.StickyKey = zephyr.StickyCookie("user")
+		require.NoError(t, g.Start())
+		services := startServices(t, network, "instance-a", "instance-b")
+
+		var userID string
+		for i := 0; userID == ""; i++ {
+			if request(g, "/users/1", "user-"+strconv.Itoa(i)) == "instance-a" {
+				userID = "user-" + strconv.Itoa(i)
+			}
+		}
+		services["instance-a"].Stop()
+
+		assert.NotEmpty(t, request(g, "/users/1", userID))
+		assert.Equal(t, "instance-b", request(g, "/users/1", userID))
+	})
+
+	t.Run("Routes requests without a key to any instance", func(t *testing.T) {
+		network := newStickyNetwork()
+		g := zephyr.NewGateway("testGateway", network.transport("gateway"))
+		g.StickyKey = zephyr.StickyCookie("user")
+		require.NoError(t, g.Start())
+		startServices(t, network, "instance-a", "instance-b")
+
+		assert.NotEmpty(t, request(g, "/users/1", ""))
+	})
+
+	t.Run("Routes requests by path parameter", func(t *testing.T) {
+		network := newStickyNetwork()
+		g := zephyr.NewGateway("testGateway", network.transport("gateway"))
+		g.StickyKey = zephyr.StickyPathParam("userID")
+		require.NoError(t, g.Start())
+		startServices(t, network, "instance-a", "instance-b", "instance-c")
+
+		seenInstanceIDs := map[string]bool{}
+		for i := 0; i < 50; i++ {
+			path := "/users/" + strconv.Itoa(i)
+			instanceID := request(g, path, "")
+			assert.Equal(t, instanceID, request(g, path, "other-cookie"))
+			seenInstanceIDs[instanceID] = true
+		}
+		assert.Len(t, seenInstanceIDs, 3)
+	})
+}
+
+func TestStickyHeader(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Session", "abc")
+	assert.Equal(t, "abc", zephyr.StickyHeader("X-Session")(req, nil))
+	assert.Equal(t, "", zephyr.StickyHeader("X-Other")(req, nil))
+}
+
+func TestServiceClient_Instance(t *testing.T) {
+	network := newStickyNetwork()
+	for _, instanceID := range []string{"instance-a", "instance-b"} {
+		s := zephyr.NewService("testService", network.transport(instanceID), func(ctx *navaros.Context) {
+			ctx.Status = http.StatusOK
+		})
+		require.NoError(t, s.Start())
+	}
+	client := zephyr.NewClient(network.transport("client"))
+
+	t.Run("Dispatches to the pinned instance", func(t *testing.T) {
+		res, err := client.Service("testService").Instance("instance-a").Get("/")
+		require.NoError(t, err)
+		assert.Equal(t, "instance-a", res.Header.Get(zephyr.InstanceIDHeader))
+	})
+
+	t.Run("Dispatches to any instance if the pinned one is unavailable", func(t *testing.T) {
+		res, err := client.Service("testService").Instance("instance-z").Get("/")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.NotEqual(t, "instance-z", res.Header.Get(zephyr.InstanceIDHeader))
+	})
+}
@@ -0,0 +1,171 @@
+package zephyr
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/telemetrytv/trace"
+)
+
+var (
+	transportMiddlewareDebug = trace.Bind("zephyr:transport:middleware")
+)
+
+// DispatchFunc dispatches a request to a service, as Transport.Dispatch does.
+type DispatchFunc func(serviceName string, res http.ResponseWriter, req *http.Request) error
+
+// AnnounceServiceFunc announces a service, as Transport.AnnounceService does.
+type AnnounceServiceFunc func(serviceDescriptor *ServiceDescriptor) error
+
+// AnnounceGatewayFunc announces a gateway, as Transport.AnnounceGateway does.
+type AnnounceGatewayFunc func(gatewayDescriptor *GatewayDescriptor) error
+
+// TransportMiddleware intercepts calls made to a transport wrapped with
+// WrapTransport, for cross-cutting behaviour such as logging, metrics, auth
+// or fault injection. Each field is optional, and is given the next function
+// in the chain to call, or not, as it sees fit.
+type TransportMiddleware struct {
+
+	// Dispatch intercepts requests dispatched through the transport, by
+	// gateways and clients. It also intercepts requests dispatched to a
+	// specific instance of a service.
+	Dispatch func(next DispatchFunc) DispatchFunc
+
+	// DispatchHandler intercepts requests arriving at the handlers services
+	// bind with BindDispatch. It is called once for each handler as it is
+	// bound. Panics raised by the returned handler are returned to the caller
+	// as a *RemoteError, as they are for the handler itself.
+	DispatchHandler func(serviceName string, next http.HandlerFunc) http.HandlerFunc
+
+	// AnnounceService intercepts service announcements.
+	AnnounceService func(next AnnounceServiceFunc) AnnounceServiceFunc
+
+	// AnnounceGateway intercepts gateway announcements.
+	AnnounceGateway func(next AnnounceGatewayFunc) AnnounceGatewayFunc
+}
+
+// MiddlewareTransport is a transport wrapped with middleware by WrapTransport.
+// It implements the optional interfaces ConnectionNotifier, ReadinessReporter
+// and InstanceDispatcher by passing them on to the wrapped transport, falling
+// back to the behaviour of a transport without them.
+type MiddlewareTransport struct {
+	Transport  Transport
+	Middleware []TransportMiddleware
+
+	dispatch        DispatchFunc
+	announceService AnnounceServiceFunc
+	announceGateway AnnounceGatewayFunc
+}
+
+var _ Transport = &MiddlewareTransport{}
+var _ ConnectionNotifier = &MiddlewareTransport{}
+var _ ReadinessReporter = &MiddlewareTransport{}
+var _ InstanceDispatcher = &MiddlewareTransport{}
+
+// WrapTransport wraps a transport with middleware. The first middleware given
+// is the outermost, so it sees each call first and each result last.
+func WrapTransport(transport Transport, middleware ...TransportMiddleware) *MiddlewareTransport {
+	transportMiddlewareDebug.Tracef("Wrapping transport with %d middleware", len(middleware))
+	c := &MiddlewareTransport{
+		Transport:       transport,
+		Middleware:      middleware,
+		announceService: transport.AnnounceService,
+		announceGateway: transport.AnnounceGateway,
+	}
+	c.dispatch = c.chainDispatch(transport.Dispatch)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		if middleware[i].AnnounceService != nil {
+			c.announceService = middleware[i].AnnounceService(c.announceService)
+		}
+		if middleware[i].AnnounceGateway != nil {
+			c.announceGateway = middleware[i].AnnounceGateway(c.announceGateway)
+		}
+	}
+	return c
+}
+
+// Unwrap returns the wrapped transport.
+func (c *MiddlewareTransport) Unwrap() Transport {
+	return c.Transport
+}
+
+func (c *MiddlewareTransport) chainDispatch(dispatch DispatchFunc) DispatchFunc {
+	for i := len(c.Middleware) - 1; i >= 0; i-- {
+		if c.Middleware[i].Dispatch != nil {
+			dispatch = c.Middleware[i].Dispatch(dispatch)
+		}
+	}
+	return dispatch
+}
+
+func (c *MiddlewareTransport) AnnounceGateway(gatewayDescriptor *GatewayDescriptor) error {
+	return c.announceGateway(gatewayDescriptor)
+}
+
+func (c *MiddlewareTransport) BindGatewayAnnounce(handler func(gatewayDescriptor *GatewayDescriptor)) error {
+	return c.Transport.BindGatewayAnnounce(handler)
+}
+
+func (c *MiddlewareTransport) UnbindGatewayAnnounce() error {
+	return c.Transport.UnbindGatewayAnnounce()
+}
+
+func (c *MiddlewareTransport) AnnounceService(serviceDescriptor *ServiceDescriptor) error {
+	return c.announceService(serviceDescriptor)
+}
+
+func (c *MiddlewareTransport) BindServiceAnnounce(handler func(serviceDescriptor *ServiceDescriptor)) error {
+	return c.Transport.BindServiceAnnounce(handler)
+}
+
+func (c *MiddlewareTransport) UnbindServiceAnnounce() error {
+	return c.Transport.UnbindServiceAnnounce()
+}
+
+func (c *MiddlewareTransport) Dispatch(serviceName string, res http.ResponseWriter, req *http.Request) error {
+	return c.dispatch(serviceName, res, req)
+}
+
+func (c *MiddlewareTransport) BindDispatch(serviceName string, handler func(res http.ResponseWriter, req *http.Request)) error {
+	wrappedHandler := http.HandlerFunc(handler)
+	for i := len(c.Middleware) - 1; i >= 0; i-- {
+		if c.Middleware[i].DispatchHandler != nil {
+			wrappedHandler = c.Middleware[i].DispatchHandler(serviceName, wrappedHandler)
+		}
+	}
+	return c.Transport.BindDispatch(serviceName, wrappedHandler)
+}
+
+func (c *MiddlewareTransport) UnbindDispatch(serviceName string) error {
+	return c.Transport.UnbindDispatch(serviceName)
+}
+
+// InstanceID returns the instance ID of the wrapped transport, or an empty
+// string if it is not an InstanceDispatcher.
+func (c *MiddlewareTransport) InstanceID() string {
+	if instanceDispatcher, ok := c.Transport.(InstanceDispatcher); ok {
+		return instanceDispatcher.InstanceID()
+	}
+	return ""
+}
+
+// DispatchInstance dispatches the request to the given instance through the
+// Dispatch middleware. If the wrapped transport is not an InstanceDispatcher,
+// it returns ErrInstanceUnavailable so callers fall back to Dispatch.
+func (c *MiddlewareTransport) DispatchInstance(serviceName string, instanceID string, res http.ResponseWriter, req *http.Request) error {
+	instanceDispatcher, ok := c.Transport.(InstanceDispatcher)
+	if !ok {
+		return fmt.Errorf("%w: transport cannot dispatch to instance %s", ErrInstanceUnavailable, instanceID)
+	}
+	return c.chainDispatch(func(serviceName string, res http.ResponseWriter, req *http.Request) error {
+		return instanceDispatcher.DispatchInstance(serviceName, instanceID, res, req)
+	})(serviceName, res, req)
+}
+
+func (c *MiddlewareTransport) BindConnectionChange(handler func(isConnected bool)) (func(), error) {
+	return bindConnectionChange(c.Transport, handler)
+}
+
+func (c *MiddlewareTransport) Ready() error {
+	return transportReady(c.Transport)
+}
@@ -0,0 +1,151 @@
+package zephyr_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+	localtransport "github.com/telemetrytv/zephyr/local-transport"
+)
+
+// recordingMiddleware appends its name to calls each time it intercepts one.
+func recordingMiddleware(name string, calls *[]string) zephyr.TransportMiddleware {
+	return zephyr.TransportMiddleware{
+		Dispatch: func(next zephyr.DispatchFunc) zephyr.DispatchFunc {
+			return func(serviceName string, res http.ResponseWriter, req *http.Request) error {
+				*calls = append(*calls, name+" dispatch "+serviceName)
+				return next(serviceName, res, req)
+			}
+		},
+		DispatchHandler: func(serviceName string, next http.HandlerFunc) http.HandlerFunc {
+			return func(res http.ResponseWriter, req *http.Request) {
+				*calls = append(*calls, name+" handle "+serviceName)
+				next(res, req)
+			}
+		},
+		AnnounceService: func(next zephyr.AnnounceServiceFunc) zephyr.AnnounceServiceFunc {
+			return func(serviceDescriptor *zephyr.ServiceDescriptor) error {
+				*calls = append(*calls, name+" announce service "+serviceDescriptor.Name)
+				return next(serviceDescriptor)
+			}
+		},
+		AnnounceGateway: func(next zephyr.AnnounceGatewayFunc) zephyr.AnnounceGatewayFunc {
+			return func(gatewayDescriptor *zephyr.GatewayDescriptor) error {
+				*calls = append(*calls, name+" announce gateway "+gatewayDescriptor.Name)
+				return next(gatewayDescriptor)
+			}
+		},
+	}
+}
+
+func TestWrapTransport(t *testing.T) {
+	t.Run("Will call chained middleware in order", func(t *testing.T) {
+		var calls []string
+		transport := zephyr.WrapTransport(localtransport.New(),
+			recordingMiddleware("outer", &calls),
+			recordingMiddleware("inner", &calls),
+		)
+
+		router := navaros.NewRouter()
+		router.PublicGet("/", func(ctx *navaros.Context) {
+			ctx.Status = http.StatusNoContent
+		})
+		service := zephyr.NewService("testService", transport, router)
+		require.NoError(t, service.Start())
+		defer service.Stop()
+		assert.Equal(t, []string{
+			"outer announce service testService",
+			"inner announce service testService",
+		}, calls)
+
+		calls = nil
+		gateway := zephyr.NewGateway("testGateway", transport)
+		require.NoError(t, gateway.Start())
+		defer gateway.Stop()
+		assert.Equal(t, []string{
+			"outer announce gateway testGateway",
+			"inner announce gateway testGateway",
+			"outer announce service testService",
+			"inner announce service testService",
+		}, calls)
+
+		calls = nil
+		res := httptest.NewRecorder()
+		gateway.ServeHTTP(res, httptest.NewRequest("GET", "http://example.com/", nil))
+		assert.Equal(t, http.StatusNoContent, res.Code)
+		assert.Equal(t, []string{
+			"outer dispatch testService",
+			"inner dispatch testService",
+			"outer handle testService",
+			"inner handle testService",
+		}, calls)
+	})
+
+	t.Run("Will let middleware stop a call reaching the transport", func(t *testing.T) {
+		transport := zephyr.WrapTransport(localtransport.New(), zephyr.TransportMiddleware{
+			AnnounceService: func(next zephyr.AnnounceServiceFunc) zephyr.AnnounceServiceFunc {
+				return func(serviceDescriptor *zephyr.ServiceDescriptor) error {
+					return nil
+				}
+			},
+			DispatchHandler: func(serviceName string, next http.HandlerFunc) http.HandlerFunc {
+				return func(res http.ResponseWriter, req *http.Request) {
+					if req.Header.Get("Authorization") == "" {
+						res.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					next(res, req)
+				}
+			},
+		})
+
+		router := navaros.NewRouter()
+		router.PublicGet("/", func(ctx *navaros.Context) {
+			ctx.Status = http.StatusNoContent
+		})
+		service := zephyr.NewService("testService", transport, router)
+		require.NoError(t, service.Start())
+		defer service.Stop()
+		gateway := zephyr.NewGateway("testGateway", transport)
+		require.NoError(t, gateway.Start())
+		defer gateway.Stop()
+
+		res := httptest.NewRecorder()
+		gateway.ServeHTTP(res, httptest.NewRequest("GET", "http://example.com/", nil))
+		assert.Equal(t, http.StatusNotFound, res.Code)
+
+		client := zephyr.NewClient(transport).Service("testService")
+		clientRes, err := client.Get("/")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, clientRes.StatusCode)
+	})
+
+	t.Run("Will pass on the optional interfaces of the wrapped transport", func(t *testing.T) {
+		reconnecting := newReconnectingTransport()
+		transport := zephyr.WrapTransport(reconnecting)
+		gateway := zephyr.NewGateway("testGateway", transport)
+		require.NoError(t, gateway.Start())
+		defer gateway.Stop()
+
+		reconnecting.setConnected(false)
+		assert.ErrorContains(t, gateway.Ready(), "disconnected")
+
+		gatewayAnnouncements, _ := reconnecting.announcements()
+		reconnecting.setConnected(true)
+		afterGatewayAnnouncements, _ := reconnecting.announcements()
+		assert.NoError(t, gateway.Ready())
+		assert.Equal(t, gatewayAnnouncements+1, afterGatewayAnnouncements)
+	})
+
+	t.Run("Will report instances as unavailable if the wrapped transport cannot dispatch to them", func(t *testing.T) {
+		transport := zephyr.WrapTransport(localtransport.New())
+
+		assert.Empty(t, transport.InstanceID())
+		err := transport.DispatchInstance("testService", "instance", httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		assert.ErrorIs(t, err, zephyr.ErrInstanceUnavailable)
+	})
+}
@@ -4,6 +4,18 @@ import (
 	"net/http"
 )
 
+// Transport facilitates communication between gateways, services, and clients.
+//
+// Dispatch streams a request to one of the handlers bound to a service name
+// with BindDispatch, and streams the handler's response back to res. If the
+// handler hijacks its response writer, for example to accept a WebSocket,
+// Dispatch must hijack res with HijackConn and tunnel bytes in both
+// directions between the two connections until either side closes. Dispatch
+// returns only once the tunnel is closed.
+//
+// Handlers bound with BindDispatch report failures by panicking. Dispatch
+// must recover the panic on the service's side, and return it to the caller
+// as a *RemoteError created with NewRemoteError.
 type Transport interface {
 	AnnounceGateway(gatewayDescriptor *GatewayDescriptor) error
 	BindGatewayAnnounce(handler func(gatewayDescriptor *GatewayDescriptor)) error
@@ -17,3 +29,42 @@ type Transport interface {
 	BindDispatch(serviceName string, handler func(res http.ResponseWriter, req *http.Request)) error
 	UnbindDispatch(serviceName string) error
 }
+
+// ConnectionNotifier is an optional interface implemented by transports whose
+// connection can be lost and restored, such as a connection to a NATS server.
+// Gateways and services started on such a transport announce themselves again
+// as soon as the connection is restored, rather than waiting for the next
+// announcement to happen to arrive.
+type ConnectionNotifier interface {
+
+	// BindConnectionChange calls handler whenever the transport loses or
+	// regains its connection. The returned function unbinds the handler.
+	BindConnectionChange(handler func(isConnected bool)) (unbind func(), err error)
+}
+
+// ReadinessReporter is an optional interface implemented by transports which
+// can report whether they are currently able to carry messages. Ready returns
+// nil if they are, or an error describing why not.
+type ReadinessReporter interface {
+	Ready() error
+}
+
+// transportReady reports the readiness of a transport, which is always ready
+// if it does not implement ReadinessReporter.
+func transportReady(transport Transport) error {
+	if readinessReporter, ok := transport.(ReadinessReporter); ok {
+		return readinessReporter.Ready()
+	}
+	return nil
+}
+
+// bindConnectionChange binds handler to the transport's connection changes, if
+// the transport implements ConnectionNotifier. The returned function unbinds
+// it, and does nothing otherwise.
+func bindConnectionChange(transport Transport, handler func(isConnected bool)) (func(), error) {
+	connectionNotifier, ok := transport.(ConnectionNotifier)
+	if !ok {
+		return func() {}, nil
+	}
+	return connectionNotifier.BindConnectionChange(handler)
+}
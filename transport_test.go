@@ -0,0 +1,174 @@
+package zephyr_test
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/telemetrytv/zephyr"
+	localtransport "github.com/telemetrytv/zephyr/local-transport"
+)
+
+// reconnectingTransport is a local transport which can be made to appear to
+// lose and regain its connection.
+type reconnectingTransport struct {
+	*localtransport.LocalTransport
+
+	mu                   sync.Mutex
+	err                  error
+	connectionHandlers   []func(isConnected bool)
+	gatewayAnnouncements int
+	serviceAnnouncements int
+}
+
+var _ zephyr.ConnectionNotifier = &reconnectingTransport{}
+var _ zephyr.ReadinessReporter = &reconnectingTransport{}
+
+func newReconnectingTransport() *reconnectingTransport {
+	return &reconnectingTransport{LocalTransport: localtransport.New()}
+}
+
+func (c *reconnectingTransport) AnnounceGateway(gatewayDescriptor *zephyr.GatewayDescriptor) error {
+	c.mu.Lock()
+	c.gatewayAnnouncements++
+	c.mu.Unlock()
+	return c.LocalTransport.AnnounceGateway(gatewayDescriptor)
+}
+
+func (c *reconnectingTransport) AnnounceService(serviceDescriptor *zephyr.ServiceDescriptor) error {
+	c.mu.Lock()
+	c.serviceAnnouncements++
+	c.mu.Unlock()
+	return c.LocalTransport.AnnounceService(serviceDescriptor)
+}
+
+func (c *reconnectingTransport) BindConnectionChange(handler func(isConnected bool)) (func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	index := len(c.connectionHandlers)
+	c.connectionHandlers = append(c.connectionHandlers, handler)
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.connectionHandlers[index] = nil
+	}, nil
+}
+
+func (c *reconnectingTransport) Ready() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *reconnectingTransport) setConnected(isConnected bool) {
+	c.mu.Lock()
+	c.err = nil
+	if !isConnected {
+		c.err = errors.New("disconnected")
+	}
+	handlers := append([]func(bool){}, c.connectionHandlers...)
+	c.mu.Unlock()
+	for _, handler := range handlers {
+		if handler != nil {
+			handler(isConnected)
+		}
+	}
+}
+
+func (c *reconnectingTransport) announcements() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gatewayAnnouncements, c.serviceAnnouncements
+}
+
+func TestConnectionNotifier(t *testing.T) {
+	t.Run("Will announce the gateway and service again once reconnected", func(t *testing.T) {
+		transport := newReconnectingTransport()
+
+		gateway := zephyr.NewGateway("testGateway", transport)
+		assert.NoError(t, gateway.Start())
+		defer gateway.Stop()
+
+		service := zephyr.NewService("testService", transport, http.NotFoundHandler())
+		assert.NoError(t, service.Start())
+		defer service.Stop()
+
+		gatewayAnnouncements, serviceAnnouncements := transport.announcements()
+
+		transport.setConnected(false)
+		afterGatewayAnnouncements, afterServiceAnnouncements := transport.announcements()
+		assert.Equal(t, gatewayAnnouncements, afterGatewayAnnouncements)
+		assert.Equal(t, serviceAnnouncements, afterServiceAnnouncements)
+
+		transport.setConnected(true)
+		afterGatewayAnnouncements, afterServiceAnnouncements = transport.announcements()
+		assert.Equal(t, gatewayAnnouncements+1, afterGatewayAnnouncements)
+		assert.Less(t, serviceAnnouncements, afterServiceAnnouncements)
+	})
+
+	t.Run("Will not announce once stopped", func(t *testing.T) {
+		transport := newReconnectingTransport()
+
+		gateway := zephyr.NewGateway("testGateway", transport)
+		assert.NoError(t, gateway.Start())
+		service := zephyr.NewService("testService", transport, http.NotFoundHandler())
+		assert.NoError(t, service.Start())
+
+		gateway.Stop()
+		service.Stop()
+		gatewayAnnouncements, serviceAnnouncements := transport.announcements()
+
+		transport.setConnected(true)
+		afterGatewayAnnouncements, afterServiceAnnouncements := transport.announcements()
+		assert.Equal(t, gatewayAnnouncements, afterGatewayAnnouncements)
+		assert.Equal(t, serviceAnnouncements, afterServiceAnnouncements)
+	})
+}
+
+func TestReadinessReporter(t *testing.T) {
+	t.Run("Will report not ready until started", func(t *testing.T) {
+		transport := newReconnectingTransport()
+		gateway := zephyr.NewGateway("testGateway", transport)
+		service := zephyr.NewService("testService", transport, http.NotFoundHandler())
+
+		assert.Error(t, gateway.Ready())
+		assert.Error(t, service.Ready())
+
+		assert.NoError(t, gateway.Start())
+		assert.NoError(t, service.Start())
+		assert.NoError(t, gateway.Ready())
+		assert.NoError(t, service.Ready())
+
+		service.Stop()
+		gateway.Stop()
+		assert.Error(t, gateway.Ready())
+		assert.Error(t, service.Ready())
+	})
+
+	t.Run("Will report not ready while the transport is disconnected", func(t *testing.T) {
+		transport := newReconnectingTransport()
+		gateway := zephyr.NewGateway("testGateway", transport)
+		service := zephyr.NewService("testService", transport, http.NotFoundHandler())
+		assert.NoError(t, gateway.Start())
+		defer gateway.Stop()
+		assert.NoError(t, service.Start())
+		defer service.Stop()
+
+		transport.setConnected(false)
+		assert.ErrorContains(t, gateway.Ready(), "disconnected")
+		assert.ErrorContains(t, service.Ready(), "disconnected")
+
+		transport.setConnected(true)
+		assert.NoError(t, gateway.Ready())
+		assert.NoError(t, service.Ready())
+	})
+
+	t.Run("Will report ready for transports that do not report readiness", func(t *testing.T) {
+		gateway := zephyr.NewGateway("testGateway", localtransport.New())
+		assert.NoError(t, gateway.Start())
+		defer gateway.Stop()
+		assert.NoError(t, gateway.Ready())
+	})
+}
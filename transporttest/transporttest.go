@@ -0,0 +1,434 @@
+// Package transporttest provides a conformance suite for implementations of
+// zephyr.Transport. A transport which passes it announces, dispatches and
+// reports failures the way gateways, services and clients expect.
+//
+//	func TestMyTransport(t *testing.T) {
+//		transporttest.Run(t, func(t *testing.T, n int) []zephyr.Transport {
+//			...
+//		})
+//	}
+package transporttest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+)
+
+// SettleTime is how long the suite waits for announcements to arrive, and for
+// announcements which should not arrive to fail to.
+var SettleTime = 2 * time.Second
+
+// LargeBodySize is the size of the bodies sent by the suite to check that
+// bodies spanning many chunks arrive intact.
+var LargeBodySize = 1<<20 + 3
+
+// Factory creates n transports which can reach one another, as though each
+// were used by a different process. Transports which carry messages within a
+// single instance, such as a LocalTransport, may return the same transport n
+// times. The factory should close the transports it creates with t.Cleanup.
+type Factory func(t *testing.T, n int) []zephyr.Transport
+
+// Run runs the conformance suite against transports created by factory, each
+// check as a subtest of t.
+func Run(t *testing.T, factory Factory) {
+	t.Run("Delivers gateway announcements to every bound handler", func(t *testing.T) {
+		transports := factory(t, 3)
+		first := bindGatewayAnnounce(t, transports[1])
+		second := bindGatewayAnnounce(t, transports[2])
+
+		require.NoError(t, transports[0].AnnounceGateway(&zephyr.GatewayDescriptor{Name: "testGateway"}))
+
+		first.waitFor(t, "testGateway")
+		second.waitFor(t, "testGateway")
+	})
+
+	t.Run("Delivers service announcements to every bound handler", func(t *testing.T) {
+		transports := factory(t, 3)
+		first := bindServiceAnnounce(t, transports[1])
+		second := bindServiceAnnounce(t, transports[2])
+
+		require.NoError(t, transports[0].AnnounceService(&zephyr.ServiceDescriptor{
+			Name:         "testService",
+			GatewayNames: []string{"testGateway"},
+		}))
+
+		first.waitFor(t, "testService")
+		second.waitFor(t, "testService")
+	})
+
+	t.Run("Stops delivering gateway announcements once unbound", func(t *testing.T) {
+		transports := factory(t, 2)
+		announcements := bindGatewayAnnounce(t, transports[1])
+		require.NoError(t, transports[0].AnnounceGateway(&zephyr.GatewayDescriptor{Name: "before"}))
+		announcements.waitFor(t, "before")
+
+		require.NoError(t, transports[1].UnbindGatewayAnnounce())
+		require.NoError(t, transports[0].AnnounceGateway(&zephyr.GatewayDescriptor{Name: "after"}))
+
+		announcements.assertNever(t, "after")
+	})
+
+	t.Run("Stops delivering service announcements once unbound", func(t *testing.T) {
+		transports := factory(t, 2)
+		announcements := bindServiceAnnounce(t, transports[1])
+		require.NoError(t, transports[0].AnnounceService(&zephyr.ServiceDescriptor{Name: "before"}))
+		announcements.waitFor(t, "before")
+
+		require.NoError(t, transports[1].UnbindServiceAnnounce())
+		require.NoError(t, transports[0].AnnounceService(&zephyr.ServiceDescriptor{Name: "after"}))
+
+		announcements.assertNever(t, "after")
+	})
+
+	t.Run("Dispatches the request method, URL, host and headers", func(t *testing.T) {
+		transports := factory(t, 2)
+		var recvRequest *http.Request
+		bindDispatch(t, transports[1], "testService", func(res http.ResponseWriter, req *http.Request) {
+			recvRequest = req.Clone(req.Context())
+			res.WriteHeader(http.StatusNoContent)
+		})
+
+		req := httptest.NewRequest("PATCH", "http://example.com/items/1?fields=name&fields=size", nil)
+		req.Header.Set("Test-Header", "test-value")
+		req.Header.Add("Multi-Header", "one")
+		req.Header.Add("Multi-Header", "two")
+		res := httptest.NewRecorder()
+		require.NoError(t, transports[0].Dispatch("testService", res, req))
+
+		require.NotNil(t, recvRequest)
+		assert.Equal(t, "PATCH", recvRequest.Method)
+		assert.Equal(t, "/items/1", recvRequest.URL.Path)
+		assert.Equal(t, []string{"name", "size"}, recvRequest.URL.Query()["fields"])
+		assert.Equal(t, "example.com", recvRequest.Host)
+		assert.Equal(t, "test-value", recvRequest.Header.Get("Test-Header"))
+		assert.Equal(t, []string{"one", "two"}, recvRequest.Header.Values("Multi-Header"))
+	})
+
+	t.Run("Dispatches the response status code and headers", func(t *testing.T) {
+		transports := factory(t, 2)
+		bindDispatch(t, transports[1], "testService", func(res http.ResponseWriter, req *http.Request) {
+			var statusCode int
+			fmt.Sscan(strings.TrimPrefix(req.URL.Path, "/"), &statusCode)
+			res.Header().Set("Test-Header", "test-value")
+			res.Header().Add("Multi-Header", "one")
+			res.Header().Add("Multi-Header", "two")
+			res.WriteHeader(statusCode)
+		})
+
+		for _, statusCode := range []int{200, 201, 204, 301, 304, 400, 404, 500, 503} {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", fmt.Sprintf("/%d", statusCode), nil)
+			require.NoError(t, transports[0].Dispatch("testService", res, req))
+
+			assert.Equal(t, statusCode, res.Code)
+			assert.Equal(t, "test-value", res.Header().Get("Test-Header"))
+			assert.Equal(t, []string{"one", "two"}, res.Header().Values("Multi-Header"))
+		}
+	})
+
+	t.Run("Dispatches empty request and response bodies", func(t *testing.T) {
+		transports := factory(t, 2)
+		var recvBody []byte
+		var readErr error
+		bindDispatch(t, transports[1], "testService", func(res http.ResponseWriter, req *http.Request) {
+			if req.Body == nil {
+				readErr = fmt.Errorf("request body is nil")
+				return
+			}
+			recvBody, readErr = io.ReadAll(req.Body)
+		})
+
+		res := httptest.NewRecorder()
+		require.NoError(t, transports[0].Dispatch("testService", res, httptest.NewRequest("POST", "/", nil)))
+
+		assert.NoError(t, readErr)
+		assert.Empty(t, recvBody)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Empty(t, res.Body.Bytes())
+	})
+
+	t.Run("Dispatches bodies spanning many chunks", func(t *testing.T) {
+		transports := factory(t, 2)
+		bindDispatch(t, transports[1], "testService", func(res http.ResponseWriter, req *http.Request) {
+			io.Copy(res, req.Body)
+		})
+
+		body := make([]byte, LargeBodySize)
+		rand.Read(body)
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		require.NoError(t, transports[0].Dispatch("testService", res, req))
+
+		assert.Equal(t, len(body), res.Body.Len())
+		assert.True(t, bytes.Equal(body, res.Body.Bytes()), "response body differs from request body")
+	})
+
+	t.Run("Dispatches request trailers", func(t *testing.T) {
+		transports := factory(t, 2)
+		var recvTrailer http.Header
+		bindDispatch(t, transports[1], "testService", func(res http.ResponseWriter, req *http.Request) {
+			_, err := io.Copy(io.Discard, req.Body)
+			assert.NoError(t, err)
+			recvTrailer = req.Trailer.Clone()
+		})
+
+		for _, bodySize := range []int{16, LargeBodySize} {
+			req := httptest.NewRequest("POST", "/", nil)
+			req.Trailer = http.Header{"Checksum": nil}
+			req.Body = io.NopCloser(&trailerReader{
+				Reader:  bytes.NewReader(make([]byte, bodySize)),
+				request: req,
+				trailer: http.Header{"Checksum": {"abc123"}},
+			})
+			req.ContentLength = int64(bodySize)
+			res := httptest.NewRecorder()
+			require.NoError(t, transports[0].Dispatch("testService", res, req))
+
+			assert.Equal(t, "abc123", recvTrailer.Get("Checksum"), "body of %d bytes", bodySize)
+		}
+	})
+
+	t.Run("Dispatches announced and prefixed response trailers", func(t *testing.T) {
+		transports := factory(t, 2)
+		bindDispatch(t, transports[1], "testService", func(res http.ResponseWriter, req *http.Request) {
+			var bodySize int
+			fmt.Sscan(strings.TrimPrefix(req.URL.Path, "/"), &bodySize)
+			res.Header().Set("Trailer", "Checksum")
+			res.WriteHeader(http.StatusOK)
+			_, err := res.Write(make([]byte, bodySize))
+			assert.NoError(t, err)
+			res.Header().Set("Checksum", "abc123")
+			res.Header().Set(http.TrailerPrefix+"Row-Count", "7")
+		})
+
+		for _, bodySize := range []int{16, LargeBodySize} {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", fmt.Sprintf("/%d", bodySize), nil)
+			require.NoError(t, transports[0].Dispatch("testService", res, req))
+
+			result := res.Result()
+			assert.Equal(t, bodySize, res.Body.Len())
+			assert.Empty(t, result.Header.Values("Checksum"), "body of %d bytes", bodySize)
+			assert.Empty(t, result.Header.Values("Row-Count"), "body of %d bytes", bodySize)
+			assert.Equal(t, "abc123", result.Trailer.Get("Checksum"), "body of %d bytes", bodySize)
+			assert.Equal(t, "7", result.Trailer.Get("Row-Count"), "body of %d bytes", bodySize)
+		}
+	})
+
+	t.Run("Returns a remote error when the handler panics", func(t *testing.T) {
+		transports := factory(t, 2)
+		bindDispatch(t, transports[1], "testService", func(res http.ResponseWriter, req *http.Request) {
+			panic("test panic")
+		})
+
+		res := httptest.NewRecorder()
+		err := transports[0].Dispatch("testService", res, httptest.NewRequest("GET", "/", nil))
+
+		var remoteErr *zephyr.RemoteError
+		require.ErrorAs(t, err, &remoteErr)
+		assert.Equal(t, "testService", remoteErr.Service)
+		assert.Equal(t, "test panic", remoteErr.Message)
+		assert.NotEmpty(t, remoteErr.Stack)
+	})
+
+	t.Run("Handles concurrent dispatches", func(t *testing.T) {
+		transports := factory(t, 2)
+		bindDispatch(t, transports[1], "testService", func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Echo-Path", req.URL.Path)
+			io.Copy(res, req.Body)
+		})
+
+		var wg sync.WaitGroup
+		for i := range 32 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				path := fmt.Sprintf("/%d", i)
+				body := strings.Repeat(path, 1000)
+				res := httptest.NewRecorder()
+				err := transports[0].Dispatch("testService", res, httptest.NewRequest("POST", path, strings.NewReader(body)))
+				assert.NoError(t, err)
+				assert.Equal(t, path, res.Header().Get("Echo-Path"))
+				assert.Equal(t, body, res.Body.String())
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("Tunnels hijacked upgrade connections", func(t *testing.T) {
+		transports := factory(t, 2)
+		bindDispatch(t, transports[1], "testService", func(res http.ResponseWriter, req *http.Request) {
+			conn, brw, err := http.NewResponseController(res).Hijack()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			_, err = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+			assert.NoError(t, err)
+			assert.NoError(t, brw.Flush())
+
+			line, err := brw.ReadString('\n')
+			assert.NoError(t, err)
+			_, err = brw.WriteString("echo: " + line)
+			assert.NoError(t, err)
+			assert.NoError(t, brw.Flush())
+		})
+
+		dispatchErr := make(chan error, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			dispatchErr <- transports[0].Dispatch("testService", res, req)
+		}))
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+		require.NoError(t, err)
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+		_, err = conn.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "echo: hello\n", line)
+
+		rest, err := io.ReadAll(reader)
+		assert.NoError(t, err, "the connection was not closed once the handler closed its end")
+		assert.Empty(t, rest)
+		assert.NoError(t, <-dispatchErr)
+	})
+
+	t.Run("Returns an error when the service is not bound", func(t *testing.T) {
+		transports := factory(t, 2)
+
+		res := httptest.NewRecorder()
+		err := transports[0].Dispatch("unboundService", res, httptest.NewRequest("GET", "/", nil))
+
+		assert.Error(t, err)
+	})
+
+	t.Run("Stops dispatching once unbound", func(t *testing.T) {
+		transports := factory(t, 2)
+		var handlerCalls int
+		var mu sync.Mutex
+		bindDispatch(t, transports[1], "testService", func(res http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			handlerCalls++
+			mu.Unlock()
+		})
+		require.NoError(t, transports[0].Dispatch("testService", httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)))
+
+		require.NoError(t, transports[1].UnbindDispatch("testService"))
+		err := transports[0].Dispatch("testService", httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+		assert.Error(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, 1, handlerCalls)
+	})
+}
+
+func bindDispatch(t *testing.T, transport zephyr.Transport, serviceName string, handler func(res http.ResponseWriter, req *http.Request)) {
+	t.Helper()
+	require.NoError(t, transport.BindDispatch(serviceName, handler))
+	t.Cleanup(func() {
+		transport.UnbindDispatch(serviceName)
+	})
+}
+
+// announcements records the names of the gateways or services announced to a
+// handler.
+type announcements struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (a *announcements) add(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.names = append(a.names, name)
+}
+
+func (a *announcements) has(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Contains(a.names, name)
+}
+
+func (a *announcements) waitFor(t *testing.T, name string) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		return a.has(name)
+	}, SettleTime, 10*time.Millisecond, "announcement of %s was not delivered", name)
+}
+
+func (a *announcements) assertNever(t *testing.T, name string) {
+	t.Helper()
+	assert.Never(t, func() bool {
+		return a.has(name)
+	}, SettleTime/4, 10*time.Millisecond, "announcement of %s was delivered after unbinding", name)
+}
+
+func bindGatewayAnnounce(t *testing.T, transport zephyr.Transport) *announcements {
+	t.Helper()
+	announcements := &announcements{}
+	require.NoError(t, transport.BindGatewayAnnounce(func(gatewayDescriptor *zephyr.GatewayDescriptor) {
+		announcements.add(gatewayDescriptor.Name)
+	}))
+	t.Cleanup(func() {
+		transport.UnbindGatewayAnnounce()
+	})
+	return announcements
+}
+
+func bindServiceAnnounce(t *testing.T, transport zephyr.Transport) *announcements {
+	t.Helper()
+	announcements := &announcements{}
+	require.NoError(t, transport.BindServiceAnnounce(func(serviceDescriptor *zephyr.ServiceDescriptor) {
+		announcements.add(serviceDescriptor.Name)
+	}))
+	t.Cleanup(func() {
+		transport.UnbindServiceAnnounce()
+	})
+	return announcements
+}
+
+// trailerReader sets trailers on a request once its body has been read to the
+// end, as the HTTP server does.
+type trailerReader struct {
+	io.Reader
+	request *http.Request
+	trailer http.Header
+}
+
+func (r *trailerReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		for key, values := range r.trailer {
+			r.request.Trailer[key] = values
+		}
+	}
+	return n, err
+}
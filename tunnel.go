@@ -0,0 +1,129 @@
+package zephyr
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/telemetrytv/trace"
+)
+
+var (
+	tunnelDebug = trace.Bind("zephyr:tunnel")
+)
+
+// ErrHijackUnsupported is returned when a connection cannot be hijacked,
+// either because the request was not dispatched through a transport, or
+// because the response writer on the dispatching side does not support it.
+var ErrHijackUnsupported = errors.New("zephyr: connection hijacking is not supported")
+
+type responseWriterContextKey struct{}
+
+// IsUpgradeRequest reports whether the request asks to upgrade the connection
+// to another protocol, such as a WebSocket.
+func IsUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TransportResponseWriter returns the response writer given to a service by
+// its transport for the given request. Unlike the writer returned by a
+// Navaros context, it can be hijacked, which makes it suitable for use with
+// WebSocket libraries that expect an http.ResponseWriter. Once hijacked,
+// anything Navaros later writes to the response is discarded by the transport.
+func TransportResponseWriter(req *http.Request) (http.ResponseWriter, bool) {
+	res, ok := req.Context().Value(responseWriterContextKey{}).(http.ResponseWriter)
+	return res, ok
+}
+
+// Hijack takes over the connection of a request being handled by a service.
+// The returned connection is tunnelled through the transport to the client
+// connected to the gateway, so the handler is responsible for writing the
+// raw protocol response, such as a 101 Switching Protocols, itself.
+func Hijack(ctx *navaros.Context) (net.Conn, *bufio.ReadWriter, error) {
+	res, ok := TransportResponseWriter(ctx.Request())
+	if !ok {
+		return nil, nil, ErrHijackUnsupported
+	}
+	conn, brw, err := http.NewResponseController(res).Hijack()
+	if err != nil {
+		if errors.Is(err, http.ErrNotSupported) {
+			return nil, nil, ErrHijackUnsupported
+		}
+		return nil, nil, err
+	}
+	return conn, brw, nil
+}
+
+// HijackConn hijacks the connection behind res. Any bytes the client sent
+// which were already buffered by the HTTP server are returned by the first
+// reads from the connection. Transports use it on the dispatching side once a
+// service has hijacked its end of the connection.
+func HijackConn(res http.ResponseWriter) (io.ReadWriteCloser, error) {
+	conn, brw, err := http.NewResponseController(res).Hijack()
+	if err != nil {
+		if errors.Is(err, http.ErrNotSupported) {
+			return nil, ErrHijackUnsupported
+		}
+		return nil, err
+	}
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &hijackedConn{Reader: brw.Reader, Conn: conn}, nil
+}
+
+// Tunnel copies data in both directions between two connections until either
+// side closes, then closes both.
+func Tunnel(a io.ReadWriteCloser, b io.ReadWriteCloser) error {
+	tunnelDebug.Trace("Opening tunnel")
+
+	errChan := make(chan error, 2)
+	pipe := func(dst io.Writer, src io.Reader) {
+		_, err := io.Copy(dst, src)
+		errChan <- err
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+
+	err := <-errChan
+	a.Close()
+	b.Close()
+	<-errChan
+
+	tunnelDebug.Trace("Tunnel closed")
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		return nil
+	}
+	return err
+}
+
+// withTransportResponseWriter stores the transport's response writer in the
+// request context so TransportResponseWriter and Hijack can find it.
+func withTransportResponseWriter(res http.ResponseWriter, req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), responseWriterContextKey{}, res))
+}
+
+type hijackedConn struct {
+	*bufio.Reader
+	net.Conn
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
@@ -0,0 +1,190 @@
+package unixtransport
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	httptransport "github.com/telemetrytv/zephyr/http-transport"
+)
+
+// DirectoryPollInterval is how often a DirectoryRegistry checks its directory
+// for sockets which have appeared or gone stale.
+var DirectoryPollInterval = 250 * time.Millisecond
+
+// socketExt is the extension of the socket files transports bind.
+const socketExt = ".sock"
+
+// DirectoryRegistry finds peers by listing the sockets in a directory shared by
+// every transport on the host. Each transport binds its own socket in the
+// directory, so registering an address needs no bookkeeping; the socket file
+// is the registration. Sockets left behind by processes which exited without
+// closing their transport are removed once they refuse connections.
+type DirectoryRegistry struct {
+	Dir string
+
+	mu            sync.Mutex
+	done          chan struct{}
+	isWatching    bool
+	knownAddrs    map[string]bool
+	watchHandlers map[int]func(addr string)
+	nextWatchID   int
+}
+
+var _ httptransport.Registry = &DirectoryRegistry{}
+var _ httptransport.Watcher = &DirectoryRegistry{}
+
+// NewDirectoryRegistry creates a DirectoryRegistry for the given directory,
+// creating the directory if it does not exist, and removes any stale sockets
+// in it. The registry must be closed
+// with Close once it is no longer needed.
+func NewDirectoryRegistry(dir string) (*DirectoryRegistry, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+socketExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		removeStaleSocket(path)
+	}
+	return &DirectoryRegistry{
+		Dir:           dir,
+		done:          make(chan struct{}),
+		knownAddrs:    map[string]bool{},
+		watchHandlers: map[int]func(addr string){},
+	}, nil
+}
+
+// Register does nothing, as the socket bound by the transport registers it.
+func (r *DirectoryRegistry) Register(addr string) error {
+	return nil
+}
+
+// Deregister removes the socket file at addr.
+func (r *DirectoryRegistry) Deregister(addr string) error {
+	if err := os.Remove(addr); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Peers returns the path of every socket in the directory.
+func (r *DirectoryRegistry) Peers() ([]string, error) {
+	return filepath.Glob(filepath.Join(r.Dir, "*"+socketExt))
+}
+
+// Watch calls handler with the path of every socket which appears in the
+// directory. The directory is polled every DirectoryPollInterval.
+func (r *DirectoryRegistry) Watch(handler func(addr string)) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	watchID := r.nextWatchID
+	r.nextWatchID++
+	r.watchHandlers[watchID] = handler
+	if !r.isWatching {
+		r.isWatching = true
+		if addrs, err := r.Peers(); err == nil {
+			for _, addr := range addrs {
+				r.knownAddrs[addr] = true
+			}
+		}
+		go r.poll()
+	}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.watchHandlers, watchID)
+	}
+}
+
+// Close stops watching the directory.
+func (r *DirectoryRegistry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	return nil
+}
+
+func (r *DirectoryRegistry) poll() {
+	ticker := time.NewTicker(DirectoryPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.scan()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// scan calls the watch handlers for each socket not seen by the previous scan.
+func (r *DirectoryRegistry) scan() {
+	addrs, err := r.Peers()
+	if err != nil {
+		transportUnixDebug.Tracef("Failed to list sockets in %s: %v", r.Dir, err)
+		return
+	}
+
+	r.mu.Lock()
+	var newAddrs []string
+	for _, addr := range addrs {
+		if !r.knownAddrs[addr] {
+			newAddrs = append(newAddrs, addr)
+		}
+	}
+	for addr := range r.knownAddrs {
+		if !slices.Contains(addrs, addr) {
+			delete(r.knownAddrs, addr)
+		}
+	}
+	for _, addr := range newAddrs {
+		r.knownAddrs[addr] = true
+	}
+	var watchHandlers []func(addr string)
+	for _, handler := range r.watchHandlers {
+		watchHandlers = append(watchHandlers, handler)
+	}
+	r.mu.Unlock()
+
+	for _, addr := range newAddrs {
+		if removeStaleSocket(addr) {
+			continue
+		}
+		transportUnixDebug.Tracef("Found socket %s", addr)
+		for _, handler := range watchHandlers {
+			handler(addr)
+		}
+	}
+}
+
+// removeStaleSocket removes the socket at path if nothing is listening on it,
+// and reports whether it did.
+func removeStaleSocket(path string) bool {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return false
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return false
+	}
+	transportUnixDebug.Tracef("Removing stale socket %s", path)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		transportUnixDebug.Tracef("Failed to remove stale socket %s: %v", path, err)
+		return false
+	}
+	return true
+}
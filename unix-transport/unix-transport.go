@@ -0,0 +1,95 @@
+package unixtransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nuid"
+	"github.com/telemetrytv/trace"
+	"github.com/telemetrytv/zephyr"
+	httptransport "github.com/telemetrytv/zephyr/http-transport"
+)
+
+var (
+	transportUnixDebug = trace.Bind("zephyr:transport:unix")
+)
+
+// Options configures a UnixTransport. Any field left as its zero value falls
+// back to its default.
+type Options struct {
+
+	// Name is the name of the transport's socket within the shared directory,
+	// without its extension. It must be unique among the transports sharing
+	// the directory, and must not contain path separators. If empty, a random
+	// name is used.
+	Name string
+
+	// DispatchTimeout is how long to wait for a service to respond with its
+	// status and headers. If zero, httptransport.DispatchTimeout is used.
+	DispatchTimeout time.Duration
+
+	// AnnounceTimeout is how long to wait for a peer to accept an
+	// announcement, or to list the services bound to it. If zero,
+	// httptransport.AnnounceTimeout is used.
+	AnnounceTimeout time.Duration
+}
+
+// UnixTransport is a transport for gateways, services and clients which share
+// a host or pod. Each transport binds a socket in a shared directory, and
+// finds its peers by watching the directory for sockets. Requests are proxied
+// as HTTP over the socket of a transport with the service bound, so bodies are
+// streamed with the back-pressure of the socket itself.
+type UnixTransport struct {
+	*httptransport.HTTPTransport
+	Registry *DirectoryRegistry
+}
+
+var _ zephyr.Transport = &UnixTransport{}
+var _ zephyr.InstanceDispatcher = &UnixTransport{}
+var _ zephyr.ReadinessReporter = &UnixTransport{}
+
+// New creates a UnixTransport which binds a socket in dir, creating dir if it
+// does not exist. Options may be given to configure the transport, otherwise
+// the defaults are used. The transport must be closed with Close once it is no
+// longer needed.
+func New(dir string, options ...Options) (*UnixTransport, error) {
+	var opts Options
+	if len(options) > 0 {
+		opts = options[0]
+	}
+	if opts.Name == "" {
+		opts.Name = nuid.Next()
+	}
+	if strings.ContainsRune(opts.Name, filepath.Separator) {
+		return nil, fmt.Errorf("unixtransport: name %q must not contain path separators", opts.Name)
+	}
+
+	registry, err := NewDirectoryRegistry(dir)
+	if err != nil {
+		return nil, err
+	}
+	socketPath := filepath.Join(dir, opts.Name+socketExt)
+	transportUnixDebug.Tracef("Binding socket %s", socketPath)
+	httpTransport, err := httptransport.New(registry, httptransport.Options{
+		Network:         "unix",
+		ListenAddr:      socketPath,
+		DispatchTimeout: opts.DispatchTimeout,
+		AnnounceTimeout: opts.AnnounceTimeout,
+	})
+	if err != nil {
+		registry.Close()
+		return nil, err
+	}
+	return &UnixTransport{HTTPTransport: httpTransport, Registry: registry}, nil
+}
+
+// Close removes the transport's socket and stops watching the shared
+// directory. Requests already being handled are given until ctx is done to
+// complete.
+func (c *UnixTransport) Close(ctx context.Context) error {
+	return errors.Join(c.HTTPTransport.Close(ctx), c.Registry.Close())
+}
@@ -0,0 +1,165 @@
+package unixtransport_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/telemetrytv/zephyr"
+	"github.com/telemetrytv/zephyr/transporttest"
+	unixtransport "github.com/telemetrytv/zephyr/unix-transport"
+)
+
+// newSocketDir creates a directory for sockets. Test temp directories are
+// named after the test, which can push socket paths past their length limit.
+func newSocketDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "zephyr")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func newTransport(t *testing.T, dir string, name string) *unixtransport.UnixTransport {
+	t.Helper()
+	transport, err := unixtransport.New(dir, unixtransport.Options{
+		Name:            name,
+		DispatchTimeout: 2 * time.Second,
+		AnnounceTimeout: time.Second,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		transport.Close(context.Background())
+	})
+	return transport
+}
+
+func TestUnixTransport(t *testing.T) {
+	t.Run("Routes requests from a gateway to a service over a socket", func(t *testing.T) {
+		dir := newSocketDir(t)
+		router := navaros.NewRouter()
+		router.PublicPost("/echo/:name", func(ctx *navaros.Context) {
+			body, err := io.ReadAll(ctx.RequestBodyReader())
+			assert.NoError(t, err)
+			ctx.Status = http.StatusCreated
+			ctx.Body = ctx.Params().Get("name") + ": " + string(body)
+		})
+		s := zephyr.NewService("testService", newTransport(t, dir, "service"), router)
+		require.NoError(t, s.Start())
+		t.Cleanup(s.Stop)
+		g := zephyr.NewGateway("testGateway", newTransport(t, dir, "gateway"))
+		require.NoError(t, g.Start())
+		t.Cleanup(g.Stop)
+
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://example.com/echo/test", strings.NewReader("test body"))
+		g.ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusCreated, res.Code)
+		assert.Equal(t, "test: test body", res.Body.String())
+	})
+
+	t.Run("Sends announcements to transports which appear later", func(t *testing.T) {
+		dir := newSocketDir(t)
+		s := zephyr.NewService("testService", newTransport(t, dir, "service"), navaros.NewRouter())
+		require.NoError(t, s.Start())
+		t.Cleanup(s.Stop)
+
+		announced := make(chan string, 1)
+		transport := newTransport(t, dir, "late")
+		require.NoError(t, transport.BindServiceAnnounce(func(serviceDescriptor *zephyr.ServiceDescriptor) {
+			select {
+			case announced <- serviceDescriptor.Name:
+			default:
+			}
+		}))
+
+		select {
+		case name := <-announced:
+			assert.Equal(t, "testService", name)
+		case <-time.After(5 * time.Second):
+			t.Fatal("service announcement was not sent to the new transport")
+		}
+	})
+
+	t.Run("Removes its socket when closed", func(t *testing.T) {
+		dir := newSocketDir(t)
+		transport := newTransport(t, dir, "closed")
+		assert.FileExists(t, filepath.Join(dir, "closed.sock"))
+
+		require.NoError(t, transport.Close(context.Background()))
+
+		assert.NoFileExists(t, filepath.Join(dir, "closed.sock"))
+	})
+
+	t.Run("Rejects names containing path separators", func(t *testing.T) {
+		_, err := unixtransport.New(newSocketDir(t), unixtransport.Options{Name: "a/b"})
+		assert.Error(t, err)
+	})
+}
+
+func TestDirectoryRegistry(t *testing.T) {
+	t.Run("Removes sockets nothing is listening on", func(t *testing.T) {
+		dir := newSocketDir(t)
+		stalePath := filepath.Join(dir, "stale.sock")
+		listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: stalePath, Net: "unix"})
+		require.NoError(t, err)
+		listener.SetUnlinkOnClose(false)
+		listener.Close()
+		require.FileExists(t, stalePath)
+
+		registry, err := unixtransport.NewDirectoryRegistry(dir)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			registry.Close()
+		})
+
+		assert.NoFileExists(t, stalePath)
+		peers, err := registry.Peers()
+		assert.NoError(t, err)
+		assert.Empty(t, peers)
+	})
+
+	t.Run("Lists the sockets of live transports", func(t *testing.T) {
+		dir := newSocketDir(t)
+		newTransport(t, dir, "one")
+		newTransport(t, dir, "two")
+
+		registry, err := unixtransport.NewDirectoryRegistry(dir)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			registry.Close()
+		})
+
+		peers, err := registry.Peers()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{
+			filepath.Join(dir, "one.sock"),
+			filepath.Join(dir, "two.sock"),
+		}, peers)
+	})
+}
+
+func TestUnixTransport_Conformance(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T, n int) []zephyr.Transport {
+		dir := newSocketDir(t)
+		transports := make([]zephyr.Transport, n)
+		for i := range transports {
+			transports[i] = newTransport(t, dir, fmt.Sprintf("transport-%d", i))
+		}
+		return transports
+	})
+}
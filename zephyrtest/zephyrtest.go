@@ -0,0 +1,187 @@
+// Package zephyrtest runs a gateway and services in-process for integration
+// tests, so that requests can be made to them over real HTTP.
+//
+//	h := zephyrtest.New(t)
+//	h.AddService("items", itemsRouter)
+//	res, err := http.Get(h.URL + "/items/1")
+package zephyrtest
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/telemetrytv/zephyr"
+	localtransport "github.com/telemetrytv/zephyr/local-transport"
+)
+
+// DefaultGatewayName is the name of the gateway started by a Harness if no
+// GatewayName is given in its Options.
+const DefaultGatewayName = "testGateway"
+
+// SettleTimeout is how long a Harness waits for the gateway to discover a
+// service before failing the test.
+var SettleTimeout = 5 * time.Second
+
+// Options configures a Harness. Any field left as its zero value falls back to
+// its default.
+type Options struct {
+
+	// Transport is used by the gateway, the services and the client. If nil,
+	// a new LocalTransport is used.
+	Transport zephyr.Transport
+
+	// GatewayName is the name of the gateway. If empty, DefaultGatewayName is
+	// used.
+	GatewayName string
+}
+
+// Harness is a gateway, and any number of services, running in-process for the
+// duration of a test. The gateway is served by an httptest.Server at URL, and
+// Client can make requests to any service, including to its private routes.
+// Everything is stopped when the test finishes.
+type Harness struct {
+	Transport zephyr.Transport
+	Gateway   *zephyr.Gateway
+	Server    *httptest.Server
+	URL       string
+	Client    *zephyr.Client
+	Services  map[string]*zephyr.Service
+
+	t testing.TB
+}
+
+// New starts a gateway and serves it with an httptest.Server. Options may be
+// given to configure the harness, otherwise the defaults are used. The
+// gateway and server are stopped with t.Cleanup.
+func New(t testing.TB, options ...Options) *Harness {
+	t.Helper()
+	var opts Options
+	if len(options) > 0 {
+		opts = options[0]
+	}
+	if opts.Transport == nil {
+		opts.Transport = localtransport.New()
+	}
+	if opts.GatewayName == "" {
+		opts.GatewayName = DefaultGatewayName
+	}
+
+	gateway := zephyr.NewGateway(opts.GatewayName, opts.Transport)
+	if err := gateway.Start(); err != nil {
+		t.Fatalf("zephyrtest: failed to start gateway %s: %v", opts.GatewayName, err)
+	}
+	t.Cleanup(gateway.Stop)
+
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+
+	return &Harness{
+		Transport: opts.Transport,
+		Gateway:   gateway,
+		Server:    server,
+		URL:       server.URL,
+		Client:    zephyr.NewClient(opts.Transport),
+		Services:  map[string]*zephyr.Service{},
+		t:         t,
+	}
+}
+
+// AddService starts a service with the given name and handler, which may be
+// anything zephyr.NewService accepts, and waits for the gateway to discover
+// it. The service is stopped with t.Cleanup.
+func (h *Harness) AddService(name string, handler any) *zephyr.Service {
+	h.t.Helper()
+	service := zephyr.NewService(name, h.Transport, handler)
+	return h.StartService(service)
+}
+
+// StartService starts a service configured by the caller, and waits for the
+// gateway to discover it. The service is stopped with t.Cleanup.
+func (h *Harness) StartService(service *zephyr.Service) *zephyr.Service {
+	h.t.Helper()
+	if err := service.Start(); err != nil {
+		h.t.Fatalf("zephyrtest: failed to start service %s: %v", service.Name, err)
+	}
+	h.t.Cleanup(service.Stop)
+	h.Services[service.Name] = service
+	h.WaitForService(service.Name)
+	return service
+}
+
+// WaitForService waits for the gateway to discover the named service, failing
+// the test if it has not within SettleTimeout.
+func (h *Harness) WaitForService(name string) {
+	h.t.Helper()
+	deadline := time.Now().Add(SettleTimeout)
+	for {
+		if _, ok := h.serviceDescriptor(name); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("zephyrtest: gateway did not discover service %s within %s", name, SettleTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Routes returns the routes the named service has announced to the gateway,
+// each formatted as the method and pattern separated by a space, for example
+// "GET /items/:id".
+func (h *Harness) Routes(serviceName string) []string {
+	serviceDescriptor, ok := h.serviceDescriptor(serviceName)
+	if !ok {
+		return nil
+	}
+	routes := make([]string, 0, len(serviceDescriptor.RouteDescriptors))
+	for _, routeDescriptor := range serviceDescriptor.RouteDescriptors {
+		routes = append(routes, routeDescriptor.Method+" "+routeDescriptor.Pattern.String())
+	}
+	return routes
+}
+
+// AssertRoutes asserts that the named service has announced exactly the given
+// routes to the gateway, in any order. Routes are formatted as they are by
+// Routes.
+func (h *Harness) AssertRoutes(serviceName string, routes ...string) bool {
+	h.t.Helper()
+	if _, ok := h.serviceDescriptor(serviceName); !ok {
+		return assert.Fail(h.t, "service not discovered", "gateway has not discovered service %s", serviceName)
+	}
+	return assert.ElementsMatch(h.t, routes, h.Routes(serviceName), "routes announced by service %s", serviceName)
+}
+
+// AssertRoutedTo asserts that the gateway routes requests with the given
+// method and path to the named service.
+func (h *Harness) AssertRoutedTo(method string, path string, serviceName string) bool {
+	h.t.Helper()
+	serviceDescriptor, _, ok := h.Gateway.ResolveRoute(method, path)
+	if !ok {
+		return assert.Fail(h.t, "request not routed", "gateway does not route %s %s to any service", method, path)
+	}
+	return assert.Equal(h.t, serviceName, serviceDescriptor.Name, "service %s %s is routed to", method, path)
+}
+
+// AssertNotRouted asserts that the gateway does not route requests with the
+// given method and path to any service.
+func (h *Harness) AssertNotRouted(method string, path string) bool {
+	h.t.Helper()
+	serviceDescriptor, _, ok := h.Gateway.ResolveRoute(method, path)
+	if ok {
+		return assert.Fail(h.t, "request routed", "gateway routes %s %s to service %s", method, path, serviceDescriptor.Name)
+	}
+	return true
+}
+
+func (h *Harness) serviceDescriptor(name string) (*zephyr.ServiceDescriptor, bool) {
+	serviceDescriptors := h.Gateway.ServiceDescriptors()
+	index := slices.IndexFunc(serviceDescriptors, func(serviceDescriptor *zephyr.ServiceDescriptor) bool {
+		return serviceDescriptor.Name == name
+	})
+	if index == -1 {
+		return nil, false
+	}
+	return serviceDescriptors[index], true
+}
@@ -0,0 +1,84 @@
+package zephyrtest_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/RobertWHurst/navaros"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	httptransport "github.com/telemetrytv/zephyr/http-transport"
+	"github.com/telemetrytv/zephyr/zephyrtest"
+)
+
+func newItemsRouter() *navaros.Router {
+	router := navaros.NewRouter()
+	router.PublicGet("/items/:id", func(ctx *navaros.Context) {
+		ctx.Body = "item " + ctx.Params().Get("id")
+	})
+	router.PublicPost("/items", func(ctx *navaros.Context) {
+		ctx.Status = http.StatusCreated
+	})
+	router.Get("/internal/stats", func(ctx *navaros.Context) {
+		ctx.Body = "stats"
+	})
+	return router
+}
+
+func TestHarness(t *testing.T) {
+	t.Run("Serves services through the gateway over HTTP", func(t *testing.T) {
+		h := zephyrtest.New(t)
+		h.AddService("items", newItemsRouter())
+
+		res, err := http.Get(h.URL + "/items/1")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "item 1", string(body))
+	})
+
+	t.Run("Makes private routes reachable with the client", func(t *testing.T) {
+		h := zephyrtest.New(t)
+		h.AddService("items", newItemsRouter())
+
+		res, err := h.Client.Service("items").Get("/internal/stats")
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		h.AssertNotRouted("GET", "/internal/stats")
+	})
+
+	t.Run("Asserts the routes announced and the service they are routed to", func(t *testing.T) {
+		h := zephyrtest.New(t)
+		h.AddService("items", newItemsRouter())
+		h.AddService("users", func(res http.ResponseWriter, req *http.Request) {})
+
+		h.AssertRoutes("items", "GET /items/:id", "POST /items")
+		h.AssertRoutes("users")
+		h.AssertRoutedTo("GET", "/items/1", "items")
+		h.AssertRoutedTo("POST", "/items", "items")
+		h.AssertNotRouted("DELETE", "/items/1")
+	})
+
+	t.Run("Runs on the given transport", func(t *testing.T) {
+		transport, err := httptransport.New(httptransport.NewStaticRegistry())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			transport.Close(context.Background())
+		})
+		h := zephyrtest.New(t, zephyrtest.Options{Transport: transport, GatewayName: "edge"})
+		h.AddService("items", newItemsRouter())
+
+		res, err := http.Get(h.URL + "/items/2")
+		require.NoError(t, err)
+		res.Body.Close()
+
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "edge", h.Gateway.Name)
+	})
+}